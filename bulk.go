@@ -0,0 +1,122 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "strings"
+  "time"
+)
+
+// how long to wait before the first retry of a bulk post (doubled for each retry after that)
+var bulkRetryDelay = time.Second
+
+// bulkPoster collects the _bulk lines and posts them in batches instead of writing them out
+type bulkPoster struct {
+  url string
+  size int
+  retries int
+  client *http.Client
+  buf bytes.Buffer
+  count int
+}
+
+func newBulkPoster (url string, size int, retries int) (*bulkPoster) {
+  if size <= 0 {
+    size = 1000
+  }
+  return &bulkPoster{ url: url, size: size, retries: retries, client: &http.Client{ Timeout: time.Minute } }
+}
+
+// bulkIndex fills %Y, %m and %d of the index pattern from the time of the entry
+func bulkIndex (pattern string, t time.Time) (string) {
+  return strings.NewReplacer("%Y", t.Format("2006"), "%m", t.Format("01"), "%d", t.Format("02")).Replace(pattern)
+}
+
+// bulkLines is the action line and the document for one entry
+func bulkLines (pattern string, columns []string, fields map[string]string) ([]byte) {
+  t, err := time.Parse(time.RFC3339, fields["time"])
+  if err != nil {
+    t = time.Now()
+  }
+
+  action, _ := json.Marshal(map[string]map[string]string{ "index": { "_index": bulkIndex(pattern, t) } })
+  lines := append(action, '\n')
+  lines = append(lines, jsonColumns(columns, fields)...)
+  return append(lines, '\n')
+}
+
+// bulkResponse is the part of the _bulk response we look at
+type bulkResponse struct {
+  Errors bool `json:"errors"`
+  Items []map[string]struct {
+    Status int `json:"status"`
+  } `json:"items"`
+}
+
+// postBulk sends the collected batch, retrying connection errors, 429 and 5xx responses
+func postBulk (p *bulkPoster) (error) {
+  if p.count == 0 {
+    return nil
+  }
+
+  delay := bulkRetryDelay
+  var lastErr error
+  for attempt := 0; attempt <= p.retries; attempt++ {
+    if attempt > 0 {
+      time.Sleep(delay)
+      delay *= 2
+    }
+
+    resp, err := p.client.Post(p.url, "application/x-ndjson", bytes.NewReader(p.buf.Bytes()))
+    if err != nil {
+      lastErr = err
+      continue
+    }
+    body, err := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+      lastErr = fmt.Errorf("bulk post to %s: %s", p.url, resp.Status)
+      continue
+    }
+    if resp.StatusCode >= 300 {
+      return fmt.Errorf("bulk post to %s: %s: %s", p.url, resp.Status, body)
+    }
+    if err != nil {
+      return err
+    }
+
+    // documents that failed are reported but do not stop the export
+    var result bulkResponse
+    if json.Unmarshal(body, &result) == nil && result.Errors {
+      failed := 0
+      for _, item := range result.Items {
+        for _, action := range item {
+          if action.Status >= 300 {
+            failed++
+          }
+        }
+      }
+      fmt.Fprintf(diag, "bulk post: %d of %d documents failed\n", failed, p.count)
+    }
+
+    p.buf.Reset()
+    p.count = 0
+    return nil
+  }
+
+  return fmt.Errorf("giving up after %d attempts: %s", p.retries+1, lastErr)
+}
+
+// addBulk adds the lines for an entry and posts the batch once it is full
+func addBulk (p *bulkPoster, lines []byte) (error) {
+  p.buf.Write(lines)
+  p.count++
+  if p.count >= p.size {
+    return postBulk(p)
+  }
+  return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestBulkIndex (t *testing.T) {
+  got := bulkIndex("web-%Y.%m.%d", time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC))
+  if got != "web-2017.09.01" {
+    t.Errorf("wrong index %s", got)
+  }
+}
+
+func TestBulkExport (t *testing.T) {
+  out := testExport(t, "bulk", []string{ "time", "ip", "campus" }, testCSVLines[:2])
+
+  lines := strings.Split(strings.TrimSpace(out), "\n")
+  if len(lines) != 4 {
+    t.Errorf("expected an action and a document per entry:\n%s", out)
+    return
+  }
+  if lines[0] != `{"index":{"_index":"logparse-2017.09.01"}}` {
+    t.Errorf("wrong action line %s", lines[0])
+  }
+  if lines[1] != `{"time":"2017-09-01T00:00:08-04:00","ip":"10.241.26.100","campus":"on"}` {
+    t.Errorf("wrong document %s", lines[1])
+  }
+}
+
+// testBulkServer answers the first fail requests with a 503 and records the bodies of the rest
+func testBulkServer (fail int, response string) (*httptest.Server, *[]string) {
+  var lock sync.Mutex
+  var bodies []string
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    lock.Lock()
+    defer lock.Unlock()
+    if fail > 0 {
+      fail--
+      w.WriteHeader(http.StatusServiceUnavailable)
+      return
+    }
+    body, _ := io.ReadAll(r.Body)
+    bodies = append(bodies, string(body))
+    if r.Header.Get("Content-Type") != "application/x-ndjson" {
+      w.WriteHeader(http.StatusBadRequest)
+      return
+    }
+    io.WriteString(w, response)
+  }))
+  return server, &bodies
+}
+
+func testBulkPost (t *testing.T, url string, size int, retries int, lines []string) (error) {
+  bulkRetryDelay = time.Millisecond
+  config, _ := testIPRanges()
+
+  var buf bytes.Buffer
+  ew, _ := newExportWriter(&buf, "bulk", defaultExportColumns)
+  ew.post = newBulkPoster(url, size, retries)
+  err := exportLog(config, strings.NewReader(strings.Join(lines, "\n")), ew, initSummaryMeta())
+  if err == nil {
+    err = finishExport(ew)
+  }
+  if buf.Len() != 0 {
+    t.Errorf("posted lines were also written out:\n%s", buf.String())
+  }
+  return err
+}
+
+func TestBulkPostBatches (t *testing.T) {
+  server, bodies := testBulkServer(1, `{"errors":false,"items":[]}`)
+  defer server.Close()
+
+  err := testBulkPost(t, server.URL + "/_bulk", 2, 2, testCSVLines)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  // three entries in batches of two and the first post is retried
+  if len(*bodies) != 2 || strings.Count((*bodies)[0], "\n") != 4 || strings.Count((*bodies)[1], "\n") != 2 {
+    t.Errorf("wrong batches: %q", *bodies)
+    return
+  }
+
+  var action map[string]map[string]string
+  json.Unmarshal([]byte(strings.SplitN((*bodies)[1], "\n", 2)[0]), &action)
+  if action["index"]["_index"] != "logparse-2017.09.01" {
+    t.Errorf("wrong action %+v", action)
+  }
+}
+
+func TestBulkPostGivesUp (t *testing.T) {
+  server, bodies := testBulkServer(10, "")
+  defer server.Close()
+
+  err := testBulkPost(t, server.URL, 10, 2, testCSVLines)
+  if err == nil || len(*bodies) != 0 {
+    t.Errorf("expected to give up after 3 attempts (err=%v)", err)
+  }
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+  "bytes"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// The chargeback report splits the cloudfront estimate (the same sums calc_aws_costs.py does) between the
+// departments that own the vhosts and sites.  Only the counted requests are charged (on and off campus, the
+// ignored ones never reach the cdn) and whatever no department owns ends up in unallocated.
+
+const unallocatedDepartment = "unallocated"
+
+// departmentConfig is one department of the -departments file
+type departmentConfig struct {
+  Name string `json:"name"`
+  // vhosts the department owns outright (every site on them)
+  VHosts []string `json:"vhosts,omitempty"`
+  // toplevel paths (met for /met) the department owns on the vhosts nobody owns
+  Sites []string `json:"sites,omitempty"`
+  Note string `json:"note,omitempty"`
+}
+
+type departmentsFile struct {
+  Departments []departmentConfig `json:"departments"`
+}
+
+// departmentMap finds the department of a vhost or site (the status of the patterns is the department index)
+type departmentMap struct {
+  names []string
+  vhosts map[string]int
+  vhostPatterns []statusPattern
+  sites map[string]int
+  sitePatterns []statusPattern
+}
+
+// readDepartments reads the department mapping in yaml, toml or json (worked out the same way as for the config)
+func readDepartments (filename string) (departmentMap, error) {
+  file, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return departmentMap{}, err
+  }
+
+  var tree interface{}
+  switch configFormat(filename, file) {
+  case "yaml":
+    tree, err = parseYAML(string(file))
+  case "toml":
+    tree, err = parseTOML(string(file))
+  default:
+    err = json.Unmarshal(file, &tree)
+  }
+  if err != nil {
+    return departmentMap{}, fmt.Errorf("%s: %s", filename, err)
+  }
+
+  var typed departmentsFile
+  data, err := json.Marshal(tree)
+  if err == nil {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    err = decoder.Decode(&typed)
+  }
+  if err != nil {
+    return departmentMap{}, fmt.Errorf("%s: %s", filename, err)
+  }
+
+  depts, err := buildDepartments(typed)
+  if err != nil {
+    return departmentMap{}, fmt.Errorf("%s: %s", filename, err)
+  }
+  return depts, nil
+}
+
+// buildDepartments checks the names and that no vhost or site belongs to two departments
+func buildDepartments (typed departmentsFile) (departmentMap, error) {
+  depts := departmentMap{ vhosts: make(map[string]int), sites: make(map[string]int) }
+  owner := make(map[string]string)
+
+  for num, item := range typed.Departments {
+    if item.Name == "" || item.Name == unallocatedDepartment {
+      return departmentMap{}, fmt.Errorf("departments[%d]: needs a name (other than %s)", num, unallocatedDepartment)
+    }
+    for _, name := range depts.names {
+      if name == item.Name {
+        return departmentMap{}, fmt.Errorf("departments[%d]: %s is listed twice", num, item.Name)
+      }
+    }
+
+    for _, section := range []struct { kind string; names []string; exact map[string]int; patterns *[]statusPattern } {
+      { "vhost", item.VHosts, depts.vhosts, &depts.vhostPatterns },
+      { "site", item.Sites, depts.sites, &depts.sitePatterns },
+    } {
+      for _, name := range section.names {
+        key := section.kind + " " + name
+        if owner[key] != "" {
+          return departmentMap{}, fmt.Errorf("departments[%d]: %s already belongs to %s", num, key, owner[key])
+        }
+        owner[key] = item.Name
+        err := addStatusRule(section.exact, section.patterns, name, len(depts.names))
+        if err != nil {
+          return departmentMap{}, fmt.Errorf("departments[%d]: %s", num, err)
+        }
+      }
+    }
+    depts.names = append(depts.names, item.Name)
+  }
+  return depts, nil
+}
+
+// findDepartment is the department of a vhost or site name (exact names first and then the patterns)
+func findDepartment (names []string, exact map[string]int, patterns []statusPattern, name string) (string, bool) {
+  num, _, ok := findStatusRule(exact, patterns, name)
+  if !ok {
+    return "", false
+  }
+  return names[num], true
+}
+
+// cloudfrontCost is the monthly estimate of calc_aws_costs.py - the tiered bandwidth (with 2 kbytes added for each
+// request) and the https requests plus the waf
+func cloudfrontCost (requests int, bytes int64) (float64, float64) {
+  tbytes := chargebackKBytes(requests, bytes) / (1024*1024*1024)
+
+  bandwidth := 0.0
+  if tbytes > 50.0 {
+    bandwidth += (tbytes - 50.0) * 60
+    tbytes = 50.0
+  }
+  if tbytes > 10.0 {
+    bandwidth += (tbytes - 10.0) * 80
+    tbytes = 10.0
+  }
+  bandwidth += tbytes * 85
+
+  requestCost := math.Ceil(float64(requests) / 10000.0) * 0.01
+  requestCost += math.Ceil(float64(requests) / 1000000.0) * 0.60
+  return bandwidth, requestCost
+}
+
+// chargebackKBytes is what the bandwidth is billed on
+func chargebackKBytes (requests int, bytes int64) (float64) {
+  return float64(bytes)/1024.0 + float64(requests*2)
+}
+
+type chargebackLine struct {
+  Department string
+  Requests int
+  Bytes int64
+  Cost float64
+}
+
+type chargebackReport struct {
+  Requests int
+  Bytes int64
+  BandwidthCost float64
+  RequestCost float64
+  Departments []chargebackLine
+}
+
+// buildChargeback allocates the counted requests of each vhost: a vhost with a department goes to it whole, on
+// the others each site goes to the department of the site.  The rest (sites nobody owns, ignored sites and
+// vhosts) is unallocated so the departments add up to the whole run.
+func buildChargeback (depts departmentMap, tracking trackedOverall) (chargebackReport) {
+  lines := make(map[string]*chargebackLine)
+  add := func(department string, requests int, bytes int64) {
+    if requests == 0 && bytes == 0 {
+      return
+    }
+    line, ok := lines[department]
+    if !ok {
+      line = &chargebackLine{ Department: department }
+      lines[department] = line
+    }
+    line.Requests += requests
+    line.Bytes += bytes
+  }
+  counted := func(split campusSplit) (int, int64) {
+    return split.OnCampus + split.OffCampus, split.OnCampusBytes + split.OffCampusBytes
+  }
+
+  restRequests, restBytes := counted(tracking.campusSplit)
+  for _, vhost := range sortedVHosts(tracking) {
+    info := tracking.Tracked[vhost]
+    requests, bytes := counted(info.campusSplit)
+    restRequests -= requests
+    restBytes -= bytes
+
+    owner, owned := findDepartment(depts.names, depts.vhosts, depts.vhostPatterns, vhost)
+    if !owned {
+      owner = unallocatedDepartment
+      for site, data := range info.Sites {
+        department, ok := findDepartment(depts.names, depts.sites, depts.sitePatterns, site)
+        if !ok {
+          continue
+        }
+        siteRequests, siteBytes := counted(data.campusSplit)
+        add(department, siteRequests, siteBytes)
+        requests -= siteRequests
+        bytes -= siteBytes
+      }
+    }
+    add(owner, requests, bytes)
+  }
+  add(unallocatedDepartment, restRequests, restBytes)
+
+  report := chargebackReport{}
+  report.Requests, report.Bytes = counted(tracking.campusSplit)
+  report.BandwidthCost, report.RequestCost = cloudfrontCost(report.Requests, report.Bytes)
+
+  // the bandwidth is shared by billed kbytes and the requests and waf by requests
+  totalKBytes := chargebackKBytes(report.Requests, report.Bytes)
+  for _, line := range lines {
+    line.Cost = report.BandwidthCost*percentOf(chargebackKBytes(line.Requests, line.Bytes), totalKBytes)/100 +
+      report.RequestCost*percentOf(float64(line.Requests), float64(report.Requests))/100
+    report.Departments = append(report.Departments, *line)
+  }
+
+  // biggest bill first with unallocated at the end
+  sort.Slice(report.Departments, func(i, j int) (bool) {
+    a, b := report.Departments[i], report.Departments[j]
+    if (a.Department == unallocatedDepartment) != (b.Department == unallocatedDepartment) {
+      return b.Department == unallocatedDepartment
+    }
+    if a.Cost != b.Cost {
+      return a.Cost > b.Cost
+    }
+    return a.Department < b.Department
+  })
+  return report
+}
+
+func writeChargebackText (w io.Writer, report chargebackReport) (error) {
+  _, err := fmt.Fprintf(w, "*** chargeback (estimated cloudfront cost $ %.2f / month: bandwidth $ %.2f, requests and waf $ %.2f)\n",
+    report.BandwidthCost + report.RequestCost, report.BandwidthCost, report.RequestCost)
+  if err != nil {
+    return err
+  }
+  for _, line := range report.Departments {
+    _, err = fmt.Fprintf(w, "  %s: requests= %s (%.2f %%) kbytes= %s (%.2f %%) cost= $ %.2f\n", line.Department,
+      addCommaToInt(line.Requests), percentOf(float64(line.Requests), float64(report.Requests)),
+      addCommaToInt64(line.Bytes/1024), percentOf(float64(line.Bytes), float64(report.Bytes)), line.Cost)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func writeChargebackCSV (w io.Writer, report chargebackReport) (error) {
+  out := csv.NewWriter(w)
+  out.Write([]string{ "department", "requests", "bytes", "percentage", "cost" })
+  for _, line := range report.Departments {
+    out.Write([]string{ line.Department, strconv.Itoa(line.Requests), strconv.FormatInt(line.Bytes, 10),
+      csvPercent(line.Requests, report.Requests), strconv.FormatFloat(line.Cost, 'f', 2, 64) })
+  }
+  out.Flush()
+  return out.Error()
+}
+
+// chargebackTracked writes the chargeback report - csv when the destination ends in .csv and text otherwise
+func chargebackTracked (dest string, depts departmentMap, tracking trackedOverall) (error) {
+  report := buildChargeback(depts, tracking)
+  if strings.HasSuffix(strings.ToLower(dest), ".csv") {
+    return writeOutput(dest, func(w io.Writer) (error) { return writeChargebackCSV(w, report) })
+  }
+  return writeOutput(dest, func(w io.Writer) (error) { return writeChargebackText(w, report) })
+}
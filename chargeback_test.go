@@ -0,0 +1,94 @@
+package main
+
+import (
+  "bytes"
+  "math"
+  "strings"
+  "testing"
+)
+
+const testDepartments = `departments:
+  - name: IST
+    sites: [htbin]
+  - name: Metropolitan College
+    sites: ["me?"]
+  - name: Web
+    vhosts: [testdomain1]
+`
+
+func TestCloudfrontCost (t *testing.T) {
+  // 60 terabytes is 10 at $85, 40 at $80 and 10 at $60 and one request is one lot of 10k plus one million for the waf
+  bandwidth, requests := cloudfrontCost(1, 60*1024*1024*1024*1024 - 2048)
+  if math.Abs(bandwidth - 4650) > 0.001 || math.Abs(requests - 0.61) > 0.001 {
+    t.Errorf("wrong cost bandwidth=%f requests=%f", bandwidth, requests)
+  }
+}
+
+func TestChargeback (t *testing.T) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.json", `[
+  { "name": "10net", "net": "10.0.0.0/8" },
+  { "virtual": "skipme", "status": "ignore" },
+  { "site": "htbin", "status": "track" },
+  { "site": "met", "status": "summarize" },
+  { "site": "news", "status": "summarize" }
+]`))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  depts, err := readDepartments(testConfigFile(t, "departments.yaml", testDepartments))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  // htbin and met on the default vhost, htbin on the vhost Web owns, a site nobody owns and an ignored vhost
+  lines := []string {
+    testCSVLines[0],
+    strings.Replace(testCSVLines[1], "/htbin/", "/met/", 1),
+    strings.Replace(testCSVLines[2], "off:http", "off:http x testdomain1", 1),
+    strings.Replace(testCSVLines[0], "/htbin/", "/news/", 1),
+    strings.Replace(testCSVLines[0], "off:http", "off:http x skipme", 1),
+  }
+  tracking := initTrackedOverall()
+  for num, line := range lines {
+    trackEntry(lc.config, &tracking, ParseAccess(num, line))
+  }
+
+  report := buildChargeback(depts, tracking)
+  var got []string
+  cost := 0.0
+  for _, line := range report.Departments {
+    got = append(got, line.Department + "=" + strings.Repeat("x", line.Requests))
+    cost += line.Cost
+  }
+  if strings.Join(got, " ") != "Metropolitan College=x IST=x Web=x unallocated=xx" {
+    t.Errorf("wrong departments %v", got)
+  }
+  if report.Requests != 5 || math.Abs(cost - report.BandwidthCost - report.RequestCost) > 0.000001 {
+    t.Errorf("the departments should add up to the whole run %+v", report)
+  }
+
+  var buf bytes.Buffer
+  writeChargebackText(&buf, report)
+  if !strings.Contains(buf.String(), "*** chargeback (estimated cloudfront cost $ 0.61 / month") ||
+    !strings.Contains(buf.String(), "  unallocated: requests= 2 (40.00 %) kbytes= 1 (28.57 %) cost= $ 0.24\n") {
+    t.Errorf("wrong text report:\n%s", buf.String())
+  }
+  buf.Reset()
+  writeChargebackCSV(&buf, report)
+  if !strings.HasPrefix(buf.String(), "department,requests,bytes,percentage,cost\nMetropolitan College,1,3000,20.00,0.12\n") {
+    t.Errorf("wrong csv:\n%s", buf.String())
+  }
+}
+
+func TestDepartmentErrors (t *testing.T) {
+  for data, want := range map[string]string {
+    `{ "departments": [ { "name": "a", "sites": ["x"] }, { "name": "b", "sites": ["x"] } ] }`: "site x already belongs to a",
+    `{ "departments": [ { "name": "unallocated" } ] }`: "needs a name",
+    `{ "departments": [ { "name": "a", "vhost": ["x"] } ] }`: "unknown field",
+  } {
+    _, err := readDepartments(testConfigFile(t, "departments.json", data))
+    if err == nil || !strings.Contains(err.Error(), want) {
+      t.Errorf("expected %q got %v", want, err)
+    }
+  }
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+)
+
+// configFile is the typed config (yaml, toml or a json object) - unlike the ipnets.json array every
+// section is explicit and unknown keys are errors
+type configFile struct {
+  // files layered under this one (see include.go)
+  Include []string `json:"include,omitempty"`
+  Networks []networkConfig `json:"networks,omitempty"`
+  VHosts []statusConfig `json:"vhosts,omitempty"`
+  Sites []statusConfig `json:"sites,omitempty"`
+  // the on campus ranges (the built in BU ranges when there are none)
+  Campus []campusConfig `json:"campus,omitempty"`
+  Normalize []string `json:"normalize,omitempty"`
+  Rewrites []rewriteConfig `json:"rewrites,omitempty"`
+  Rules []ruleConfig `json:"rules,omitempty"`
+}
+
+type networkConfig struct {
+  Name string `json:"name"`
+  Net string `json:"net"`
+  // hosts and/or uri
+  Track []string `json:"track,omitempty"`
+  Ignore bool `json:"ignore,omitempty"`
+  // team=web, role=proxy, ... (see tags.go)
+  Tags []string `json:"tags,omitempty"`
+  Note string `json:"note,omitempty"`
+}
+
+// statusConfig is a vhost or site - status is ignore, summarize or track (the default)
+type statusConfig struct {
+  Name string `json:"name"`
+  Status string `json:"status,omitempty"`
+  Tags []string `json:"tags,omitempty"`
+  Note string `json:"note,omitempty"`
+}
+
+type campusConfig struct {
+  Name string `json:"name"`
+  Nets []string `json:"nets"`
+}
+
+type rewriteConfig struct {
+  Match string `json:"match"`
+  Replace string `json:"replace"`
+}
+
+// ruleConfig is a rule over any field of an entry - action is ignore, network, site, tag or sample and
+// value is the network label, site, tag or sample rate (1/N or a fraction)
+type ruleConfig struct {
+  Name string `json:"name"`
+  // "field op value" conditions that all have to match (see ruleengine.go)
+  When []string `json:"when"`
+  Action string `json:"action"`
+  Value string `json:"value,omitempty"`
+  Note string `json:"note,omitempty"`
+}
+
+// campusNet is a range of a campus zone
+type campusNet struct {
+  zone string
+  net *net.IPNet
+}
+
+// the keys each section of the typed config allows
+var configKeys = map[string][]string {
+  "": { "include", "networks", "vhosts", "sites", "campus", "normalize", "rewrites", "rules" },
+  "networks": { "name", "net", "track", "ignore", "tags", "note" },
+  "vhosts": { "name", "status", "tags", "note" },
+  "sites": { "name", "status", "tags", "note" },
+  "campus": { "name", "nets" },
+  "rewrites": { "match", "replace" },
+  "rules": { "name", "when", "action", "value", "note" },
+}
+
+func unknownKeys (allowed []string, data map[string]interface{}) ([]string) {
+  var unknown []string
+  for key := range data {
+    found := false
+    for _, a := range allowed {
+      found = found || a == key
+    }
+    if !found {
+      unknown = append(unknown, key)
+    }
+  }
+  sort.Strings(unknown)
+  return unknown
+}
+
+// checkConfigKeys reports the keys the typed config does not know (with where they are)
+func checkConfigKeys (tree interface{}) (error) {
+  root, ok := tree.(map[string]interface{})
+  if !ok {
+    return fmt.Errorf("the config must be a mapping of sections")
+  }
+
+  if unknown := unknownKeys(configKeys[""], root); len(unknown) > 0 {
+    return fmt.Errorf("unknown section %q", unknown[0])
+  }
+
+  var sections []string
+  for section := range root {
+    sections = append(sections, section)
+  }
+  sort.Strings(sections)
+
+  for _, section := range sections {
+    list, ok := root[section].([]interface{})
+    if !ok || section == "normalize" || section == "include" {
+      continue
+    }
+    for num, item := range list {
+      entry, ok := item.(map[string]interface{})
+      if !ok {
+        return fmt.Errorf("%s[%d]: expected a mapping", section, num)
+      }
+      if unknown := unknownKeys(configKeys[section], entry); len(unknown) > 0 {
+        return fmt.Errorf("%s[%d]: unknown key %q", section, num, unknown[0])
+      }
+    }
+  }
+  return nil
+}
+
+// decodeConfigTree turns the parsed yaml/toml/json into the typed config
+func decodeConfigTree (tree interface{}) (configFile, error) {
+  var config configFile
+
+  err := checkConfigKeys(tree)
+  if err != nil {
+    return config, err
+  }
+
+  data, err := json.Marshal(tree)
+  if err != nil {
+    return config, err
+  }
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.DisallowUnknownFields()
+  err = decoder.Decode(&config)
+  return config, err
+}
+
+func checkStatus (status string) (error) {
+  switch status {
+  case "", "ignore", "summarize", "track":
+    return nil
+  }
+  return fmt.Errorf("unknown status %q (ignore, summarize or track)", status)
+}
+
+// typedToConfig checks the values of the typed config and builds the config trackEntry uses
+func typedToConfig (typed configFile) (logConfig, error) {
+  config := logConfig{ vhosts: make(map[string]int), sites: make(map[string]int), vhostTags: make(map[string][]string), siteTags: make(map[string][]string) }
+
+  for num, item := range typed.Networks {
+    n := network{ name: item.Name, ignore: item.Ignore, tags: item.Tags }
+    if err := checkTags(item.Tags); err != nil {
+      return logConfig{}, fmt.Errorf("networks[%d]: %s", num, err)
+    }
+    for _, track := range item.Track {
+      switch track {
+      case "hosts":
+        n.trackHosts = true
+      case "uri":
+        n.trackURI = true
+      default:
+        return logConfig{}, fmt.Errorf("networks[%d]: unknown track %q (hosts or uri)", num, track)
+      }
+    }
+
+    _, ipnet, err := net.ParseCIDR(item.Net)
+    if err != nil {
+      return logConfig{}, fmt.Errorf("networks[%d]: %s", num, err)
+    }
+    n.net = ipnet
+    config.ipranges = append(config.ipranges, n)
+  }
+
+  for _, section := range []struct { name string; items []statusConfig; status map[string]int; patterns *[]statusPattern; tags map[string][]string } {
+    { "vhosts", typed.VHosts, config.vhosts, &config.vhostPatterns, config.vhostTags },
+    { "sites", typed.Sites, config.sites, &config.sitePatterns, config.siteTags },
+  } {
+    for num, item := range section.items {
+      err := checkStatus(item.Status)
+      if err == nil {
+        err = checkTags(item.Tags)
+      }
+      if err == nil {
+        err = addStatusRule(section.status, section.patterns, item.Name, statusToNumber(item.Status))
+      }
+      if err != nil {
+        return logConfig{}, fmt.Errorf("%s[%d]: %s", section.name, num, err)
+      }
+      // like the status a later entry with the same name wins
+      section.tags[item.Name] = item.Tags
+    }
+  }
+
+  for num, zone := range typed.Campus {
+    for _, cidr := range zone.Nets {
+      _, ipnet, err := net.ParseCIDR(cidr)
+      if err != nil {
+        return logConfig{}, fmt.Errorf("campus[%d]: %s", num, err)
+      }
+      config.campus = append(config.campus, campusNet{ zone.Name, ipnet })
+    }
+  }
+
+  if len(typed.Normalize) > 0 {
+    err := addNormalizeSteps(&config.normalizer, strings.Join(typed.Normalize, ","))
+    if err != nil {
+      return logConfig{}, err
+    }
+  }
+  for num, rewrite := range typed.Rewrites {
+    err := addRewrite(&config.normalizer, rewrite.Match, rewrite.Replace)
+    if err != nil {
+      return logConfig{}, fmt.Errorf("rewrites[%d]: %s", num, err)
+    }
+  }
+  for num, item := range typed.Rules {
+    rule, err := newEntryRule(item.Name, item.When, item.Action, item.Value)
+    if err != nil {
+      return logConfig{}, fmt.Errorf("rules[%d]: %s", num, err)
+    }
+    config.rules = append(config.rules, rule)
+  }
+
+  return config, nil
+}
+
+// the keys initIPRanges looks at for each kind of ipnets.json entry (note is only a comment)
+var legacyKeys = map[string][]string {
+  "virtual": { "virtual", "status", "tags", "note" },
+  "site": { "site", "status", "tags", "note" },
+  "normalize": { "normalize", "note" },
+  "rewrite": { "rewrite", "replace", "note" },
+  "rule": { "rule", "when", "action", "value", "note" },
+  "include": { "include", "note" },
+  "network": { "name", "net", "track", "ignore", "tags", "note" },
+}
+
+// legacyKind is the kind of ipnets.json entry the same way initIPRanges decides it
+func legacyKind (item map[string]string) (string) {
+  for _, kind := range []string{ "virtual", "site", "normalize", "rewrite", "rule", "include" } {
+    if _, ok := item[kind]; ok {
+      return kind
+    }
+  }
+  return "network"
+}
+
+// legacyStatus is the status initIPRanges would give (anything it does not know is track)
+func legacyStatus (status string) (string) {
+  if status == "ignore" || status == "summarize" {
+    return status
+  }
+  return "track"
+}
+
+// legacyToTyped converts the ipnets.json array - the warnings are the things the old loader silently ignored
+func legacyToTyped (data []map[string]string) (configFile, []string) {
+  var typed configFile
+  var warnings []string
+
+  for num, item := range data {
+    kind := legacyKind(item)
+    for _, key := range unknownKeys(legacyKeys[kind], stringMapToTree(item)) {
+      warnings = append(warnings, fmt.Sprintf("entry %d (%s): unknown key %q dropped", num, kind, key))
+    }
+    if status, ok := item["status"]; ok && legacyStatus(status) != status {
+      warnings = append(warnings, fmt.Sprintf("entry %d (%s): status %q is treated as track", num, kind, status))
+    }
+
+    switch kind {
+    case "virtual":
+      typed.VHosts = append(typed.VHosts, statusConfig{ item["virtual"], legacyStatus(item["status"]), splitTags(item["tags"]), item["note"] })
+    case "site":
+      typed.Sites = append(typed.Sites, statusConfig{ item["site"], legacyStatus(item["status"]), splitTags(item["tags"]), item["note"] })
+    case "normalize":
+      for _, step := range strings.Split(item["normalize"], ",") {
+        typed.Normalize = append(typed.Normalize, strings.TrimSpace(step))
+      }
+    case "rewrite":
+      typed.Rewrites = append(typed.Rewrites, rewriteConfig{ item["rewrite"], item["replace"] })
+    case "include":
+      typed.Include = append(typed.Include, item["include"])
+    case "rule":
+      typed.Rules = append(typed.Rules, ruleConfig{ item["rule"], splitWhen(item["when"]), item["action"], item["value"], item["note"] })
+    default:
+      n := networkConfig{ Name: item["name"], Net: item["net"], Tags: splitTags(item["tags"]), Note: item["note"] }
+      if strings.Contains(item["track"], "hosts") {
+        n.Track = append(n.Track, "hosts")
+      }
+      if strings.Contains(item["track"], "uri") {
+        n.Track = append(n.Track, "uri")
+      }
+      _, n.Ignore = item["ignore"]
+      typed.Networks = append(typed.Networks, n)
+    }
+  }
+
+  // spell out the campus ranges the old config got from the code (with includes they come from those)
+  if len(typed.Include) > 0 {
+    return typed, warnings
+  }
+  zone := campusConfig{ Name: "campus" }
+  for _, ipnet := range onCampusIPs {
+    ones, _ := ipnet.Mask.Size()
+    zone.Nets = append(zone.Nets, fmt.Sprintf("%s/%d", ipnet.IP.String(), ones))
+  }
+  typed.Campus = append(typed.Campus, zone)
+
+  return typed, warnings
+}
+
+func stringMapToTree (item map[string]string) (map[string]interface{}) {
+  tree := make(map[string]interface{})
+  for k, v := range item {
+    tree[k] = v
+  }
+  return tree
+}
+
+// configFormat is yaml, toml, json or legacy (the ipnets.json array)
+func configFormat (filename string, file []byte) (string) {
+  switch strings.ToLower(filepath.Ext(filename)) {
+  case ".yaml", ".yml":
+    return "yaml"
+  case ".toml":
+    return "toml"
+  }
+  if bytes.HasPrefix(bytes.TrimSpace(file), []byte("[")) {
+    return "legacy"
+  }
+  return "json"
+}
+
+// readConfigFile reads a config in any of the formats - a json array is the old ipnets.json and the
+// second result is the typed version of whatever was read (with the includes merged in)
+func readConfigFile (filename string) (logConfig, configFile, []byte, error) {
+  config, src, err := readConfigSource(filename)
+  return config, src.typed, src.data, err
+}
+
+func readConfigSource (filename string) (logConfig, configSource, error) {
+  typed, data, file, err := parseConfigFile(filename)
+  if err != nil {
+    return logConfig{}, configSource{ data: file }, err
+  }
+
+  // the old array goes through the old loader (unless it has includes) so it behaves as it always has - that
+  // includes skipping keys it does not know, config lint and convert are where those get reported
+  if data != nil && len(typed.Include) == 0 {
+    config, err := initIPRanges(data)
+    typed, _ = legacyToTyped(data)
+    return config, configSource{ typed: typed, data: file, files: []string{ filename } }, err
+  }
+
+  src := configSource{ typed: typed, data: file, files: []string{ filename } }
+  if len(typed.Include) > 0 {
+    src, err = readConfigLayers(filename, nil)
+    if err != nil {
+      return logConfig{}, src, err
+    }
+  }
+  config, err := typedToConfig(src.typed)
+  if err != nil {
+    return logConfig{}, src, fmt.Errorf("%s: %s", filename, err)
+  }
+  return config, src, nil
+}
+
+// loadedConfig is the config with what we need to point back into the file (for explain and the rule hits)
+type loadedConfig struct {
+  filename string
+  format string
+  config logConfig
+  typed configFile
+  positions configPositions
+  // the files read and with includes where each entry of typed came from
+  files []string
+  where map[string][]string
+}
+
+func loadConfig (filename string) (loadedConfig, error) {
+  config, src, err := readConfigSource(filename)
+  if err != nil {
+    return loadedConfig{}, err
+  }
+  config.hash = hashConfig(src.data)
+
+  file, _ := ioutil.ReadFile(filename)
+  format := configFormat(filename, file)
+  return loadedConfig{ filename, format, config, src.typed, findConfigPositions(format, file), src.files, src.where }, nil
+}
+
+// configWhere is file:line for an entry of a section (the index in the legacy array is the one in ipranges)
+func configWhere (lc loadedConfig, section string, num int) (string) {
+  if lc.where != nil && num < len(lc.where[section]) {
+    return lc.where[section][num]
+  }
+  if lc.format == "legacy" && section == "networks" {
+    section = "entries"
+  }
+  if line := configPosition(lc.positions, section, num); line > 0 {
+    return fmt.Sprintf("%s:%d", lc.filename, line)
+  }
+  return fmt.Sprintf("%s %s[%d]", lc.filename, section, num)
+}
+
+// the config files looked for when none is given (the first one that exists is used)
+var defaultConfigFiles = []string{ "ipnets.json", "ipnets.yaml", "ipnets.yml", "ipnets.toml" }
+
+func findConfigFile () (string) {
+  for _, filename := range defaultConfigFiles {
+    if _, err := os.Stat(filename); err == nil {
+      return filename
+    }
+  }
+  return defaultConfigFiles[0]
+}
+
+// tableFields lists the json fields of a config entry in order (leaving out the empty omitempty ones)
+func tableFields (entry interface{}) ([]configField) {
+  data, _ := json.Marshal(entry)
+  var values map[string]interface{}
+  json.Unmarshal(data, &values)
+
+  var keys []string
+  switch entry.(type) {
+  case networkConfig:
+    keys = configKeys["networks"]
+  case statusConfig:
+    keys = configKeys["vhosts"]
+  case campusConfig:
+    keys = configKeys["campus"]
+  case rewriteConfig:
+    keys = configKeys["rewrites"]
+  case ruleConfig:
+    keys = configKeys["rules"]
+  }
+
+  var fields []configField
+  for _, key := range keys {
+    value, ok := values[key]
+    if !ok {
+      continue
+    }
+    if list, isList := value.([]interface{}); isList {
+      var strs []string
+      for _, item := range list {
+        strs = append(strs, fmt.Sprint(item))
+      }
+      value = strs
+    }
+    fields = append(fields, configField{ key, value })
+  }
+  return fields
+}
+
+// configFields is the typed config in the order it is written out
+func configFields (typed configFile) ([]configField) {
+  var fields []configField
+  if len(typed.Include) > 0 {
+    fields = append(fields, configField{ "include", typed.Include })
+  }
+  if len(typed.Normalize) > 0 {
+    fields = append(fields, configField{ "normalize", typed.Normalize })
+  }
+
+  var campus, networks, vhosts, sites, rewrites, rules [][]configField
+  for _, item := range typed.Campus {
+    campus = append(campus, tableFields(item))
+  }
+  for _, item := range typed.Networks {
+    networks = append(networks, tableFields(item))
+  }
+  for _, item := range typed.VHosts {
+    vhosts = append(vhosts, tableFields(item))
+  }
+  for _, item := range typed.Sites {
+    sites = append(sites, tableFields(item))
+  }
+  for _, item := range typed.Rewrites {
+    rewrites = append(rewrites, tableFields(item))
+  }
+  for _, item := range typed.Rules {
+    rules = append(rules, tableFields(item))
+  }
+
+  for _, section := range []configField {
+    { "campus", campus }, { "networks", networks }, { "vhosts", vhosts }, { "sites", sites }, { "rewrites", rewrites }, { "rules", rules },
+  } {
+    if len(section.Value.([][]configField)) > 0 {
+      fields = append(fields, section)
+    }
+  }
+  return fields
+}
+
+// writeConfig writes the typed config as yaml, toml or json
+func writeConfig (w io.Writer, format string, typed configFile) (error) {
+  switch format {
+  case "yaml":
+    writeYAML(w, configFields(typed))
+  case "toml":
+    writeTOML(w, configFields(typed))
+  case "json":
+    data, err := json.MarshalIndent(typed, "", "  ")
+    if err != nil {
+      return err
+    }
+    w.Write(append(data, '\n'))
+  default:
+    return fmt.Errorf("unknown config format %q (yaml, toml or json)", format)
+  }
+  return nil
+}
+
+// configConvert prints the config in the typed format (with the warnings for what the old format ignored)
+func configConvert (filename string, format string) (error) {
+  file, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return err
+  }
+
+  var typed configFile
+  if configFormat(filename, file) == "legacy" {
+    var data []map[string]string
+    err = json.Unmarshal(file, &data)
+    if err != nil {
+      return fmt.Errorf("%s: %s", filename, err)
+    }
+    var warnings []string
+    typed, warnings = legacyToTyped(data)
+    for _, warning := range warnings {
+      fmt.Fprintf(os.Stderr, "%s: %s\n", filename, warning)
+    }
+  } else {
+    _, _, _, err = readConfigFile(filename)
+    if err != nil {
+      return err
+    }
+    // the includes stay includes (config flatten merges them)
+    typed, _, _, err = parseConfigFile(filename)
+    if err != nil {
+      return err
+    }
+  }
+
+  return writeConfig(os.Stdout, format, typed)
+}
+
+// configFileName is -config or the first of the default config files that exists
+func configFileName () (string) {
+  if *configFlag != "" {
+    return *configFlag
+  }
+  return findConfigFile()
+}
+
+// configMain runs the config subcommands
+func configMain (subcommand string, args []string) (error) {
+  filename := configFileName()
+  if len(args) > 0 {
+    filename = args[0]
+  }
+
+  switch subcommand {
+  case "convert":
+    return configConvert(filename, *toFlag)
+  case "flatten":
+    return configFlatten(filename, *toFlag)
+  case "lint":
+    return configLint(filename, *fromJSONFlag, *verboseFlag, *strictFlag)
+  }
+  return fmt.Errorf("usage: logparse config convert [-to yaml|toml|json] [config file]\n       logparse config flatten [-to yaml|toml|json] [config file]\n       logparse config lint [-verbose] [-strict] [-fromjson summary] [config file]")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func testConfigFile (t *testing.T, name string, data string) (string) {
+  filename := filepath.Join(t.TempDir(), name)
+  err := os.WriteFile(filename, []byte(data), 0644)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  return filename
+}
+
+func TestTypedConfig (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.yaml", `
+campus:
+  - name: main
+    nets: [128.197.0.0/16]
+networks:
+  - name: 10net
+    net: 10.0.0.0/8
+    track: [hosts, uri]
+  - name: "ignore:F5-1"
+    net: 10.231.9.92/32
+    ignore: true
+vhosts:
+  - name: testdomain1
+    status: ignore
+sites:
+  - name: htbin
+    status: track
+normalize: [lowercase]
+`)
+
+  config, err := buildIPRanges(filename)
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+
+  ip, trackHosts, trackURI, ignore, label := findNetwork(config, "10.1.2.3")
+  if ip != "10.1.2.3" || !trackHosts || !trackURI || ignore || label != "10net" {
+    t.Errorf("wrong network for 10.1.2.3: %s %v %v %v %s", ip, trackHosts, trackURI, ignore, label)
+  }
+  if ignoreVHost, _ := findVirtual(config, "testdomain1"); !ignoreVHost {
+    t.Errorf("testdomain1 not ignored")
+  }
+  if _, trackSite := findSite(config, "htbin"); !trackSite {
+    t.Errorf("htbin not tracked")
+  }
+  if !config.normalizer.lowercase {
+    t.Errorf("normalize not loaded")
+  }
+
+  // the campus zones replace the built in ranges
+  if zone, onCampus := findCampus(config, "128.197.1.1"); !onCampus || zone != "main" {
+    t.Errorf("128.197.1.1 in zone %q %v", zone, onCampus)
+  }
+  if _, onCampus := findCampus(config, "10.1.2.3"); onCampus {
+    t.Errorf("10.1.2.3 is not in a campus zone of this config")
+  }
+  if config.hash == "" {
+    t.Errorf("config hash missing")
+  }
+}
+
+func TestTypedConfigErrors (t *testing.T) {
+  for _, test := range []struct { name string; data string; want string } {
+    { "a.yaml", "networks:\n  - name: x\n    net: 10.0.0.0/8\n    trak: hosts\n", `networks[0]: unknown key "trak"` },
+    { "b.toml", "[[vhosts]]\nname = \"x\"\nstatus = \"trak\"\n", `vhosts[0]: unknown status "trak"` },
+    { "c.json", `{ "network": [] }`, `unknown section "network"` },
+    { "d.yaml", "networks:\n  - name: x\n    net: 10.0.0.0/8\n    track: [host]\n", `networks[0]: unknown track "host"` },
+    { "e.yaml", "networks:\n  - name: x\n    net: 10.0.0/8\n", `networks[0]: invalid CIDR` },
+    { "f.yaml", "networks:\n  - name: x\n    ignore: yes\n", `cannot unmarshal` },
+  } {
+    _, err := buildIPRanges(testConfigFile(t, test.name, test.data))
+    if err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%s: expected %q got %v", test.name, test.want, err)
+    }
+  }
+}
+
+func TestLegacyToTyped (t *testing.T) {
+  data := append(append([]map[string]string{}, testIPData...),
+    map[string]string{ "name": "typo", "net": "10.1.0.0/16", "trak": "hosts" },
+    map[string]string{ "site": "foo", "status": "tracked" })
+
+  typed, warnings := legacyToTyped(data)
+  if len(warnings) != 2 || !strings.Contains(warnings[0], `"trak"`) || !strings.Contains(warnings[1], `"tracked"`) {
+    t.Errorf("wrong warnings: %+v", warnings)
+  }
+  if len(typed.Networks) != 4 || len(typed.VHosts) != 3 || len(typed.Sites) != 2 || len(typed.Campus) != 1 {
+    t.Errorf("wrong sections: %+v", typed)
+  }
+
+  // the typed config behaves the same as the legacy one
+  legacy, _ := initIPRanges(data)
+  config, err := typedToConfig(typed)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  for _, ip := range []string{ "10.231.9.92", "10.1.2.3", "127.0.0.1", "128.197.1.1" } {
+    _, h1, u1, i1, l1 := findNetwork(legacy, ip)
+    _, h2, u2, i2, l2 := findNetwork(config, ip)
+    _, c1 := findCampus(legacy, ip)
+    _, c2 := findCampus(config, ip)
+    if h1 != h2 || u1 != u2 || i1 != i2 || l1 != l2 || c1 != c2 {
+      t.Errorf("%s differs: %v %v %v %s %v / %v %v %v %s %v", ip, h1, u1, i1, l1, c1, h2, u2, i2, l2, c2)
+    }
+  }
+  for _, vhost := range []string{ "testdomain1", "testdomain2", "testdomain3" } {
+    if legacy.vhosts[vhost] != config.vhosts[vhost] {
+      t.Errorf("vhost %s differs", vhost)
+    }
+  }
+
+  // and survives being written out and read back in every format
+  for _, format := range []string{ "yaml", "toml", "json" } {
+    var buf bytes.Buffer
+    err := writeConfig(&buf, format, typed)
+    if err != nil {
+      t.Errorf("error=%s", err)
+    }
+    _, back, _, err := readConfigFile(testConfigFile(t, "ipnets." + format, buf.String()))
+    if err != nil {
+      t.Errorf("%s: error=%s\n%s", format, err, buf.String())
+      continue
+    }
+    if len(back.Networks) != 4 || back.Networks[0].Ignore != true || back.Networks[1].Track[1] != "uri" || back.VHosts[0].Status != "ignore" {
+      t.Errorf("%s did not read back: %+v", format, back)
+    }
+  }
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+// Just enough YAML and TOML to read and write the typed config - both parse into the same tree of
+// map[string]interface{}, []interface{}, string and bool that encoding/json would give us.
+
+// configLine is a line with the comment and the indentation taken off
+type configLine struct {
+  number int
+  indent int
+  text string
+}
+
+// stripComment removes a # comment that is not inside quotes
+func stripComment (line string) (string) {
+  quote := byte(0)
+  for i := 0; i < len(line); i++ {
+    c := line[i]
+    switch {
+    case quote != 0:
+      if c == '\\' && quote == '"' {
+        i++
+      } else if c == quote {
+        quote = 0
+      }
+    case c == '"' || c == '\'':
+      quote = c
+    case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+      return line[:i]
+    }
+  }
+  return line
+}
+
+func configLines (data string) ([]configLine) {
+  var lines []configLine
+  for num, line := range strings.Split(data, "\n") {
+    line = strings.TrimRight(stripComment(strings.TrimRight(line, "\r")), " \t")
+    text := strings.TrimLeft(line, " ")
+    if text == "" || text == "---" {
+      continue
+    }
+    lines = append(lines, configLine{ num + 1, len(line) - len(text), text })
+  }
+  return lines
+}
+
+// splitFlow splits the inside of a [a, "b", c] list on the commas outside quotes
+func splitFlow (list string) ([]string) {
+  var items []string
+  quote := byte(0)
+  start := 0
+  for i := 0; i < len(list); i++ {
+    c := list[i]
+    switch {
+    case quote != 0:
+      if c == '\\' && quote == '"' {
+        i++
+      } else if c == quote {
+        quote = 0
+      }
+    case c == '"' || c == '\'':
+      quote = c
+    case c == ',':
+      items = append(items, strings.TrimSpace(list[start:i]))
+      start = i + 1
+    }
+  }
+  if last := strings.TrimSpace(list[start:]); last != "" {
+    items = append(items, last)
+  }
+  return items
+}
+
+// quoteRules are the escapes of "double" quoted strings (the character after the \ and what it stands for, or
+// how many hex digits of a code point follow) and whether '' is a quote in 'single' quoted strings
+type quoteRules struct {
+  escapes map[byte]string
+  hex map[byte]int
+  doubledQuote bool
+  // toml does not allow control characters other than tab inside strings
+  noControls bool
+}
+
+// yamlQuotes are the escapes of yaml 1.2 (the line breaks inside quotes are not supported)
+var yamlQuotes = quoteRules {
+  escapes: map[byte]string { '0': "\x00", 'a': "\a", 'b': "\b", 't': "\t", '\t': "\t", 'n': "\n", 'v': "\v", 'f': "\f",
+    'r': "\r", 'e': "\x1b", ' ': " ", '"': `"`, '/': "/", '\\': `\`, 'N': "\u0085", '_': "\u00a0", 'L': "\u2028",
+    'P': "\u2029" },
+  hex: map[byte]int { 'x': 2, 'u': 4, 'U': 8 },
+  doubledQuote: true,
+}
+
+// tomlQuotes are the escapes of toml 1.0 basic strings ('literal' strings have none and can not hold a ')
+var tomlQuotes = quoteRules {
+  escapes: map[byte]string { 'b': "\b", 't': "\t", 'n': "\n", 'f': "\f", 'r': "\r", '"': `"`, '\\': `\` },
+  hex: map[byte]int { 'u': 4, 'U': 8 },
+  noControls: true,
+}
+
+// quotedScalar reads a "double" (with \ escapes) or 'single' quoted string - anything the rules do not
+// have is an error rather than being read some other way
+func quotedScalar (text string, rules quoteRules) (string, error) {
+  if len(text) < 2 || text[len(text)-1] != text[0] {
+    return "", fmt.Errorf("unterminated string %s", text)
+  }
+  inside := text[1:len(text)-1]
+  if rules.noControls {
+    for _, c := range inside {
+      if (c < 0x20 && c != '\t') || c == 0x7f {
+        return "", fmt.Errorf("control character %U in string %s", c, text)
+      }
+    }
+  }
+
+  if text[0] == '\'' {
+    parts := []string{ inside }
+    if rules.doubledQuote {
+      parts = strings.Split(inside, "''")
+    }
+    for _, part := range parts {
+      if strings.Contains(part, "'") {
+        return "", fmt.Errorf("unescaped ' in string %s", text)
+      }
+    }
+    return strings.Join(parts, "'"), nil
+  }
+
+  var out strings.Builder
+  for i := 0; i < len(inside); i++ {
+    c := inside[i]
+    if c == '"' {
+      return "", fmt.Errorf("unescaped \" in string %s", text)
+    }
+    if c != '\\' {
+      out.WriteByte(c)
+      continue
+    }
+    if i+1 >= len(inside) {
+      return "", fmt.Errorf("unterminated string %s", text)
+    }
+    i++
+    if escaped, ok := rules.escapes[inside[i]]; ok {
+      out.WriteString(escaped)
+      continue
+    }
+    digits, ok := rules.hex[inside[i]]
+    if !ok {
+      return "", fmt.Errorf("unknown escape \\%c in string %s", inside[i], text)
+    }
+    end := min(i+1+digits, len(inside))
+    code, err := strconv.ParseUint(inside[i+1:end], 16, 32)
+    if err != nil || end - i - 1 != digits || !utf8.ValidRune(rune(code)) {
+      return "", fmt.Errorf("bad escape \\%s in string %s", inside[i:end], text)
+    }
+    out.WriteRune(rune(code))
+    i = end - 1
+  }
+  return out.String(), nil
+}
+
+// yamlScalar reads a value on the rest of a line - we only need strings, booleans and flow lists
+func yamlScalar (text string) (interface{}, error) {
+  switch {
+  case text == "true":
+    return true, nil
+  case text == "false":
+    return false, nil
+  case text == "[]":
+    return []interface{}{}, nil
+  case strings.HasPrefix(text, "["):
+    if !strings.HasSuffix(text, "]") {
+      return nil, fmt.Errorf("unterminated list %s", text)
+    }
+    list := []interface{}{}
+    for _, item := range splitFlow(text[1:len(text)-1]) {
+      value, err := yamlScalar(item)
+      if err != nil {
+        return nil, err
+      }
+      list = append(list, value)
+    }
+    return list, nil
+  case strings.HasPrefix(text, "{"):
+    return nil, fmt.Errorf("flow mappings are not supported: %s", text)
+  case strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'"):
+    return quotedScalar(text, yamlQuotes)
+  }
+  return text, nil
+}
+
+// yamlKey splits "key: value" (the value may be empty) - ok is false when the line is not a mapping entry
+func yamlKey (text string) (string, string, bool) {
+  if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") {
+    end := strings.Index(text[1:], text[:1])
+    if end < 0 || !strings.HasPrefix(text[end+2:], ":") {
+      return "", "", false
+    }
+    return text[1:end+1], strings.TrimSpace(text[end+3:]), true
+  }
+
+  if strings.HasSuffix(text, ":") {
+    return text[:len(text)-1], "", true
+  }
+  colon := strings.Index(text, ": ")
+  if colon < 0 {
+    return "", "", false
+  }
+  return text[:colon], strings.TrimSpace(text[colon+2:]), true
+}
+
+func isSequenceItem (text string) (bool) {
+  return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlBlock parses the lines starting at i that are indented by indent and returns the value and
+// the index of the first line after it
+func yamlBlock (lines []configLine, i int, indent int) (interface{}, int, error) {
+  if isSequenceItem(lines[i].text) {
+    list := []interface{}{}
+    for i < len(lines) && lines[i].indent == indent && isSequenceItem(lines[i].text) {
+      item := strings.TrimSpace(strings.TrimPrefix(lines[i].text, "-"))
+
+      var value interface{}
+      var err error
+      if item == "" {
+        if i+1 >= len(lines) || lines[i+1].indent <= indent {
+          value, i = nil, i+1
+        } else {
+          value, i, err = yamlBlock(lines, i+1, lines[i+1].indent)
+        }
+      } else if _, _, ok := yamlKey(item); ok {
+        // "- key: value" starts a mapping indented to where key is
+        lines[i] = configLine{ lines[i].number, lines[i].indent + len(lines[i].text) - len(item), item }
+        value, i, err = yamlBlock(lines, i, lines[i].indent)
+      } else {
+        value, err = yamlScalar(item)
+        i++
+      }
+      if err != nil {
+        return nil, i, err
+      }
+      list = append(list, value)
+    }
+    return list, i, nil
+  }
+
+  mapping := make(map[string]interface{})
+  for i < len(lines) && lines[i].indent == indent && !isSequenceItem(lines[i].text) {
+    line := lines[i]
+    key, rest, ok := yamlKey(line.text)
+    if !ok {
+      return nil, i, fmt.Errorf("line %d: expected key: value", line.number)
+    }
+    if _, exists := mapping[key]; exists {
+      return nil, i, fmt.Errorf("line %d: duplicate key %s", line.number, key)
+    }
+
+    var value interface{}
+    var err error
+    i++
+    if rest != "" {
+      value, err = yamlScalar(rest)
+      if err != nil {
+        err = fmt.Errorf("line %d: %s", line.number, err)
+      }
+    } else if i < len(lines) && (lines[i].indent > indent || (lines[i].indent == indent && isSequenceItem(lines[i].text))) {
+      value, i, err = yamlBlock(lines, i, lines[i].indent)
+    }
+    if err != nil {
+      return nil, i, err
+    }
+    mapping[key] = value
+  }
+  return mapping, i, nil
+}
+
+// parseYAML reads the block style YAML subset the config uses
+func parseYAML (data string) (interface{}, error) {
+  lines := configLines(data)
+  if len(lines) == 0 {
+    return map[string]interface{}{}, nil
+  }
+
+  value, i, err := yamlBlock(lines, 0, lines[0].indent)
+  if err == nil && i < len(lines) {
+    err = fmt.Errorf("line %d: unexpected indentation", lines[i].number)
+  }
+  return value, err
+}
+
+// tomlValue reads a value - strings, booleans, numbers and (possibly nested) arrays
+func tomlValue (text string) (interface{}, error) {
+  switch {
+  case text == "true":
+    return true, nil
+  case text == "false":
+    return false, nil
+  case strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'"):
+    return quotedScalar(text, tomlQuotes)
+  case strings.HasPrefix(text, "{"):
+    return nil, fmt.Errorf("inline tables are not supported: %s", text)
+  case strings.HasPrefix(text, "["):
+    if !strings.HasSuffix(text, "]") {
+      return nil, fmt.Errorf("unterminated array %s", text)
+    }
+    list := []interface{}{}
+    for _, item := range splitFlow(text[1:len(text)-1]) {
+      value, err := tomlValue(item)
+      if err != nil {
+        return nil, err
+      }
+      list = append(list, value)
+    }
+    return list, nil
+  }
+
+  return tomlNumber(text)
+}
+
+// tomlNumber reads an integer (decimal or 0x, 0o, 0b) as an int64 and anything with a . or an exponent as a
+// float64 - inf and nan are left out since json can not hold them
+func tomlNumber (text string) (interface{}, error) {
+  unsigned := strings.TrimLeft(text, "+-")
+  if len(text) - len(unsigned) > 1 || len(unsigned) == 0 || unsigned[0] < '0' || unsigned[0] > '9' {
+    return nil, fmt.Errorf("unsupported value %s", text)
+  }
+  prefixed := len(unsigned) > 1 && unsigned[0] == '0' && strings.IndexByte("xob", unsigned[1]) >= 0
+
+  // an _ has to be between two digits
+  for i := 0; i < len(text); i++ {
+    if text[i] == '_' && (i == 0 || i+1 == len(text) || !isTOMLDigit(text[i-1], prefixed) || !isTOMLDigit(text[i+1], prefixed)) {
+      return nil, fmt.Errorf("unsupported value %s", text)
+    }
+  }
+  clean := strings.Replace(text, "_", "", -1)
+
+  if prefixed {
+    integer, err := strconv.ParseInt(clean, 0, 64)
+    if err != nil || len(unsigned) != len(text) {
+      return nil, fmt.Errorf("unsupported value %s", text)
+    }
+    return integer, nil
+  }
+
+  digits := strings.Replace(unsigned, "_", "", -1)
+  if len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9' {
+    return nil, fmt.Errorf("leading zeros are not allowed: %s", text)
+  }
+  if strings.Trim(digits, "0123456789") == "" {
+    integer, err := strconv.ParseInt(clean, 10, 64)
+    if err != nil {
+      return nil, fmt.Errorf("integer out of range %s", text)
+    }
+    return integer, nil
+  }
+
+  // a . needs digits on both sides (1. and .5 are not toml)
+  dot := strings.IndexByte(digits, '.')
+  if strings.Trim(digits, "0123456789.eE+-") != "" || (dot >= 0 && (dot+1 == len(digits) || !isTOMLDigit(digits[dot+1], false))) {
+    return nil, fmt.Errorf("unsupported value %s", text)
+  }
+  number, err := strconv.ParseFloat(clean, 64)
+  if err != nil {
+    return nil, fmt.Errorf("unsupported value %s", text)
+  }
+  return number, nil
+}
+
+// isTOMLDigit is a decimal digit (or any hex digit after 0x, 0o or 0b - ParseInt checks the rest)
+func isTOMLDigit (c byte, prefixed bool) (bool) {
+  return (c >= '0' && c <= '9') || (prefixed && ((c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')))
+}
+
+// tomlKey reads a bare or quoted key (dotted keys are not supported)
+func tomlKey (key string) (string, error) {
+  key = strings.TrimSpace(key)
+  if strings.HasPrefix(key, `"`) || strings.HasPrefix(key, "'") {
+    return quotedScalar(key, tomlQuotes)
+  }
+  if strings.Contains(key, ".") {
+    return "", fmt.Errorf("dotted keys are not supported: %s", key)
+  }
+  if key == "" || strings.ContainsAny(key, " \t") {
+    return "", fmt.Errorf("unsupported key %q", key)
+  }
+  return key, nil
+}
+
+// parseTOML reads the TOML subset the config uses - top level keys, [tables] and [[arrays of tables]]
+func parseTOML (data string) (interface{}, error) {
+  root := make(map[string]interface{})
+  current := root
+
+  lines := configLines(data)
+  for i := 0; i < len(lines); i++ {
+    line := lines[i]
+    text := line.text
+
+    if strings.HasPrefix(text, "[[") && strings.HasSuffix(text, "]]") {
+      name, err := tomlKey(text[2:len(text)-2])
+      if err != nil {
+        return nil, fmt.Errorf("line %d: %s", line.number, err)
+      }
+      list, ok := root[name].([]interface{})
+      if _, exists := root[name]; exists && !ok {
+        return nil, fmt.Errorf("line %d: %s is not an array of tables", line.number, name)
+      }
+      current = make(map[string]interface{})
+      root[name] = append(list, current)
+      continue
+    }
+    if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+      name, err := tomlKey(text[1:len(text)-1])
+      if err != nil {
+        return nil, fmt.Errorf("line %d: %s", line.number, err)
+      }
+      if _, exists := root[name]; exists {
+        return nil, fmt.Errorf("line %d: duplicate table %s", line.number, name)
+      }
+      current = make(map[string]interface{})
+      root[name] = current
+      continue
+    }
+
+    equals := strings.Index(text, "=")
+    if equals < 0 {
+      return nil, fmt.Errorf("line %d: expected key = value", line.number)
+    }
+    key, err := tomlKey(text[:equals])
+    if err != nil {
+      return nil, fmt.Errorf("line %d: %s", line.number, err)
+    }
+
+    // arrays can go over several lines
+    rest := strings.TrimSpace(text[equals+1:])
+    for strings.HasPrefix(rest, "[") && strings.Count(rest, "[") > strings.Count(rest, "]") && i+1 < len(lines) {
+      i++
+      rest += " " + lines[i].text
+    }
+
+    value, err := tomlValue(rest)
+    if err != nil {
+      return nil, fmt.Errorf("line %d: %s", line.number, err)
+    }
+    if _, exists := current[key]; exists {
+      return nil, fmt.Errorf("line %d: duplicate key %s", line.number, key)
+    }
+    current[key] = value
+  }
+
+  return root, nil
+}
+
+// configField is a key and value in the order they are written out
+type configField struct {
+  Key string
+  // string, bool, []string or (only at the top level) [][]configField
+  Value interface{}
+}
+
+// quoteConfig quotes a value the way yaml, toml and json all read it (leaving < > and & alone so regexes
+// and urls stay readable)
+func quoteConfig (value string) (string) {
+  var quoted bytes.Buffer
+  encoder := json.NewEncoder(&quoted)
+  encoder.SetEscapeHTML(false)
+  encoder.Encode(value)
+  return strings.TrimSuffix(quoted.String(), "\n")
+}
+
+func flowList (values []string) (string) {
+  var quoted []string
+  for _, value := range values {
+    quoted = append(quoted, quoteConfig(value))
+  }
+  return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func scalarConfig (value interface{}) (string) {
+  switch v := value.(type) {
+  case bool:
+    return strconv.FormatBool(v)
+  case []string:
+    return flowList(v)
+  }
+  return quoteConfig(fmt.Sprint(value))
+}
+
+// writeYAML writes the fields in block style
+func writeYAML (w io.Writer, fields []configField) {
+  for _, field := range fields {
+    tables, ok := field.Value.([][]configField)
+    if !ok {
+      fmt.Fprintf(w, "%s: %s\n", field.Key, scalarConfig(field.Value))
+      continue
+    }
+
+    fmt.Fprintf(w, "\n%s:\n", field.Key)
+    for _, table := range tables {
+      for num, entry := range table {
+        prefix := "    "
+        if num == 0 {
+          prefix = "  - "
+        }
+        fmt.Fprintf(w, "%s%s: %s\n", prefix, entry.Key, scalarConfig(entry.Value))
+      }
+    }
+  }
+}
+
+// writeTOML writes the scalar fields first and then the [[arrays of tables]]
+func writeTOML (w io.Writer, fields []configField) {
+  for _, field := range fields {
+    if _, ok := field.Value.([][]configField); !ok {
+      fmt.Fprintf(w, "%s = %s\n", field.Key, scalarConfig(field.Value))
+    }
+  }
+
+  for _, field := range fields {
+    tables, ok := field.Value.([][]configField)
+    if !ok {
+      continue
+    }
+    for _, table := range tables {
+      fmt.Fprintf(w, "\n[[%s]]\n", field.Key)
+      for _, entry := range table {
+        fmt.Fprintf(w, "%s = %s\n", entry.Key, scalarConfig(entry.Value))
+      }
+    }
+  }
+}
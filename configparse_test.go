@@ -0,0 +1,223 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "strings"
+  "testing"
+)
+
+func treeJSON (t *testing.T, tree interface{}) (string) {
+  data, err := json.Marshal(tree)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  return string(data)
+}
+
+const testYAML = `
+# a comment
+normalize: [decode, "slashes"]
+networks:
+  - name: "ignore:F5"   # the load balancer
+    net: 10.231.9.92/32
+    ignore: true
+  -
+    name: 'it''s'
+    track:
+      - hosts
+      - uri
+empty:
+`
+
+func TestParseYAML (t *testing.T) {
+  tree, err := parseYAML(testYAML)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  got := treeJSON(t, tree)
+  want := `{"empty":null,"networks":[{"ignore":true,"name":"ignore:F5","net":"10.231.9.92/32"},{"name":"it's","track":["hosts","uri"]}],"normalize":["decode","slashes"]}`
+  if got != want {
+    t.Errorf("got  %s\nwant %s", got, want)
+  }
+}
+
+func TestParseYAMLErrors (t *testing.T) {
+  for _, data := range []string {
+    "a: 1\na: 2\n",
+    "a: {b: c}\n",
+    "a:\n  b: 1\n c: 2\n",
+    "just text\n",
+  } {
+    _, err := parseYAML(data)
+    if err == nil {
+      t.Errorf("no error for %q", data)
+    }
+  }
+}
+
+const testTOML = `
+normalize = ["decode", 'slashes'] # steps
+
+[[networks]]
+name = "ignore:F5"
+net = "10.231.9.92/32"
+ignore = true
+
+[[networks]]
+"name" = "it's # not a comment"
+track = [
+  "hosts",
+  "uri",
+]
+`
+
+func TestParseTOML (t *testing.T) {
+  tree, err := parseTOML(testTOML)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  got := treeJSON(t, tree)
+  want := `{"networks":[{"ignore":true,"name":"ignore:F5","net":"10.231.9.92/32"},{"name":"it's # not a comment","track":["hosts","uri"]}],"normalize":["decode","slashes"]}`
+  if got != want {
+    t.Errorf("got  %s\nwant %s", got, want)
+  }
+}
+
+func TestParseTOMLErrors (t *testing.T) {
+  for _, data := range []string {
+    "a = 1\na = 2\n",
+    "a.b = 1\n",
+    "[t]\n[t]\n",
+    "a = {b = 1}\n",
+    "no equals\n",
+  } {
+    _, err := parseTOML(data)
+    if err == nil {
+      t.Errorf("no error for %q", data)
+    }
+  }
+}
+
+func TestWriteYAMLAndTOML (t *testing.T) {
+  fields := []configField {
+    { "normalize", []string{ "decode" } },
+    { "networks", [][]configField { { { "name", `a "b"` }, { "ignore", true } }, { { "name", "c" } } } },
+  }
+
+  var yaml bytes.Buffer
+  writeYAML(&yaml, fields)
+  var toml bytes.Buffer
+  writeTOML(&toml, fields)
+
+  // both read back to the same tree
+  yamlTree, err := parseYAML(yaml.String())
+  if err != nil {
+    t.Errorf("error=%s\n%s", err, yaml.String())
+  }
+  tomlTree, err := parseTOML(toml.String())
+  if err != nil {
+    t.Errorf("error=%s\n%s", err, toml.String())
+  }
+  want := `{"networks":[{"ignore":true,"name":"a \"b\""},{"name":"c"}],"normalize":["decode"]}`
+  if treeJSON(t, yamlTree) != want || treeJSON(t, tomlTree) != want {
+    t.Errorf("yaml %s\ntoml %s", treeJSON(t, yamlTree), treeJSON(t, tomlTree))
+  }
+}
+
+func TestWriteConfigKeepsHTMLCharacters (t *testing.T) {
+  fields := []configField {
+    { "rewrites", [][]configField { { { "match", `^/search\?q=<[^>]*>&page=` }, { "replace", "/search?a=1&b=2" } } } },
+  }
+
+  for format, write := range map[string]func(io.Writer, []configField) { "yaml": writeYAML, "toml": writeTOML } {
+    var buf bytes.Buffer
+    write(&buf, fields)
+    if strings.Contains(buf.String(), `\u00`) || !strings.Contains(buf.String(), `<[^>]*>&page=`) {
+      t.Errorf("%s should keep < > and & as they are:\n%s", format, buf.String())
+    }
+
+    parse := parseYAML
+    if format == "toml" {
+      parse = parseTOML
+    }
+    tree, err := parse(buf.String())
+    if err != nil {
+      t.Errorf("%s: error=%s", format, err)
+      continue
+    }
+    rewrite := tree.(map[string]interface{})["rewrites"].([]interface{})[0].(map[string]interface{})
+    if rewrite["match"] != `^/search\?q=<[^>]*>&page=` || rewrite["replace"] != "/search?a=1&b=2" {
+      t.Errorf("%s did not round trip: %+v", format, rewrite)
+    }
+  }
+}
+
+func TestQuotedScalar (t *testing.T) {
+  for _, test := range []struct { text string; rules quoteRules; want string } {
+    { `"tab\there \x41\u00e9\U0001F600 \/ \e\N"`, yamlQuotes, "tab\there Aé\U0001F600 / \x1b\u0085" },
+    { `'it''s \n'`, yamlQuotes, `it's \n` },
+    { `"a \"b\" \\ \u00e9"`, tomlQuotes, `a "b" \ é` },
+    { `'C:\path'`, tomlQuotes, `C:\path` },
+  } {
+    got, err := quotedScalar(test.text, test.rules)
+    if err != nil || got != test.want {
+      t.Errorf("%s read as %q (error=%v) not %q", test.text, got, err, test.want)
+    }
+  }
+
+  // go escapes and the escapes of the other format are errors
+  for _, test := range []struct { text string; rules quoteRules } {
+    { `"\101"`, yamlQuotes },
+    { `"\'"`, yamlQuotes },
+    { `"\x41"`, tomlQuotes },
+    { `"\e"`, tomlQuotes },
+    { `"\/"`, tomlQuotes },
+    { `"\u12"`, tomlQuotes },
+    { `"\uD800"`, tomlQuotes },
+    { `'it''s'`, tomlQuotes },
+    { "\"a\x01b\"", tomlQuotes },
+    { `"a" "b"`, yamlQuotes },
+  } {
+    if got, err := quotedScalar(test.text, test.rules); err == nil {
+      t.Errorf("no error for %s (read as %q)", test.text, got)
+    }
+  }
+}
+
+func TestTOMLNumbers (t *testing.T) {
+  tree, err := parseTOML("a = 9_007_199_254_740_993\nb = 0x1f\nc = 1.5e3\nd = 0o17\ne = +0.5\n")
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  got := treeJSON(t, tree)
+  if got != `{"a":9007199254740993,"b":31,"c":1500,"d":15,"e":0.5}` {
+    t.Errorf("wrong numbers %s", got)
+  }
+  if _, ok := tree.(map[string]interface{})["a"].(int64); !ok {
+    t.Errorf("integers should be read as int64: %T", tree.(map[string]interface{})["a"])
+  }
+
+  for _, value := range []string { "01", "1_", "1__0", "1.", ".5", "inf", "nan", "1e_5", "99999999999999999999", "0x", "--1", "-0x1f" } {
+    if _, err := parseTOML("a = " + value + "\n"); err == nil {
+      t.Errorf("no error for %s", value)
+    }
+  }
+}
+
+func TestTOMLUnsupported (t *testing.T) {
+  for data, want := range map[string]string {
+    "x = 1\na.b = 1\n": "line 2: dotted keys are not supported",
+    "[t]\nx = 1\n[a.b]\n": "line 3: dotted keys are not supported",
+    "a = {b = 1}\n": "line 1: inline tables are not supported",
+    "a = [{b = 1}]\n": "line 1: inline tables are not supported",
+  } {
+    _, err := parseTOML(data)
+    if err == nil || !strings.Contains(err.Error(), want) {
+      t.Errorf("%q: expected %q got %v", data, want, err)
+    }
+  }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+  "encoding/csv"
+  "io"
+  "os"
+  "sort"
+  "strconv"
+)
+
+var csvHeader = []string{ "vhost", "kind", "label", "key", "requests", "bytes", "percentage" }
+
+func sortedTrackedKeys (tracking map[string]trackedData) ([]string) {
+  var keys []string
+  for k := range tracking {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+func sortedVHosts (tracking trackedOverall) ([]string) {
+  var keys []string
+  for k := range tracking.Tracked {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+func csvPercent (value int, total int) (string) {
+  return strconv.FormatFloat(percentOf(float64(value), float64(total)), 'f', 2, 64)
+}
+
+// csvSplitRows turns a campusSplit into total/oncampus/offcampus/ignored rows
+func csvSplitRows (vhost string, kind string, label string, split campusSplit) ([][]string) {
+  ignored := split.Total - split.OnCampus - split.OffCampus
+  ignoredBytes := split.TotalBytes - split.OnCampusBytes - split.OffCampusBytes
+
+  row := func(key string, requests int, bytes int64) ([]string) {
+    return []string{ vhost, kind, label, key, strconv.Itoa(requests), strconv.FormatInt(bytes, 10), csvPercent(requests, split.Total) }
+  }
+
+  return [][]string{
+    row("total", split.Total, split.TotalBytes),
+    row("oncampus", split.OnCampus, split.OnCampusBytes),
+    row("offcampus", split.OffCampus, split.OffCampusBytes),
+    row("ignored", ignored, ignoredBytes),
+  }
+}
+
+// csvOverall writes the split for the whole run, each vhost and every network/site in it
+func csvOverall (w io.Writer, tracking trackedOverall) (error) {
+  out := csv.NewWriter(w)
+  out.Write(csvHeader)
+
+  out.WriteAll(csvSplitRows("", "overall", "", tracking.campusSplit))
+  for _, vhost := range sortedVHosts(tracking) {
+    info := tracking.Tracked[vhost]
+    out.WriteAll(csvSplitRows(vhost, "vhost", "", info.campusSplit))
+    for _, label := range sortedTrackedKeys(info.Networks) {
+      out.WriteAll(csvSplitRows(vhost, "network", label, info.Networks[label].campusSplit))
+    }
+    for _, label := range sortedTrackedKeys(info.Sites) {
+      out.WriteAll(csvSplitRows(vhost, "site", label, info.Sites[label].campusSplit))
+    }
+  }
+
+  out.Flush()
+  return out.Error()
+}
+
+// csvCounts writes one row per host or base_uri (we only count requests for those so bytes is empty)
+func csvCounts (w io.Writer, tracking trackedOverall, key string) (error) {
+  out := csv.NewWriter(w)
+  out.Write(csvHeader)
+
+  writeCounts := func(vhost string, kind string, data map[string]trackedData) {
+    for _, label := range sortedTrackedKeys(data) {
+      v := data[label]
+      counts := v.Hosts
+      if key == "base_uri" {
+        counts = v.Base_uri
+      }
+      for _, item := range sortedMap(counts) {
+        if item.Key != "_total" {
+          out.Write([]string{ vhost, kind, label, item.Key, strconv.Itoa(item.Value), "", csvPercent(item.Value, v.Base_uri["_total"]) })
+        }
+      }
+    }
+  }
+
+  for _, vhost := range sortedVHosts(tracking) {
+    writeCounts(vhost, "network", tracking.Tracked[vhost].Networks)
+    writeCounts(vhost, "site", tracking.Tracked[vhost].Sites)
+  }
+
+  out.Flush()
+  return out.Error()
+}
+
+// csvTracked writes prefix-overall.csv, prefix-hosts.csv and prefix-base_uri.csv (or all
+// three tables one after the other when prefix is - for stdout)
+func csvTracked (prefix string, tracking trackedOverall) (error) {
+  tables := []struct { suffix string; write func(io.Writer) (error) } {
+    { "-overall.csv", func(w io.Writer) (error) { return csvOverall(w, tracking) } },
+    { "-hosts.csv", func(w io.Writer) (error) { return csvCounts(w, tracking, "hosts") } },
+    { "-base_uri.csv", func(w io.Writer) (error) { return csvCounts(w, tracking, "base_uri") } },
+  }
+
+  for num, table := range tables {
+    dest := prefix + table.suffix
+    if prefix == "-" {
+      dest = "-"
+      if num > 0 {
+        os.Stdout.WriteString("\n")
+      }
+    }
+
+    err := writeOutput(dest, table.write)
+    if err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+  "bytes"
+  "encoding/csv"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+var testCSVLines = []string {
+  `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `100.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 3000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/test.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+}
+
+func testCSVTracking (t *testing.T) (trackedOverall) {
+  tracking, _ := testTrackStuff(t, testCSVLines, 2, 2000)
+  return tracking
+}
+
+func readTestCSV (t *testing.T, data []byte) ([][]string) {
+  rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+  if err != nil {
+    t.Errorf("error reading csv: %s", err)
+  }
+  return rows
+}
+
+func findCSVRow (rows [][]string, vhost, kind, label, key string) ([]string) {
+  for _, row := range rows {
+    if row[0] == vhost && row[1] == kind && row[2] == label && row[3] == key {
+      return row
+    }
+  }
+  return nil
+}
+
+func TestCSVOverall (t *testing.T) {
+  var buf bytes.Buffer
+  err := csvOverall(&buf, testCSVTracking(t))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  rows := readTestCSV(t, buf.Bytes())
+  if len(rows) == 0 || rows[0][0] != "vhost" {
+    t.Errorf("missing header: %+v", rows)
+    return
+  }
+
+  row := findCSVRow(rows, "", "overall", "", "oncampus")
+  if row == nil || row[4] != "2" || row[5] != "2000" || row[6] != "66.67" {
+    t.Errorf("wrong overall oncampus row: %+v", row)
+  }
+
+  row = findCSVRow(rows, "_default", "site", "htbin", "offcampus")
+  if row == nil || row[4] != "1" || row[5] != "3000" {
+    t.Errorf("wrong htbin offcampus row: %+v", row)
+  }
+
+  row = findCSVRow(rows, "_default", "network", "10net", "total")
+  if row == nil || row[4] != "2" {
+    t.Errorf("wrong 10net total row: %+v", row)
+  }
+}
+
+func TestCSVCounts (t *testing.T) {
+  var buf bytes.Buffer
+  err := csvCounts(&buf, testCSVTracking(t), "base_uri")
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  rows := readTestCSV(t, buf.Bytes())
+  row := findCSVRow(rows, "_default", "site", "htbin", "/htbin/index.html")
+  if row == nil || row[4] != "2" || row[6] != "66.67" {
+    t.Errorf("wrong htbin index.html row: %+v", row)
+  }
+  if findCSVRow(rows, "_default", "site", "htbin", "_total") != nil {
+    t.Errorf("_total should not be written out")
+  }
+
+  buf.Reset()
+  csvCounts(&buf, testCSVTracking(t), "hosts")
+  rows = readTestCSV(t, buf.Bytes())
+  row = findCSVRow(rows, "_default", "network", "10net", "10.241.26.100")
+  if row == nil || row[4] != "2" {
+    t.Errorf("wrong 10net host row: %+v", row)
+  }
+}
+
+func TestCSVTrackedFiles (t *testing.T) {
+  prefix := filepath.Join(t.TempDir(), "test")
+  err := csvTracked(prefix, testCSVTracking(t))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  for _, suffix := range []string{ "-overall.csv", "-hosts.csv", "-base_uri.csv" } {
+    if _, err := os.Stat(prefix + suffix); err != nil {
+      t.Errorf("missing %s: %s", suffix, err)
+    }
+  }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "strings"
+)
+
+// lastStatusEntry finds the vhost/site entry that decided the status (a later one wins)
+func lastStatusEntry (items []statusConfig, name string) (int) {
+  found := -1
+  for num, item := range items {
+    if item.Name == name {
+      found = num
+    }
+  }
+  return found
+}
+
+// explainPattern says which pattern matched when it was not the exact name
+func explainPattern (name string, rule string) (string) {
+  if rule == name {
+    return ""
+  }
+  return "pattern " + rule + " "
+}
+
+func explainStatus (ignore bool, track bool) (string) {
+  if ignore {
+    return "ignore"
+  }
+  if track {
+    return "track"
+  }
+  return "summarize"
+}
+
+func trackedWith (hosts bool, uri bool) (string) {
+  switch {
+  case hosts && uri:
+    return "with its hosts and base_uri"
+  case hosts:
+    return "with its hosts"
+  case uri:
+    return "with its base_uri"
+  }
+  return "as counts only"
+}
+
+// explainEntry prints each decision trackEntry makes for the entry
+func explainEntry (w io.Writer, lc loadedConfig, entry map[string]string, samples sampleCounts) {
+  config := lc.config
+  original := entry["base_uri"]
+  normalizeEntry(config.normalizer, entry)
+  d := classifyEntry(config, entry, samples)
+  // what the networks, vhosts and sites decided before the rules changed it
+  before := config
+  before.rules = nil
+  b := classifyEntry(before, entry, nil)
+
+  line := func(step string, format string, args ...interface{}) {
+    fmt.Fprintf(w, "%-10s %s\n", step, fmt.Sprintf(format, args...))
+  }
+
+  ip := entry["ip"]
+  line("ip", "%s", ip)
+  switch {
+  case alreadyIP.MatchString(ip):
+    line("dns", "not needed")
+  case buDomain.MatchString(ip) && b.Network == "error":
+    line("dns", "lookup of %s failed so it is counted as %s without looking at the networks", ip, d.IP)
+  case buDomain.MatchString(ip):
+    line("dns", "%s resolved to %s", ip, d.IP)
+  default:
+    line("dns", "%s is neither an address nor a bu.edu name so it is counted as network %s", ip, b.Network)
+  }
+
+  if b.Network != "error" && b.Network != "outsideBUDNS" {
+    if num := b.NetworkRule; num >= 0 {
+      line("network", "%s (%s %s, the first entry containing %s)", b.Network, configWhere(lc, "networks", num), config.ipranges[num].net, d.IP)
+    } else {
+      line("network", "%s (no entry contains %s)", b.Network, d.IP)
+    }
+  }
+
+  if b.Ignore {
+    line("campus", "not checked because the network is ignored")
+  } else if b.OnCampus {
+    line("campus", "on (zone %s)", b.Zone)
+  } else {
+    line("campus", "off")
+  }
+
+  if num := lastStatusEntry(lc.typed.VHosts, d.VHostRule); d.VHostRule != "" && num >= 0 {
+    line("vhost", "%s is %s (%s%s)", d.VHost, explainStatus(d.IgnoreVHost, d.TrackVHost), explainPattern(d.VHost, d.VHostRule), configWhere(lc, "vhosts", num))
+  } else {
+    line("vhost", "%s is not listed so it is tracked", d.VHost)
+  }
+
+  if original != entry["base_uri"] {
+    line("normalize", "%s became %s", original, entry["base_uri"])
+  }
+  if num := lastStatusEntry(lc.typed.Sites, b.SiteRule); b.SiteRule != "" && num >= 0 {
+    line("site", "%s (from %s) is %s (%s%s)", b.Site, entry["base_uri"], explainStatus(b.IgnoreSite, b.TrackSite), explainPattern(b.Site, b.SiteRule), configWhere(lc, "sites", num))
+  } else {
+    line("site", "%s (from %s) is not listed so it is ignored", b.Site, entry["base_uri"])
+  }
+
+  for _, num := range d.Rules {
+    rule := lc.typed.Rules[num]
+    action := rule.Action
+    if rule.Value != "" {
+      action += " " + rule.Value
+    }
+    line("rule", "%s matched (%s): %s", rule.Name, configWhere(lc, "rules", num), action)
+  }
+
+  // the same order of decisions as trackEntry
+  split := "off campus"
+  if d.Ignore {
+    split = "ignored"
+  } else if d.OnCampus {
+    split = "on campus"
+  }
+  switch {
+  case d.Drop:
+    line("outcome", "left out by the sample rule so it is not counted at all")
+  case d.Ignore:
+    line("outcome", "only counted in the overall totals (ignored) because the network is ignored")
+  case d.IgnoreVHost:
+    line("outcome", "only counted in the overall totals (%s) because the vhost is ignored", split)
+  default:
+    outcome := fmt.Sprintf("counted %s in vhost %s under network %s %s", split, d.VHost, d.Network, trackedWith(d.TrackVHost && d.TrackHosts, d.TrackVHost && d.TrackURI))
+    if d.IgnoreSite {
+      outcome += " (not under a site)"
+    } else {
+      outcome += fmt.Sprintf(" and site %s %s", d.Site, trackedWith(d.TrackSite, d.TrackSite))
+    }
+    if len(d.Tags) > 0 {
+      outcome += " tagged " + strings.Join(d.Tags, ",")
+    }
+    line("outcome", "%s", outcome)
+  }
+}
+
+// explainArgs turns ip [vhost [path]] into an entry the way ParseAccess would have
+func explainArgs (args []string) (map[string]string) {
+  entry := map[string]string{ "ip": args[0], "base_uri": "/" }
+  if len(args) > 1 && args[1] != "" && args[1] != "-" {
+    entry["virtual"] = args[1]
+  }
+  if len(args) > 2 {
+    entry["base_uri"] = args[2]
+  }
+  setLevels(entry)
+  return entry
+}
+
+// explainMain is the explain command: a raw log line, ip [vhost [path]] or - for log lines on stdin
+func explainMain (filename string, args []string) (error) {
+  if len(args) == 0 {
+    return fmt.Errorf("usage: logparse explain ip [vhost [path]]\n       logparse explain 'raw log line'\n       logparse explain - < log lines")
+  }
+
+  lc, err := loadConfig(filename)
+  if err != nil {
+    return err
+  }
+
+  var lines []string
+  switch {
+  case len(args) == 1 && args[0] == "-":
+    data, err := ioutil.ReadAll(bufio.NewReader(os.Stdin))
+    if err != nil {
+      return err
+    }
+    lines = strings.Split(strings.TrimSpace(string(data)), "\n")
+  case len(args) == 1 && strings.Contains(args[0], " "):
+    lines = args
+  default:
+    explainEntry(os.Stdout, lc, explainArgs(args), nil)
+    return nil
+  }
+
+  // the sample rules count along the lines like they would in a run
+  samples := make(sampleCounts)
+  for num, line := range lines {
+    if num > 0 {
+      fmt.Println()
+    }
+    entry := ParseAccess(num, line)
+    if entry == nil {
+      return fmt.Errorf("could not parse %s", line)
+    }
+    explainEntry(os.Stdout, lc, entry, samples)
+  }
+  return nil
+}
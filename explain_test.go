@@ -0,0 +1,86 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+const testExplainConfig = `[
+  { "name": "ignore:F5-1", "net": "10.231.9.92/32", "ignore": "true" },
+  { "virtual": "testdomain1", "status": "ignore" },
+  { "name": "10net", "net": "10.0.0.0/8", "track": "hosts,uri" },
+  { "site": "htbin", "status": "track" },
+  { "normalize": "lowercase" }
+]
+`
+
+func testExplain (t *testing.T, filename string, entry map[string]string) (string) {
+  lc, err := loadConfig(filename)
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return ""
+  }
+
+  var buf bytes.Buffer
+  explainEntry(&buf, lc, entry, nil)
+  return buf.String()
+}
+
+func checkExplain (t *testing.T, out string, want []string) {
+  for _, w := range want {
+    if !strings.Contains(out, w + "\n") {
+      t.Errorf("missing %q in:\n%s", w, out)
+    }
+  }
+}
+
+func TestExplainTracked (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.json", testExplainConfig)
+  out := testExplain(t, filename, explainArgs([]string{ "10.1.2.3", "", "/HTBIN/test" }))
+
+  checkExplain(t, out, []string {
+    "dns        not needed",
+    "network    10net (" + filename + ":4 10.0.0.0/8, the first entry containing 10.1.2.3)",
+    "campus     on (zone campus)",
+    "vhost      _default is not listed so it is tracked",
+    "normalize  /HTBIN/test became /htbin/test",
+    "site       htbin (from /htbin/test) is track (" + filename + ":5)",
+    "outcome    counted on campus in vhost _default under network 10net with its hosts and base_uri and site htbin with its hosts and base_uri",
+  })
+}
+
+func TestExplainIgnored (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.json", testExplainConfig)
+
+  out := testExplain(t, filename, explainArgs([]string{ "10.231.9.92", "www", "/met" }))
+  checkExplain(t, out, []string {
+    "campus     not checked because the network is ignored",
+    "site       met (from /met) is not listed so it is ignored",
+    "outcome    only counted in the overall totals (ignored) because the network is ignored",
+  })
+
+  out = testExplain(t, filename, explainArgs([]string{ "1.2.3.4", "testdomain1" }))
+  checkExplain(t, out, []string {
+    "network    default (no entry contains 1.2.3.4)",
+    "vhost      testdomain1 is ignore (" + filename + ":3)",
+    "outcome    only counted in the overall totals (off campus) because the vhost is ignored",
+  })
+
+  out = testExplain(t, filename, explainArgs([]string{ "crawler.example.com" }))
+  checkExplain(t, out, []string {
+    "dns        crawler.example.com is neither an address nor a bu.edu name so it is counted as network outsideBUDNS",
+  })
+}
+
+func TestExplainLogLine (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.yaml", "networks:\n  - name: 10net\n    net: 10.0.0.0/8\n    track: [uri]\n")
+
+  // the outcome agrees with what trackEntry counted for the same line
+  entry := ParseAccess(0, testCSVLines[0])
+  out := testExplain(t, filename, entry)
+  checkExplain(t, out, []string {
+    "network    10net (" + filename + ":2 10.0.0.0/8, the first entry containing 10.241.26.100)",
+    "outcome    counted on campus in vhost _default under network 10net with its base_uri (not under a site)",
+  })
+}
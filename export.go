@@ -0,0 +1,260 @@
+package main
+
+import (
+  "bufio"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// the fields ParseAccess (and setLevels) fill in
+var entryColumns = []string {
+  "ip", "ident", "user", "date", "timezone", "request_line", "method", "uri", "base_uri", "query", "protocol",
+  "ret", "size", "elapsed", "cpu", "cpuchild", "referer", "browser", "pid", "keepalive", "uniq",
+  "serverip", "https", "virtual", "toplevel", "secondLevel",
+}
+
+// the fields added from the config decisions
+var decisionColumns = []string {
+  "time", "network", "network_ip", "campus", "zone", "vhost", "vhost_status", "site", "site_status", "tags",
+}
+
+var defaultExportColumns = []string {
+  "time", "ip", "network", "campus", "vhost", "vhost_status", "site", "site_status",
+  "method", "base_uri", "query", "ret", "size", "elapsed", "referer", "browser",
+}
+
+// parseExportColumns checks a comma separated column list ("" is the default list and "all" is everything)
+func parseExportColumns (list string) ([]string, error) {
+  if list == "" {
+    return defaultExportColumns, nil
+  }
+
+  known := make(map[string]bool)
+  for _, column := range append(append([]string{}, entryColumns...), decisionColumns...) {
+    known[column] = true
+  }
+
+  if list == "all" {
+    var columns []string
+    for column := range known {
+      columns = append(columns, column)
+    }
+    sort.Strings(columns)
+    return columns, nil
+  }
+
+  var columns []string
+  for _, column := range strings.Split(list, ",") {
+    column = strings.TrimSpace(column)
+    if ! known[column] {
+      return nil, fmt.Errorf("unknown export column %q", column)
+    }
+    columns = append(columns, column)
+  }
+  return columns, nil
+}
+
+// entryTime turns the [date and timezone] of a log line into a time
+func entryTime (entry map[string]string) (time.Time, bool) {
+  t, err := time.Parse("[02/Jan/2006:15:04:05 -0700]", entry["date"] + " " + entry["timezone"])
+  return t, err == nil
+}
+
+func decisionStatus (ignore bool, track bool) (string) {
+  if ignore {
+    return "ignore"
+  }
+  if track {
+    return "track"
+  }
+  return "count"
+}
+
+// unquoteField undoes what ParseAccess leaves in place - the quotes of the request, referer and browser and \" as &quot;
+func unquoteField (value string) (string) {
+  return strings.Replace(strings.Trim(value, `"`), "&quot;", `"`, -1)
+}
+
+// exportFields is the parsed entry plus the decisions trackEntry would make for it
+func exportFields (entry map[string]string, d entryDecision) (map[string]string) {
+  fields := make(map[string]string)
+  for k, v := range entry {
+    fields[k] = unquoteField(v)
+  }
+
+  if t, ok := entryTime(entry); ok {
+    fields["time"] = t.Format(time.RFC3339)
+  }
+  fields["network"] = d.Network
+  fields["network_ip"] = d.IP
+  fields["campus"] = "off"
+  if d.Ignore {
+    fields["campus"] = "ignored"
+  } else if d.OnCampus {
+    fields["campus"] = "on"
+  }
+  fields["zone"] = d.Zone
+  fields["vhost"] = d.VHost
+  fields["vhost_status"] = decisionStatus(d.IgnoreVHost, d.TrackVHost)
+  fields["site"] = d.Site
+  fields["site_status"] = decisionStatus(d.IgnoreSite, d.TrackSite)
+  fields["tags"] = strings.Join(d.Tags, ",")
+
+  return fields
+}
+
+type exportWriter struct {
+  format string
+  columns []string
+  w *bufio.Writer
+  csv *csv.Writer
+  // index name pattern of the bulk format
+  index string
+  // set when the bulk lines are posted instead of written
+  post *bulkPoster
+}
+
+// newExportWriter starts an export in jsonl, csv (which gets a header line) or the elasticsearch _bulk format
+func newExportWriter (w io.Writer, format string, columns []string) (*exportWriter, error) {
+  ew := &exportWriter{ format: format, columns: columns, w: bufio.NewWriter(w), index: "logparse-%Y.%m.%d" }
+
+  switch format {
+  case "jsonl", "bulk":
+  case "csv":
+    ew.csv = csv.NewWriter(ew.w)
+    ew.csv.Write(columns)
+  default:
+    return nil, fmt.Errorf("unknown export format %q (jsonl, csv or bulk)", format)
+  }
+  return ew, nil
+}
+
+// jsonColumns writes the columns as a json object keeping the column order
+func jsonColumns (columns []string, fields map[string]string) ([]byte) {
+  line := []byte("{")
+  for num, column := range columns {
+    if num > 0 {
+      line = append(line, ',')
+    }
+    key, _ := json.Marshal(column)
+    value, _ := json.Marshal(fields[column])
+    line = append(line, key...)
+    line = append(line, ':')
+    line = append(line, value...)
+  }
+  return append(line, '}')
+}
+
+func writeExportEntry (ew *exportWriter, fields map[string]string) (error) {
+  if ew.csv != nil {
+    var row []string
+    for _, column := range ew.columns {
+      row = append(row, fields[column])
+    }
+    return ew.csv.Write(row)
+  }
+
+  if ew.format == "bulk" {
+    lines := bulkLines(ew.index, ew.columns, fields)
+    if ew.post != nil {
+      return addBulk(ew.post, lines)
+    }
+    _, err := ew.w.Write(lines)
+    return err
+  }
+
+  _, err := ew.w.Write(append(jsonColumns(ew.columns, fields), '\n'))
+  return err
+}
+
+func finishExport (ew *exportWriter) (error) {
+  if ew.post != nil {
+    if err := postBulk(ew.post); err != nil {
+      return err
+    }
+  }
+  if ew.csv != nil {
+    ew.csv.Flush()
+    if err := ew.csv.Error(); err != nil {
+      return err
+    }
+  }
+  return ew.w.Flush()
+}
+
+// exportLog is scanLog for the export mode - every parsed line is written out instead of being counted
+func exportLog (config logConfig, input io.Reader, ew *exportWriter, meta *summaryMeta) (error) {
+  scanner := bufio.NewScanner(input)
+  samples := make(sampleCounts)
+
+  for scanner.Scan() {
+    number := meta.Lines
+    line := scanner.Text()
+    entry := ParseAccess(number, line)
+    if entry != nil {
+      normalizeEntry(config.normalizer, entry)
+      // entries a sample rule leaves out are not exported either
+      if d := classifyEntry(config, entry, samples); !d.Drop {
+        err := writeExportEntry(ew, exportFields(entry, d))
+        if err != nil {
+          return err
+        }
+      }
+    } else {
+      meta.ParseErrors++
+      fmt.Fprintf(diag, "%d: parse line %s\n", number, line)
+    }
+
+    if number % 500000 == 0 {
+      t := time.Now()
+      fmt.Fprintf(progress, "processed=%d (%s)\n", number, t.Format("20060102150405"))
+    }
+    meta.Lines++
+  }
+
+  return scanner.Err()
+}
+
+// exportMain writes the entries of the log files (or stdin) to stdout
+func exportMain (config logConfig, inputs []string) (error) {
+  columns, err := parseExportColumns(*columnsFlag)
+  if err != nil {
+    return err
+  }
+  ew, err := newExportWriter(os.Stdout, *formatFlag, columns)
+  if err != nil {
+    return err
+  }
+  if *indexFlag != "" {
+    ew.index = *indexFlag
+  }
+  if *bulkURLFlag != "" {
+    if ew.format != "bulk" {
+      return fmt.Errorf("-bulkurl needs -format bulk")
+    }
+    ew.post = newBulkPoster(*bulkURLFlag, *bulkSizeFlag, *bulkRetriesFlag)
+  }
+
+  meta := initSummaryMeta()
+  if len(inputs) == 0 {
+    inputs = []string{ "-" }
+  }
+  for _, filename := range inputs {
+    input, closer, err := openLog(filename)
+    if err != nil {
+      return err
+    }
+    err = exportLog(config, input, ew, meta)
+    closer()
+    if err != nil {
+      return err
+    }
+  }
+  return finishExport(ew)
+}
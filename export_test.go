@@ -0,0 +1,94 @@
+package main
+
+import (
+  "bytes"
+  "encoding/csv"
+  "encoding/json"
+  "strings"
+  "testing"
+)
+
+func testExport (t *testing.T, format string, columns []string, lines []string) (string) {
+  config, err := testIPRanges()
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  var buf bytes.Buffer
+  ew, err := newExportWriter(&buf, format, columns)
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return ""
+  }
+  err = exportLog(config, strings.NewReader(strings.Join(lines, "\n")), ew, initSummaryMeta())
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  finishExport(ew)
+  return buf.String()
+}
+
+func TestExportJSONLines (t *testing.T) {
+  out := testExport(t, "jsonl", defaultExportColumns, testCSVLines)
+
+  lines := strings.Split(strings.TrimSpace(out), "\n")
+  if len(lines) != 3 {
+    t.Errorf("expected 3 lines got:\n%s", out)
+    return
+  }
+
+  var entry map[string]string
+  err := json.Unmarshal([]byte(lines[0]), &entry)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  if entry["network"] != "10net" || entry["campus"] != "on" || entry["site"] != "htbin" || entry["site_status"] != "track" {
+    t.Errorf("wrong decisions: %+v", entry)
+  }
+  if entry["method"] != "GET" || entry["time"] != "2017-09-01T00:00:08-04:00" {
+    t.Errorf("wrong fields: %+v", entry)
+  }
+  if !strings.HasPrefix(lines[0], `{"time":`) {
+    t.Errorf("column order not kept: %s", lines[0])
+  }
+
+  json.Unmarshal([]byte(lines[1]), &entry)
+  if entry["network"] != "default" || entry["campus"] != "off" {
+    t.Errorf("wrong decisions for second line: %+v", entry)
+  }
+}
+
+func TestExportCSV (t *testing.T) {
+  out := testExport(t, "csv", []string{ "ip", "vhost", "vhost_status", "size" }, testCSVLines[:1])
+
+  rows, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+  if err != nil || len(rows) != 2 {
+    t.Errorf("wrong csv (%s):\n%s", err, out)
+    return
+  }
+  if strings.Join(rows[0], ",") != "ip,vhost,vhost_status,size" || strings.Join(rows[1], ",") != "10.241.26.100,_default,track,1000" {
+    t.Errorf("wrong csv:\n%s", out)
+  }
+}
+
+func TestExportColumns (t *testing.T) {
+  columns, err := parseExportColumns("ip, campus")
+  if err != nil || len(columns) != 2 || columns[1] != "campus" {
+    t.Errorf("wrong columns %+v (%s)", columns, err)
+  }
+
+  _, err = parseExportColumns("ip,nosuch")
+  if err == nil {
+    t.Errorf("unknown column accepted")
+  }
+
+  columns, _ = parseExportColumns("all")
+  if len(columns) != len(entryColumns) + len(decisionColumns) {
+    t.Errorf("all is missing columns: %+v", columns)
+  }
+
+  _, err = newExportWriter(&bytes.Buffer{}, "xml", columns)
+  if err == nil {
+    t.Errorf("unknown format accepted")
+  }
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+  "html/template"
+  "io"
+  "sort"
+  "time"
+)
+
+// only the top rows of the host and base_uri tables go into the report to keep the file small
+const htmlMaxRows = 100
+
+type htmlRow struct {
+  Label string
+  Requests int
+  Bytes int64
+  HasBytes bool
+  Percent float64
+}
+
+type htmlTable struct {
+  Title string
+  Rows []htmlRow
+  Truncated int
+}
+
+type htmlBar struct {
+  X float64
+  Width float64
+  OnY float64
+  OnHeight float64
+  OffY float64
+  OffHeight float64
+  Title string
+}
+
+type htmlChart struct {
+  Width int
+  Height int
+  Bars []htmlBar
+  Max int
+  First string
+  Last string
+}
+
+type htmlCard struct {
+  Title string
+  Requests int
+  Bytes int64
+  RequestPercent float64
+  BytePercent float64
+}
+
+type htmlVHost struct {
+  Name string
+  Number int
+  Cards []htmlCard
+  Chart *htmlChart
+  Tables []htmlTable
+}
+
+type htmlReport struct {
+  Title string
+  Generated string
+  Cards []htmlCard
+  // nil unless a sample rule left entries out
+  Sampled *reportSampled
+  Chart *htmlChart
+  VHosts []htmlVHost
+}
+
+func htmlCards (split campusSplit) ([]htmlCard) {
+  card := func(title string, requests int, bytes int64) (htmlCard) {
+    return htmlCard{ title, requests, bytes,
+      percentOf(float64(requests), float64(split.Total)), percentOf(float64(bytes), float64(split.TotalBytes)) }
+  }
+
+  return []htmlCard{
+    card("Total", split.Total, split.TotalBytes),
+    card("On Campus", split.OnCampus, split.OnCampusBytes),
+    card("Off Campus", split.OffCampus, split.OffCampusBytes),
+    card("Ignored", split.Total - split.OnCampus - split.OffCampus,
+      split.TotalBytes - split.OnCampusBytes - split.OffCampusBytes),
+  }
+}
+
+// htmlTimeline builds a stacked bar chart (on campus under off campus) of requests per hour
+func htmlTimeline (timeline map[string]campusSplit) (*htmlChart) {
+  if len(timeline) == 0 {
+    return nil
+  }
+
+  var buckets []string
+  for bucket := range timeline {
+    buckets = append(buckets, bucket)
+  }
+  sort.Strings(buckets)
+
+  chart := &htmlChart{ Width: 800, Height: 200, First: buckets[0], Last: buckets[len(buckets)-1] }
+  for _, bucket := range buckets {
+    if timeline[bucket].Total > chart.Max {
+      chart.Max = timeline[bucket].Total
+    }
+  }
+
+  barWidth := float64(chart.Width) / float64(len(buckets))
+  scale := float64(chart.Height) / float64(chart.Max)
+  for num, bucket := range buckets {
+    split := timeline[bucket]
+    onHeight := float64(split.OnCampus) * scale
+    offHeight := float64(split.OffCampus) * scale
+    chart.Bars = append(chart.Bars, htmlBar{
+      X: float64(num) * barWidth,
+      Width: barWidth,
+      OnY: float64(chart.Height) - onHeight,
+      OnHeight: onHeight,
+      OffY: float64(chart.Height) - onHeight - offHeight,
+      OffHeight: offHeight,
+      Title: bucket + ": " + addCommaToInt(split.OnCampus) + " on / " + addCommaToInt(split.OffCampus) + " off campus",
+    })
+  }
+
+  return chart
+}
+
+// htmlSplitTable is one row per network or site
+func htmlSplitTable (title string, data map[string]trackedData, total int) (htmlTable) {
+  table := htmlTable{ Title: title }
+  for _, label := range sortedTrackedKeys(data) {
+    v := data[label]
+    table.Rows = append(table.Rows, htmlRow{ label, v.Total, v.TotalBytes, true, percentOf(float64(v.Total), float64(total)) })
+  }
+
+  sort.SliceStable(table.Rows, func(i, j int) bool { return table.Rows[i].Requests > table.Rows[j].Requests })
+  return table
+}
+
+// htmlCountTables makes a table for every network/site that tracks hosts or base_uri
+func htmlCountTables (kind string, data map[string]trackedData) ([]htmlTable) {
+  var tables []htmlTable
+
+  for _, label := range sortedTrackedKeys(data) {
+    v := data[label]
+    for _, counts := range []struct { name string; track bool; data map[string]int } {
+      { "hosts", v.TrackHosts, v.Hosts },
+      { "base_uri", v.TrackURI, v.Base_uri },
+    } {
+      if ! counts.track {
+        continue
+      }
+
+      table := htmlTable{ Title: kind + " " + label + " " + counts.name }
+      for _, item := range sortedMap(counts.data) {
+        if item.Key == "_total" {
+          continue
+        }
+        if len(table.Rows) >= htmlMaxRows {
+          table.Truncated++
+          continue
+        }
+        table.Rows = append(table.Rows, htmlRow{ item.Key, item.Value, 0, false, percentOf(float64(item.Value), float64(v.Base_uri["_total"])) })
+      }
+      tables = append(tables, table)
+    }
+  }
+
+  return tables
+}
+
+func buildHTMLReport (title string, tracking trackedOverall) (htmlReport) {
+  report := htmlReport{
+    Title: title,
+    Generated: time.Now().Format("2006-01-02 15:04:05"),
+    Cards: htmlCards(tracking.campusSplit),
+    Sampled: reportSampling(tracking),
+    Chart: htmlTimeline(tracking.Timeline),
+  }
+
+  for _, vhost := range sortedVHosts(tracking) {
+    info := tracking.Tracked[vhost]
+    v := htmlVHost{ Name: vhost, Number: info.Number, Cards: htmlCards(info.campusSplit), Chart: htmlTimeline(info.Timeline) }
+    v.Tables = append(v.Tables, htmlSplitTable("networks", info.Networks, info.Total))
+    v.Tables = append(v.Tables, htmlSplitTable("sites", info.Sites, info.Total))
+    v.Tables = append(v.Tables, htmlCountTables("network", info.Networks)...)
+    v.Tables = append(v.Tables, htmlCountTables("site", info.Sites)...)
+    report.VHosts = append(report.VHosts, v)
+  }
+
+  return report
+}
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+  "comma": addCommaToInt,
+  "kbytes": func(bytes int64) (string) { return addCommaToInt64(bytes/1024) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.cards { display: flex; gap: 1em; margin: 1em 0; }
+.card { border: 1px solid #ccc; border-radius: 6px; padding: 0.8em 1.2em; min-width: 10em; }
+.card h3 { margin: 0 0 0.4em 0; font-size: 1em; color: #555; }
+.card .big { font-size: 1.6em; font-weight: bold; }
+table { border-collapse: collapse; margin: 0.5em 0 1.5em 0; }
+th, td { border: 1px solid #ddd; padding: 0.2em 0.6em; }
+th { background: #eee; cursor: pointer; }
+td.num { text-align: right; }
+rect.on { fill: #cc0000; }
+rect.off { fill: #999999; }
+.legend { font-size: 0.9em; color: #555; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="legend">generated {{.Generated}}</p>
+{{define "cards"}}<div class="cards">{{range .}}
+<div class="card"><h3>{{.Title}}</h3><div class="big">{{comma .Requests}}</div>
+requests ({{printf "%.2f" .RequestPercent}} %)<br>{{kbytes .Bytes}} kbytes ({{printf "%.2f" .BytePercent}} %)</div>{{end}}
+</div>{{end}}
+{{define "chart"}}{{if .}}<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}" xmlns="http://www.w3.org/2000/svg">
+{{range .Bars}}<g><title>{{.Title}}</title><rect class="off" x="{{printf "%.2f" .X}}" y="{{printf "%.2f" .OffY}}" width="{{printf "%.2f" .Width}}" height="{{printf "%.2f" .OffHeight}}"/><rect class="on" x="{{printf "%.2f" .X}}" y="{{printf "%.2f" .OnY}}" width="{{printf "%.2f" .Width}}" height="{{printf "%.2f" .OnHeight}}"/></g>
+{{end}}</svg>
+<p class="legend">requests per hour from {{.First}} to {{.Last}} (max {{comma .Max}}); red is on campus, grey is off campus</p>{{end}}{{end}}
+{{template "cards" .Cards}}
+{{with .Sampled}}<p class="legend">sampled: {{comma .Left}} entries were left out by sample rules, every count is of the {{comma .Kept}} kept{{range .Rules}}; rule {{.Name}} {{.Action}} matched {{comma .Hits}} ({{.Where}}){{end}}</p>
+{{end}}{{template "chart" .Chart}}
+{{range .VHosts}}
+<h2>vhost {{.Name}}</h2>
+<p>{{comma .Number}} tracked requests</p>
+{{template "cards" .Cards}}
+{{template "chart" .Chart}}
+{{range .Tables}}
+<h3>{{.Title}}</h3>
+<table class="sortable">
+<thead><tr><th>name</th><th>requests</th><th>kbytes</th><th>%</th></tr></thead>
+<tbody>{{range .Rows}}
+<tr><td>{{.Label}}</td><td class="num" data-sort="{{.Requests}}">{{comma .Requests}}</td><td class="num" data-sort="{{.Bytes}}">{{if .HasBytes}}{{kbytes .Bytes}}{{end}}</td><td class="num" data-sort="{{.Percent}}">{{printf "%.2f" .Percent}}</td></tr>{{end}}
+</tbody>
+</table>
+{{if .Truncated}}<p class="legend">{{comma .Truncated}} more rows not shown</p>{{end}}
+{{end}}
+{{end}}
+<script>
+// click on a column header to sort by it (numbers use data-sort)
+document.querySelectorAll("table.sortable th").forEach(function(th, _) {
+  th.addEventListener("click", function() {
+    var table = th.closest("table");
+    var index = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var body = table.tBodies[0];
+    var rows = Array.prototype.slice.call(body.rows);
+    var desc = th.dataset.dir !== "desc";
+    th.dataset.dir = desc ? "desc" : "asc";
+    rows.sort(function(a, b) {
+      var x = a.cells[index], y = b.cells[index];
+      var result;
+      if (x.dataset.sort !== undefined) {
+        result = parseFloat(x.dataset.sort) - parseFloat(y.dataset.sort);
+      } else {
+        result = x.textContent.localeCompare(y.textContent);
+      }
+      return desc ? -result : result;
+    });
+    rows.forEach(function(row) { body.appendChild(row); });
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+func writeHTMLReport (w io.Writer, title string, tracking trackedOverall) (error) {
+  return htmlTemplate.Execute(w, buildHTMLReport(title, tracking))
+}
+
+func htmlTracked (dest string, title string, tracking trackedOverall) (error) {
+  return writeOutput(dest, func(w io.Writer) (error) { return writeHTMLReport(w, title, tracking) })
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+var testHTMLLines = []string {
+  `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `100.241.26.100 - - [01/Sep/2017:01:10:08 -0400] "GET /htbin/<script>.html HTTP/1.1" 200 3000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `100.241.26.100 - - [01/Sep/2017:01:20:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 3000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+}
+
+func TestHourBucket (t *testing.T) {
+  var cache hourCache
+  if bucket := hourBucket(&cache, "[01/Sep/2017:00:00:08", "-0400]"); bucket != "2017-09-01T04" {
+    t.Errorf("hourBucket: expected 2017-09-01T04 got %s", bucket)
+  }
+  // the same hour in another offset is another bucket (the cache has to see the offset too)
+  if bucket := hourBucket(&cache, "[01/Sep/2017:00:10:08", "+0000]"); bucket != "2017-09-01T00" {
+    t.Errorf("hourBucket: expected 2017-09-01T00 got %s", bucket)
+  }
+  // 01:30 happens twice when DST ends and they are an hour apart
+  if bucket := hourBucket(&cache, "[05/Nov/2017:01:30:00", "-0500]"); bucket != "2017-11-05T06" {
+    t.Errorf("hourBucket: expected 2017-11-05T06 got %s", bucket)
+  }
+  if bucket := hourBucket(&cache, "[24/Aug/2017:17:02:18", "+0530]"); bucket != "2017-08-24T11" {
+    t.Errorf("hourBucket: expected 2017-08-24T11 got %s", bucket)
+  }
+  if bucket := hourBucket(&cache, "garbage", "-0400]"); bucket != "" {
+    t.Errorf("hourBucket: expected nothing for garbage and got %s", bucket)
+  }
+}
+
+func TestHTMLTimeline (t *testing.T) {
+  tracking, _ := testTrackStuff(t, testHTMLLines, 1, 1000)
+
+  if len(tracking.Timeline) != 2 || tracking.Timeline["2017-09-01T05"].OffCampus != 2 {
+    t.Errorf("timeline should have 2 hours with 2 off campus in the second: %+v", tracking.Timeline)
+  }
+
+  chart := htmlTimeline(tracking.Timeline)
+  if chart == nil || len(chart.Bars) != 2 || chart.Max != 2 {
+    t.Errorf("chart should have 2 bars with a max of 2: %+v", chart)
+    return
+  }
+  if chart.Bars[1].OffHeight != float64(chart.Height) || chart.Bars[0].OnHeight != float64(chart.Height)/2 {
+    t.Errorf("bars are not scaled correctly: %+v", chart.Bars)
+  }
+}
+
+func TestHTMLReport (t *testing.T) {
+  tracking, _ := testTrackStuff(t, testHTMLLines, 1, 1000)
+
+  var buf bytes.Buffer
+  err := writeHTMLReport(&buf, "test report", tracking)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  html := buf.String()
+  for _, expected := range []string{ "<title>test report</title>", "vhost _default", "<svg", "site htbin base_uri", "/htbin/index.html" } {
+    if ! strings.Contains(html, expected) {
+      t.Errorf("report is missing %s", expected)
+    }
+  }
+
+  // the uri comes from the log so it has to be escaped
+  if strings.Contains(html, "/htbin/<script>.html") {
+    t.Errorf("base_uri was not escaped in the report")
+  }
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+)
+
+// configSource is everything that was read for a config - with includes typed is the merged config, where is
+// the file:line each of its entries came from and notes lists the entries an overlay replaced
+type configSource struct {
+  typed configFile
+  // the contents of every file read, each once (for the hash)
+  data []byte
+  files []string
+  // the contents of each of files (with includes)
+  contents [][]byte
+  where map[string][]string
+  notes []string
+}
+
+// configSections are the sections an entry can be pointed at in (normalize is a plain list)
+var configSections = []string{ "networks", "vhosts", "sites", "campus", "rewrites", "rules" }
+
+// parseConfigFile reads one file into the typed form - legacy is the ipnets.json array when it was one
+func parseConfigFile (filename string) (configFile, []map[string]string, []byte, error) {
+  file, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return configFile{}, nil, nil, err
+  }
+
+  var tree interface{}
+  switch configFormat(filename, file) {
+  case "yaml":
+    tree, err = parseYAML(string(file))
+  case "toml":
+    tree, err = parseTOML(string(file))
+  case "legacy":
+    var data []map[string]string
+    err = json.Unmarshal(file, &data)
+    if err != nil {
+      return configFile{}, nil, file, fmt.Errorf("%s: %s", filename, err)
+    }
+    typed, _ := legacyToTyped(data)
+    // the built in campus ranges are what no campus section means anyway and would replace an included zone
+    typed.Campus = nil
+    return typed, data, file, nil
+  default:
+    err = json.Unmarshal(file, &tree)
+  }
+  if err != nil {
+    return configFile{}, nil, file, fmt.Errorf("%s: %s", filename, err)
+  }
+
+  typed, err := decodeConfigTree(tree)
+  if err != nil {
+    return configFile{}, nil, file, fmt.Errorf("%s: %s", filename, err)
+  }
+  return typed, nil, file, nil
+}
+
+// includePath is an include relative to the file it is in
+func includePath (from string, include string) (string) {
+  if filepath.IsAbs(include) {
+    return include
+  }
+  return filepath.Join(filepath.Dir(from), include)
+}
+
+// fileWhere is file:line for each entry of a single file
+func fileWhere (filename string, typed configFile, positions configPositions) (map[string][]string) {
+  counts := map[string]int{ "networks": len(typed.Networks), "vhosts": len(typed.VHosts), "sites": len(typed.Sites),
+    "campus": len(typed.Campus), "rewrites": len(typed.Rewrites), "rules": len(typed.Rules) }
+
+  where := make(map[string][]string)
+  for _, section := range configSections {
+    for num := 0; num < counts[section]; num++ {
+      location := fmt.Sprintf("%s %s[%d]", filename, section, num)
+      if line := configPosition(positions, section, num); line > 0 {
+        location = fmt.Sprintf("%s:%d", filename, line)
+      }
+      where[section] = append(where[section], location)
+    }
+  }
+  return where
+}
+
+// readConfigLayers reads a file and everything it includes (chain is the files that included it, to catch loops)
+func readConfigLayers (filename string, chain []string) (configSource, error) {
+  var src configSource
+
+  abs, _ := filepath.Abs(filename)
+  for _, earlier := range chain {
+    if earlier == abs {
+      return src, fmt.Errorf("%s: include loop (%s)", filename, strings.Join(append(chain, abs), " -> "))
+    }
+  }
+
+  typed, _, file, err := parseConfigFile(filename)
+  if err != nil {
+    return src, err
+  }
+  own := configSource{ typed: typed, data: file, files: []string{ filename }, contents: [][]byte{ file },
+    where: fileWhere(filename, typed, findConfigPositions(configFormat(filename, file), file)) }
+  if len(typed.Include) == 0 {
+    return own, nil
+  }
+
+  // the includes are layered in order and the file itself goes on top of them
+  for num, include := range typed.Include {
+    layer, err := readConfigLayers(includePath(filename, include), append(chain, abs))
+    if err != nil {
+      return src, fmt.Errorf("%s: include %s: %s", filename, include, err)
+    }
+    if num == 0 {
+      src = layer
+    } else {
+      src = mergeConfig(src, layer)
+    }
+  }
+  own.typed.Include = nil
+  return mergeConfig(src, own), nil
+}
+
+// mergeSource is where an entry of the merged config comes from
+type mergeSource struct {
+  overlay bool
+  num int
+}
+
+// mergeByName lays the overlay entries over the base ones - an overlay entry with the name of a base entry
+// replaces it where it is, the rest are added at the end (unnamed entries never collide).  replaced maps
+// the overlay entries that replaced something to the base entry.
+func mergeByName (base []string, overlay []string) ([]mergeSource, map[int]int) {
+  replaced := make(map[int]int)
+  byName := make(map[string]int)
+  for num, name := range overlay {
+    if name != "" {
+      byName[name] = num
+    }
+  }
+
+  var sources []mergeSource
+  used := make(map[int]bool)
+  for num, name := range base {
+    if over, ok := byName[name]; ok && name != "" {
+      // a name the base lists twice only keeps the one place
+      if !used[over] {
+        sources = append(sources, mergeSource{ true, over })
+        replaced[over] = num
+        used[over] = true
+      }
+      continue
+    }
+    sources = append(sources, mergeSource{ false, num })
+  }
+  for num := range overlay {
+    if !used[num] {
+      sources = append(sources, mergeSource{ true, num })
+    }
+  }
+  return sources, replaced
+}
+
+// mergeConfig puts overlay on top of base:
+//   networks  a network with the name of a base one replaces it in place and the other overlay networks
+//             go before the base ones so they win the lookups
+//   vhosts, sites, campus zones and rules
+//             an entry with the name of a base entry replaces it in place, new ones are added at the end
+//   rewrites  the same keyed on match
+//   normalize the overlay's steps are added after the base ones
+func mergeConfig (base configSource, overlay configSource) (configSource) {
+  merged := configSource{ where: make(map[string][]string), notes: append(append([]string{}, base.notes...), overlay.notes...) }
+  // a file included from more than one place is only listed (and hashed) once
+  seen := make(map[string]bool)
+  for _, layer := range []configSource{ base, overlay } {
+    for num, filename := range layer.files {
+      abs, _ := filepath.Abs(filename)
+      if seen[abs] {
+        continue
+      }
+      seen[abs] = true
+      merged.files = append(merged.files, filename)
+      merged.contents = append(merged.contents, layer.contents[num])
+      merged.data = append(merged.data, layer.contents[num]...)
+    }
+  }
+  b, o := base.typed, overlay.typed
+
+  names := func(n int, name func(int) (string)) ([]string) {
+    list := make([]string, n)
+    for num := range list {
+      list[num] = name(num)
+    }
+    return list
+  }
+  note := func(section string, name string, over int, num int) {
+    merged.notes = append(merged.notes, fmt.Sprintf("%s %s at %s replaces the one at %s", section, name, overlay.where[section][over], base.where[section][num]))
+  }
+  // mergeSection adds the entries in merged order (add appends base or overlay entry num)
+  mergeSection := func(section string, baseNames []string, overNames []string, add func(mergeSource)) {
+    sources, replaced := mergeByName(baseNames, overNames)
+    for _, source := range sources {
+      add(source)
+      where := base.where[section]
+      if source.overlay {
+        where = overlay.where[section]
+      }
+      merged.where[section] = append(merged.where[section], where[source.num])
+    }
+    for over := range overNames {
+      if num, ok := replaced[over]; ok {
+        note(section, overNames[over], over, num)
+      }
+    }
+  }
+
+  // networks: the new overlay networks go first (so a landscape's more specific ranges win) and the ones
+  // that replace a base network take its place
+  baseNames := names(len(b.Networks), func(num int) (string) { return b.Networks[num].Name })
+  overNames := names(len(o.Networks), func(num int) (string) { return o.Networks[num].Name })
+  sources, replaced := mergeByName(baseNames, overNames)
+  newFirst := make([]mergeSource, 0, len(sources))
+  for _, source := range sources {
+    if _, ok := replaced[source.num]; source.overlay && !ok {
+      newFirst = append(newFirst, source)
+    }
+  }
+  for _, source := range sources {
+    if _, ok := replaced[source.num]; !source.overlay || ok {
+      newFirst = append(newFirst, source)
+    }
+  }
+  for _, source := range newFirst {
+    if source.overlay {
+      merged.typed.Networks = append(merged.typed.Networks, o.Networks[source.num])
+      merged.where["networks"] = append(merged.where["networks"], overlay.where["networks"][source.num])
+    } else {
+      merged.typed.Networks = append(merged.typed.Networks, b.Networks[source.num])
+      merged.where["networks"] = append(merged.where["networks"], base.where["networks"][source.num])
+    }
+  }
+  for over := range overNames {
+    if num, ok := replaced[over]; ok {
+      note("networks", overNames[over], over, num)
+    }
+  }
+
+  mergeSection("vhosts", names(len(b.VHosts), func(num int) (string) { return b.VHosts[num].Name }),
+    names(len(o.VHosts), func(num int) (string) { return o.VHosts[num].Name }), func(source mergeSource) {
+    if source.overlay {
+      merged.typed.VHosts = append(merged.typed.VHosts, o.VHosts[source.num])
+    } else {
+      merged.typed.VHosts = append(merged.typed.VHosts, b.VHosts[source.num])
+    }
+  })
+  mergeSection("sites", names(len(b.Sites), func(num int) (string) { return b.Sites[num].Name }),
+    names(len(o.Sites), func(num int) (string) { return o.Sites[num].Name }), func(source mergeSource) {
+    if source.overlay {
+      merged.typed.Sites = append(merged.typed.Sites, o.Sites[source.num])
+    } else {
+      merged.typed.Sites = append(merged.typed.Sites, b.Sites[source.num])
+    }
+  })
+  mergeSection("campus", names(len(b.Campus), func(num int) (string) { return b.Campus[num].Name }),
+    names(len(o.Campus), func(num int) (string) { return o.Campus[num].Name }), func(source mergeSource) {
+    if source.overlay {
+      merged.typed.Campus = append(merged.typed.Campus, o.Campus[source.num])
+    } else {
+      merged.typed.Campus = append(merged.typed.Campus, b.Campus[source.num])
+    }
+  })
+  mergeSection("rewrites", names(len(b.Rewrites), func(num int) (string) { return b.Rewrites[num].Match }),
+    names(len(o.Rewrites), func(num int) (string) { return o.Rewrites[num].Match }), func(source mergeSource) {
+    if source.overlay {
+      merged.typed.Rewrites = append(merged.typed.Rewrites, o.Rewrites[source.num])
+    } else {
+      merged.typed.Rewrites = append(merged.typed.Rewrites, b.Rewrites[source.num])
+    }
+  })
+  mergeSection("rules", names(len(b.Rules), func(num int) (string) { return b.Rules[num].Name }),
+    names(len(o.Rules), func(num int) (string) { return o.Rules[num].Name }), func(source mergeSource) {
+    if source.overlay {
+      merged.typed.Rules = append(merged.typed.Rules, o.Rules[source.num])
+    } else {
+      merged.typed.Rules = append(merged.typed.Rules, b.Rules[source.num])
+    }
+  })
+
+  merged.typed.Normalize = append(merged.typed.Normalize, b.Normalize...)
+  for _, step := range o.Normalize {
+    found := false
+    for _, existing := range merged.typed.Normalize {
+      found = found || existing == step
+    }
+    if !found {
+      merged.typed.Normalize = append(merged.typed.Normalize, step)
+    }
+  }
+
+  return merged
+}
+
+// configFlatten prints the config with its includes merged in and the entries the overlays replaced on stderr
+func configFlatten (filename string, format string) (error) {
+  src, err := readConfigLayers(filename, nil)
+  if err != nil {
+    return err
+  }
+  for _, note := range src.notes {
+    fmt.Fprintf(os.Stderr, "%s\n", note)
+  }
+  return writeConfig(os.Stdout, format, src.typed)
+}
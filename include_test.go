@@ -0,0 +1,156 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+const testSharedConfig = `campus:
+  - name: main
+    nets: ["128.197.0.0/16"]
+networks:
+  - name: ignore:F5-1
+    net: 10.231.9.92/32
+    ignore: true
+  - name: 10net
+    net: 10.0.0.0/8
+    track: [hosts]
+sites:
+  - name: htbin
+    status: track
+  - name: admissions
+    status: track
+normalize: [lowercase]
+`
+
+func testIncludeFiles (t *testing.T, files map[string]string) (string) {
+  dir := t.TempDir()
+  for name, data := range files {
+    filename := filepath.Join(dir, name)
+    os.MkdirAll(filepath.Dir(filename), 0755)
+    err := os.WriteFile(filename, []byte(data), 0644)
+    if err != nil {
+      t.Errorf("error=%s", err)
+    }
+  }
+  return dir
+}
+
+func TestIncludeOverlay (t *testing.T) {
+  dir := testIncludeFiles(t, map[string]string {
+    "shared/campus.yaml": testSharedConfig,
+    "prod.json": `[
+  { "include": "shared/campus.yaml" },
+  { "name": "10net", "net": "10.0.0.0/8", "track": "hosts,uri" },
+  { "name": "vpn", "net": "10.241.0.0/16" },
+  { "site": "htbin", "status": "summarize" },
+  { "site": "news", "status": "track" }
+]`,
+  })
+
+  lc, err := loadConfig(filepath.Join(dir, "prod.json"))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  var networks []string
+  for _, item := range lc.typed.Networks {
+    networks = append(networks, item.Name)
+  }
+  if strings.Join(networks, " ") != "vpn ignore:F5-1 10net" || len(lc.typed.Networks[2].Track) != 2 {
+    t.Errorf("wrong networks %+v", lc.typed.Networks)
+  }
+  if len(lc.typed.Sites) != 3 || lc.typed.Sites[0].Status != "summarize" || lc.typed.Sites[2].Name != "news" {
+    t.Errorf("wrong sites %+v", lc.typed.Sites)
+  }
+  if len(lc.typed.Campus) != 1 || lc.typed.Campus[0].Name != "main" {
+    t.Errorf("the legacy overlay should keep the included campus %+v", lc.typed.Campus)
+  }
+
+  _, _, _, _, label := findNetwork(lc.config, "10.231.9.92")
+  if label != "ignore:F5-1" {
+    t.Errorf("the replaced 10net should stay after the F5: %s", label)
+  }
+  if _, onCampus := findCampus(lc.config, "10.1.2.3"); onCampus {
+    t.Errorf("10.1.2.3 is not in the main zone")
+  }
+
+  if where := configWhere(lc, "networks", 1); where != filepath.Join(dir, "shared/campus.yaml") + ":5" {
+    t.Errorf("wrong where %s", where)
+  }
+  if where := configWhere(lc, "sites", 0); where != filepath.Join(dir, "prod.json") + ":5" {
+    t.Errorf("wrong where %s", where)
+  }
+  if len(lc.files) != 2 || !strings.HasSuffix(lc.files[0], "campus.yaml") {
+    t.Errorf("wrong files %v", lc.files)
+  }
+}
+
+func TestMergeConfigNotes (t *testing.T) {
+  dir := testIncludeFiles(t, map[string]string {
+    "shared.yaml": testSharedConfig,
+    "test.yaml": "include: [shared.yaml]\nsites:\n  - name: admissions\n    status: ignore\nnormalize: [lowercase, slashes]\n",
+  })
+
+  _, src, err := readConfigSource(filepath.Join(dir, "test.yaml"))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  if len(src.notes) != 1 || !strings.Contains(src.notes[0], "sites admissions at " + filepath.Join(dir, "test.yaml") + ":3 replaces the one at") {
+    t.Errorf("wrong notes %v", src.notes)
+  }
+  if strings.Join(src.typed.Normalize, ",") != "lowercase,slashes" {
+    t.Errorf("wrong normalize %v", src.typed.Normalize)
+  }
+  if src.typed.Include != nil {
+    t.Errorf("the merged config should not include anything")
+  }
+}
+
+func TestIncludeErrors (t *testing.T) {
+  dir := testIncludeFiles(t, map[string]string {
+    "a.yaml": "include: [b.yaml]\n",
+    "b.yaml": "include: [a.yaml]\n",
+    "missing.yaml": "include: [nothere.yaml]\n",
+    "bad.toml": "include = [\"broken.yaml\"]\n",
+    "broken.yaml": "networks:\n  - name: x\n    net: 10.0.0.0/33\n",
+  })
+
+  for name, want := range map[string]string{ "a.yaml": "include loop", "missing.yaml": "no such file", "bad.toml": "invalid CIDR" } {
+    _, err := buildIPRanges(filepath.Join(dir, name))
+    if err == nil || !strings.Contains(err.Error(), want) {
+      t.Errorf("%s: expected %q got %v", name, want, err)
+    }
+  }
+}
+
+func TestIncludeTwice (t *testing.T) {
+  dir := testIncludeFiles(t, map[string]string {
+    "shared.yaml": testSharedConfig,
+    "a/a.yaml": "include: [../shared.yaml]\nsites:\n  - name: news\n    status: track\n",
+    "b/b.yaml": "include: [../shared.yaml]\nsites:\n  - name: events\n    status: track\n",
+    "top.yaml": "include: [a/a.yaml, b/b.yaml]\n",
+  })
+
+  lc, err := loadConfig(filepath.Join(dir, "top.yaml"))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  // shared.yaml is read from both includes but is only listed and hashed once
+  var files []string
+  var data []byte
+  for _, filename := range lc.files {
+    files = append(files, filepath.Base(filename))
+    file, _ := os.ReadFile(filename)
+    data = append(data, file...)
+  }
+  if strings.Join(files, " ") != "shared.yaml a.yaml b.yaml top.yaml" {
+    t.Errorf("wrong files %v", files)
+  }
+  if lc.config.hash != hashConfig(data) {
+    t.Errorf("the hash should cover each file once")
+  }
+}
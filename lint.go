@@ -0,0 +1,471 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// lintIssue is one problem config lint found - errors (and warnings with -strict) fail the lint
+type lintIssue struct {
+  line int
+  level string
+  message string
+}
+
+// configPositions is the line each entry of a section starts on (0 when we cannot tell)
+type configPositions map[string][]int
+
+// jsonArrayLines finds the line each object of a json array starts on
+func jsonArrayLines (file []byte) ([]int) {
+  var lines []int
+  line := 1
+  depth := 0
+  inString := false
+  for i := 0; i < len(file); i++ {
+    c := file[i]
+    switch {
+    case c == '\n':
+      line++
+    case inString:
+      if c == '\\' {
+        i++
+      } else if c == '"' {
+        inString = false
+      }
+    case c == '"':
+      inString = true
+    case c == '[' || c == '{':
+      if depth == 1 && c == '{' {
+        lines = append(lines, line)
+      }
+      depth++
+    case c == ']' || c == '}':
+      depth--
+    }
+  }
+  return lines
+}
+
+// findConfigPositions works out where the entries of each section are in the file
+func findConfigPositions (format string, file []byte) (configPositions) {
+  positions := make(configPositions)
+
+  switch format {
+  case "legacy":
+    var data []map[string]string
+    if json.Unmarshal(file, &data) != nil {
+      return positions
+    }
+    lines := jsonArrayLines(file)
+    sections := map[string]string{ "virtual": "vhosts", "site": "sites", "rewrite": "rewrites", "network": "networks", "normalize": "normalize", "rule": "rules" }
+    for num, item := range data {
+      section := sections[legacyKind(item)]
+      if num < len(lines) {
+        positions[section] = append(positions[section], lines[num])
+      }
+    }
+    positions["entries"] = lines
+  case "toml":
+    for _, line := range configLines(string(file)) {
+      if strings.HasPrefix(line.text, "[[") && strings.HasSuffix(line.text, "]]") {
+        section := strings.TrimSpace(line.text[2:len(line.text)-2])
+        positions[section] = append(positions[section], line.number)
+      }
+    }
+  case "yaml":
+    section := ""
+    itemIndent := -1
+    for _, line := range configLines(string(file)) {
+      if line.indent == 0 && !isSequenceItem(line.text) {
+        section, _, _ = yamlKey(line.text)
+        itemIndent = -1
+        continue
+      }
+      if section == "" || !isSequenceItem(line.text) {
+        continue
+      }
+      if itemIndent < 0 {
+        itemIndent = line.indent
+      }
+      if line.indent == itemIndent {
+        positions[section] = append(positions[section], line.number)
+      }
+    }
+  }
+  return positions
+}
+
+// wherePositions are the lines of the entries of a merged config that are in filename (0 for the included ones)
+func wherePositions (filename string, where map[string][]string) (configPositions) {
+  positions := make(configPositions)
+  for section, locations := range where {
+    for _, location := range locations {
+      line := 0
+      if strings.HasPrefix(location, filename + ":") {
+        line, _ = strconv.Atoi(location[len(filename)+1:])
+      }
+      positions[section] = append(positions[section], line)
+    }
+  }
+  return positions
+}
+
+// configPosition is the line of entry num of a section
+func configPosition (p configPositions, section string, num int) (int) {
+  if num < len(p[section]) {
+    return p[section][num]
+  }
+  return 0
+}
+
+// editDistance is the levenshtein distance (for suggesting what a misspelled key should be)
+func editDistance (a string, b string) (int) {
+  prev := make([]int, len(b)+1)
+  for j := range prev {
+    prev[j] = j
+  }
+  for i := 1; i <= len(a); i++ {
+    cur := make([]int, len(b)+1)
+    cur[0] = i
+    for j := 1; j <= len(b); j++ {
+      cost := 1
+      if a[i-1] == b[j-1] {
+        cost = 0
+      }
+      cur[j] = cur[j-1] + 1
+      if prev[j] + 1 < cur[j] {
+        cur[j] = prev[j] + 1
+      }
+      if prev[j-1] + cost < cur[j] {
+        cur[j] = prev[j-1] + cost
+      }
+    }
+    prev = cur
+  }
+  return prev[len(b)]
+}
+
+func didYouMean (key string, known []string) (string) {
+  for _, k := range known {
+    if editDistance(key, k) <= 2 {
+      return fmt.Sprintf(" (did you mean %s?)", k)
+    }
+  }
+  return ""
+}
+
+// lintTrack checks the words of an ipnets.json track value (which is only searched for hosts and uri)
+func lintTrack (track string) ([]lintIssue) {
+  var issues []lintIssue
+  words := strings.FieldsFunc(track, func(c rune) (bool) { return c < 'a' || c > 'z' })
+  for _, word := range words {
+    switch {
+    case word == "hosts" || word == "uri":
+    case strings.Contains(word, "hosts") || strings.Contains(word, "uri"):
+      issues = append(issues, lintIssue{ 0, "warning", fmt.Sprintf("track %q is read as %s", word, strings.Join(trackWords(word), " and ")) })
+    default:
+      issues = append(issues, lintIssue{ 0, "error", fmt.Sprintf("track %q tracks nothing%s", word, didYouMean(word, []string{ "hosts", "uri" })) })
+    }
+  }
+  return issues
+}
+
+func trackWords (track string) ([]string) {
+  var words []string
+  if strings.Contains(track, "hosts") {
+    words = append(words, "hosts")
+  }
+  if strings.Contains(track, "uri") {
+    words = append(words, "uri")
+  }
+  return words
+}
+
+// lintLegacy checks the things the ipnets.json loader lets through without a word
+func lintLegacy (data []map[string]string, lines []int) ([]lintIssue) {
+  var issues []lintIssue
+  add := func(num int, level string, format string, args ...interface{}) {
+    line := 0
+    if num < len(lines) {
+      line = lines[num]
+    }
+    issues = append(issues, lintIssue{ line, level, fmt.Sprintf(format, args...) })
+  }
+
+  for num, item := range data {
+    kind := legacyKind(item)
+    for _, key := range unknownKeys(legacyKeys[kind], stringMapToTree(item)) {
+      add(num, "error", "unknown key %q is ignored%s", key, didYouMean(key, legacyKeys[kind]))
+    }
+
+    switch kind {
+    case "virtual", "site":
+      status, ok := item["status"]
+      if !ok {
+        add(num, "info", "%s %s has no status so it is tracked", kind, item[kind])
+      } else if legacyStatus(status) != status {
+        add(num, "error", "status %q of %s %s is treated as track%s", status, kind, item[kind], didYouMean(status, []string{ "ignore", "summarize", "track" }))
+      }
+    case "network":
+      if _, ok := item["net"]; !ok {
+        add(num, "error", "network %q has no net", item["name"])
+      }
+      if ignore, ok := item["ignore"]; ok {
+        switch strings.ToLower(ignore) {
+        case "", "no", "false", "0", "off":
+          add(num, "warning", "ignore %q still ignores the network (it is the key being there that counts)", ignore)
+        }
+      }
+      for _, issue := range lintTrack(item["track"]) {
+        add(num, issue.level, "%s", issue.message)
+      }
+    }
+  }
+  return issues
+}
+
+// lintTyped checks the ranges and statuses (for either format once it is in the typed form)
+func lintTyped (typed configFile, positions configPositions) ([]lintIssue) {
+  var issues []lintIssue
+  add := func(section string, num int, level string, format string, args ...interface{}) {
+    issues = append(issues, lintIssue{ configPosition(positions, section, num), level, fmt.Sprintf(format, args...) })
+  }
+  describe := func(section string, num int, name string) (string) {
+    if line := configPosition(positions, section, num); line > 0 {
+      return fmt.Sprintf("%s (line %d)", name, line)
+    }
+    return fmt.Sprintf("%s (%s[%d])", name, section, num)
+  }
+
+  // the first network that contains the address wins so later ranges inside earlier ones never match
+  nets := make([]*net.IPNet, len(typed.Networks))
+  for num, item := range typed.Networks {
+    _, ipnet, err := net.ParseCIDR(item.Net)
+    if err != nil {
+      if item.Net != "" {
+        add("networks", num, "error", "%s", err)
+      }
+      continue
+    }
+    nets[num] = ipnet
+    if item.Name == "" {
+      add("networks", num, "warning", "network %s has no name", item.Net)
+    }
+    if err := checkTags(item.Tags); err != nil {
+      add("networks", num, "error", "%s", err)
+    }
+    if item.Ignore && len(item.Track) > 0 {
+      add("networks", num, "warning", "network %s is ignored so track %s does nothing", item.Name, strings.Join(item.Track, ","))
+    }
+
+    for earlier := 0; earlier < num; earlier++ {
+      if nets[earlier] == nil || !nets[earlier].Contains(ipnet.IP) {
+        continue
+      }
+      ones, _ := ipnet.Mask.Size()
+      earlierOnes, _ := nets[earlier].Mask.Size()
+      if ones < earlierOnes {
+        continue
+      }
+      if ones == earlierOnes {
+        add("networks", num, "error", "%s %s is unreachable: the same range as %s", item.Name, item.Net, describe("networks", earlier, typed.Networks[earlier].Name))
+      } else {
+        add("networks", num, "error", "%s %s is shadowed by %s %s which comes first", item.Name, item.Net, describe("networks", earlier, typed.Networks[earlier].Name), typed.Networks[earlier].Net)
+      }
+      break
+    }
+  }
+  for num, ipnet := range nets {
+    for later := num + 1; ipnet != nil && later < len(nets); later++ {
+      if nets[later] != nil && nets[later].Contains(ipnet.IP) && !ipnet.Contains(nets[later].IP) {
+        add("networks", num, "info", "%s %s overlaps the later %s %s and wins", typed.Networks[num].Name, typed.Networks[num].Net, describe("networks", later, typed.Networks[later].Name), typed.Networks[later].Net)
+        break
+      }
+    }
+  }
+
+  for _, section := range []struct { name string; items []statusConfig; defaultStatus string } {
+    { "vhosts", typed.VHosts, "track" },
+    { "sites", typed.Sites, "ignore" },
+  } {
+    seen := make(map[string]int)
+    for num, item := range section.items {
+      if checkStatus(item.Status) != nil {
+        add(section.name, num, "error", "%s", checkStatus(item.Status))
+      }
+      if err := checkTags(item.Tags); err != nil {
+        add(section.name, num, "error", "%s", err)
+      }
+      status := legacyStatus(item.Status)
+      if status == section.defaultStatus {
+        add(section.name, num, "info", "%s is %s which is already the default", item.Name, status)
+      }
+      if earlier, ok := seen[item.Name]; ok {
+        level := "warning"
+        if legacyStatus(section.items[earlier].Status) != status {
+          level = "error"
+        }
+        add(section.name, num, level, "%s is listed again (%s) and this %s wins", describe(section.name, earlier, item.Name), legacyStatus(section.items[earlier].Status), status)
+      }
+      seen[item.Name] = num
+    }
+  }
+
+  var zones []campusNet
+  for num, zone := range typed.Campus {
+    for _, cidr := range zone.Nets {
+      _, ipnet, err := net.ParseCIDR(cidr)
+      if err != nil {
+        add("campus", num, "error", "%s", err)
+        continue
+      }
+      for _, other := range zones {
+        if other.net.Contains(ipnet.IP) || ipnet.Contains(other.net.IP) {
+          add("campus", num, "warning", "%s in zone %s overlaps %s in zone %s", cidr, zone.Name, other.net, other.zone)
+        }
+      }
+      zones = append(zones, campusNet{ zone.Name, ipnet })
+    }
+  }
+
+  for num, item := range typed.Rules {
+    if _, err := newEntryRule(item.Name, item.When, item.Action, item.Value); err != nil {
+      add("rules", num, "error", "%s", err)
+    }
+    if item.Name == "" {
+      add("rules", num, "warning", "rule %s has no name", strings.Join(item.When, " && "))
+    }
+  }
+
+  return issues
+}
+
+// lintConfig reads a config file and returns everything that looks wrong with it
+func lintConfig (filename string) ([]lintIssue, error) {
+  file, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return nil, err
+  }
+
+  format := configFormat(filename, file)
+  positions := findConfigPositions(format, file)
+
+  var issues []lintIssue
+  var typed configFile
+  if format == "legacy" {
+    var data []map[string]string
+    err = json.Unmarshal(file, &data)
+    if err != nil {
+      return []lintIssue{ { 0, "error", err.Error() } }, nil
+    }
+    issues = lintLegacy(data, positions["entries"])
+    typed, _ = legacyToTyped(data)
+    // the campus ranges are the built in ones so there is nothing to check
+    typed.Campus = nil
+  } else {
+    // only this file's entries so the lines point into it (the includes are linted on their own)
+    typed, _, _, err = parseConfigFile(filename)
+    if err == nil && len(typed.Include) == 0 {
+      _, err = typedToConfig(typed)
+    }
+    if err != nil {
+      return []lintIssue{ { 0, "error", err.Error() } }, nil
+    }
+  }
+
+  // with includes the merged config is what gets checked (the order can differ from the file) and the
+  // entries it replaces in the includes are worth knowing about
+  if len(typed.Include) > 0 {
+    _, src, err := readConfigSource(filename)
+    if err != nil {
+      return append(issues, lintIssue{ 0, "error", err.Error() }), nil
+    }
+    for _, note := range src.notes {
+      issues = append(issues, lintIssue{ 0, "info", note })
+    }
+    typed, positions = src.typed, wherePositions(filename, src.where)
+  }
+
+  // in file order
+  issues = append(issues, lintTyped(typed, positions)...)
+  sort.SliceStable(issues, func(i, j int) (bool) { return issues[i].line < issues[j].line })
+  return issues, nil
+}
+
+// writeLint prints the issues (info only when verbose) and returns how many should fail the lint
+func writeLint (w io.Writer, filename string, issues []lintIssue, verbose bool, strict bool) (int) {
+  failed := 0
+  for _, issue := range issues {
+    if issue.level == "info" && !verbose {
+      continue
+    }
+    if issue.level == "error" || (strict && issue.level == "warning") {
+      failed++
+    }
+
+    location := filename
+    if issue.line > 0 {
+      location = fmt.Sprintf("%s:%d", filename, issue.line)
+    }
+    fmt.Fprintf(w, "%s: %s: %s\n", location, issue.level, issue.message)
+  }
+  return failed
+}
+
+// lintUnusedRules warns about the entries of the config that never matched in a json summary made with it
+// (the ones from an include are listed with the file they are in)
+func lintUnusedRules (filename string, summary string) ([]lintIssue, error) {
+  tracking, err := readTracked(summary)
+  if err != nil {
+    return nil, err
+  }
+  if len(tracking.Rules) == 0 {
+    return []lintIssue{ { 0, "info", summary + " has no rule hits (made before they were counted?)" } }, nil
+  }
+
+  var issues []lintIssue
+  for _, rule := range unusedRules(tracking.Rules) {
+    line := 0
+    where := ""
+    if num := strings.LastIndex(rule.Where, ":"); num >= 0 && rule.Where[:num] == filename {
+      line, _ = strconv.Atoi(rule.Where[num+1:])
+    } else if rule.Where != "" {
+      where = " at " + rule.Where
+    }
+    name := rule.Name
+    if rule.Match != "" {
+      name += " " + rule.Match
+    }
+    issues = append(issues, lintIssue{ line, "warning", fmt.Sprintf("%s %s%s never matched in %s", rule.Kind, name, where, summary) })
+  }
+  return issues, nil
+}
+
+// configLint is the config lint command - the error makes main exit non-zero
+func configLint (filename string, summary string, verbose bool, strict bool) (error) {
+  issues, err := lintConfig(filename)
+  if err != nil {
+    return err
+  }
+  if summary != "" {
+    unused, err := lintUnusedRules(filename, summary)
+    if err != nil {
+      return err
+    }
+    issues = append(issues, unused...)
+    sort.SliceStable(issues, func(i, j int) (bool) { return issues[i].line < issues[j].line })
+  }
+
+  failed := writeLint(os.Stdout, filename, issues, verbose, strict)
+  if failed > 0 {
+    return fmt.Errorf("%s: %d problems", filename, failed)
+  }
+  return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+const testLintLegacy = `[
+  { "name": "lb", "net": "10.231.9.92/32", "ignore": "no" },
+  { "name": "10net", "net": "10.0.0.0/8", "track": "hosts,uris" },
+  { "name": "inside", "net": "10.1.0.0/16", "track": "host" },
+  { "name": "lb-again", "net": "10.231.9.92/32" },
+  { "name": "typo", "net": "128.197.0.0/16", "trak": "hosts" },
+  { "virtual": "www.bu.edu", "status": "summarise" },
+  { "site": "htbin", "status": "track" },
+  { "site": "htbin", "status": "ignore" }
+]
+`
+
+func testLint (t *testing.T, name string, data string) (string) {
+  issues, err := lintConfig(testConfigFile(t, name, data))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  var buf bytes.Buffer
+  writeLint(&buf, "cfg", issues, true, false)
+  return buf.String()
+}
+
+func TestLintLegacy (t *testing.T) {
+  out := testLint(t, "ipnets.json", testLintLegacy)
+
+  for _, want := range []string {
+    `cfg:2: warning: ignore "no" still ignores the network (it is the key being there that counts)`,
+    `cfg:3: warning: track "uris" is read as uri`,
+    `cfg:4: error: track "host" tracks nothing (did you mean hosts?)`,
+    `cfg:4: error: inside 10.1.0.0/16 is shadowed by 10net (line 3) 10.0.0.0/8 which comes first`,
+    `cfg:5: error: lb-again 10.231.9.92/32 is unreachable: the same range as lb (line 2)`,
+    `cfg:6: error: unknown key "trak" is ignored (did you mean track?)`,
+    `cfg:7: error: status "summarise" of virtual www.bu.edu is treated as track (did you mean summarize?)`,
+    `cfg:9: error: htbin (line 8) is listed again (track) and this ignore wins`,
+    `cfg:2: info: lb 10.231.9.92/32 overlaps the later 10net (line 3) 10.0.0.0/8 and wins`,
+  } {
+    if !strings.Contains(out, want + "\n") {
+      t.Errorf("missing %q in:\n%s", want, out)
+    }
+  }
+}
+
+func TestLintTyped (t *testing.T) {
+  out := testLint(t, "ipnets.yaml", `
+campus:
+  - name: main
+    nets: [128.197.0.0/16, 128.197.5.0/24]
+networks:
+  - name: 10net
+    net: 10.0.0.0/8
+  - name: inside
+    net: 10.1.0.0/16
+    ignore: true
+    track: [uri]
+`)
+
+  for _, want := range []string {
+    "cfg:3: warning: 128.197.5.0/24 in zone main overlaps 128.197.0.0/16 in zone main",
+    "cfg:8: error: inside 10.1.0.0/16 is shadowed by 10net (line 6) 10.0.0.0/8 which comes first",
+    "cfg:8: warning: network inside is ignored so track uri does nothing",
+  } {
+    if !strings.Contains(out, want + "\n") {
+      t.Errorf("missing %q in:\n%s", want, out)
+    }
+  }
+
+  // strict loading errors are reported as they are
+  out = testLint(t, "ipnets.toml", "[[networks]]\nname = \"x\"\ntrak = \"hosts\"\n")
+  if !strings.Contains(out, `networks[0]: unknown key "trak"`) {
+    t.Errorf("missing load error:\n%s", out)
+  }
+}
+
+func TestWriteLint (t *testing.T) {
+  issues := []lintIssue{ { 1, "info", "a" }, { 2, "warning", "b" }, { 0, "error", "c" } }
+
+  var buf bytes.Buffer
+  if failed := writeLint(&buf, "cfg", issues, false, false); failed != 1 {
+    t.Errorf("%d failed instead of 1", failed)
+  }
+  if buf.String() != "cfg:2: warning: b\ncfg: error: c\n" {
+    t.Errorf("wrong output:\n%s", buf.String())
+  }
+  if failed := writeLint(&bytes.Buffer{}, "cfg", issues, false, true); failed != 2 {
+    t.Errorf("warnings do not fail with strict")
+  }
+}
+
+func TestConfigPositions (t *testing.T) {
+  positions := findConfigPositions("toml", []byte("a = 1\n\n[[networks]]\nname = \"x\"\n[[networks]]\n"))
+  if len(positions["networks"]) != 2 || positions["networks"][1] != 5 {
+    t.Errorf("wrong toml positions %+v", positions)
+  }
+}
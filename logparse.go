@@ -4,6 +4,7 @@ import (
   "net"
   "fmt"
   "bufio"
+  "io"
   "os"
   "strings"
   "regexp"
@@ -13,30 +14,80 @@ import (
   "io/ioutil"
   "sort"
   "strconv"
+  "flag"
 )
 
+// campusSplit is the request/byte breakdown we keep for the whole run, each vhost and each
+// network/site within a vhost (ignored is whatever is left over after on and off campus)
+type campusSplit struct {
+  Total int
+  TotalBytes int64
+  OnCampus int
+  OnCampusBytes int64
+  OffCampus int
+  OffCampusBytes int64
+}
+
 type trackedData struct {
+  campusSplit
   NumRequests int
   Hosts map[string]int
   Base_uri map[string]int
   TrackHosts bool
   TrackURI bool
+  // query string names/values (only for sites when query tracking is enabled)
+  Query *queryStats `json:",omitempty"`
+}
+
+type crossTabCell struct {
+  Requests int
+  Bytes int64
+}
+
+// upper bounds (seconds) of the latency buckets - the last bucket in Buckets is everything slower
+var latencyBounds = []float64{ 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10 }
+
+type latencyHistogram struct {
+  Count int
+  Sum float64
+  Buckets []int
 }
 
 type trackedInfo struct {
+  campusSplit
   Number int
   Networks map[string]trackedData
   Sites map[string]trackedData
+  // network label -> site -> counts (only filled in when crossTab is enabled)
+  CrossTab map[string]map[string]crossTabCell `json:",omitempty"`
+  // path tree of base_uri down to pathDepth segments (nil when pathDepth is 0)
+  Paths *pathNode `json:",omitempty"`
+  // hour (2017-09-01T00) -> split for the vhost
+  Timeline map[string]campusSplit `json:",omitempty"`
+  // elapsed time of the tracked requests (nil when the log has no elapsed times)
+  Latency *latencyHistogram `json:",omitempty"`
+  // tag from the tag rules (see ruleengine.go) -> split for the vhost
+  Tags map[string]campusSplit `json:",omitempty"`
 }
 
 type trackedOverall struct {
-  Total int
-  TotalBytes int64
-  OnCampus int
-  OnCampusBytes int64
-  OffCampus int
-  OffCampusBytes int64
+  // see summary.go (0 means an unversioned summary from before there was a version)
+  SchemaVersion int
+  Meta *summaryMeta `json:",omitempty"`
+  campusSplit
+  // hour (2017-09-01T00) -> split for the whole run
+  Timeline map[string]campusSplit `json:",omitempty"`
   Tracked map[string]trackedInfo
+  // tag -> split for the whole run (see tags.go)
+  Tags map[string]campusSplit `json:",omitempty"`
+  // how often each network, vhost and site entry of the config matched (see rules.go)
+  Rules []ruleHit `json:",omitempty"`
+  // "network:<ipranges index>", "vhost:<name>", "site:<name>" or "rule:<rules index>" -> index in Rules
+  ruleIndex map[string]int
+  // where the sample rules are up to (see ruleengine.go)
+  samples sampleCounts
+  // the last hour bucket worked out for the scan
+  hours hourCache
 }
 
 type network struct {
@@ -45,12 +96,34 @@ type network struct {
   trackHosts bool
   trackURI bool
   ignore bool
+  tags []string
+}
+
+// scanSettings are the parts of the config that come from the command line rather than the config file
+type scanSettings struct {
+  crossTab bool
+  pathDepth int
+  trackQuery bool
 }
 
 type logConfig struct {
+  scanSettings
   ipranges []network
   vhosts map[string]int
   sites map[string]int
+  // glob and regex vhost/site entries (tried after the exact names)
+  vhostPatterns []statusPattern
+  sitePatterns []statusPattern
+  // the tags of the vhost/site entries (by the name or pattern that decides the status)
+  vhostTags map[string][]string
+  siteTags map[string][]string
+  normalizer uriNormalizer
+  // on campus ranges from the config (onCampusIPs when there are none)
+  campus []campusNet
+  // the rules section in config order (see ruleengine.go)
+  rules []*entryRule
+  // sha256 of the file the config was loaded from
+  hash string
 }
 
 // use ipcalc http://jodies.de/ipcalc to test the ranges
@@ -98,6 +171,24 @@ func isOnCampus (ip string) (bool) {
   return false
 }
 
+// findCampus returns the campus zone the ip is in (the zones from the config or the built in ranges)
+func findCampus (config logConfig, ip string) (string, bool) {
+  if len(config.campus) == 0 {
+    if isOnCampus(ip) {
+      return "campus", true
+    }
+    return "", false
+  }
+
+  ipaddr := net.ParseIP(ip)
+  for _, item := range config.campus {
+    if item.net.Contains(ipaddr) {
+      return item.zone, true
+    }
+  }
+  return "", false
+}
+
 // simple routine to add commas to numbers (based on https://play.golang.org/p/fkg7FsquII)
 func addCommaToInt (num int) (string) {
   return addCommaToInt64(int64(num))
@@ -142,17 +233,52 @@ func initIPRanges (data []map[string]string) (logConfig, error) {
   ipranges := make([]network, len(data))
   vhosts := make(map[string]int)
   sites := make(map[string]int)
+  vhostTags := make(map[string][]string)
+  siteTags := make(map[string][]string)
+  var vhostPatterns, sitePatterns []statusPattern
+  var normalizer uriNormalizer
+  var rules []*entryRule
 
   for num, item := range data {
     virtual, vIsPresent := item["virtual"]
     site, sIsPresent := item["site"]
+    normalize, nIsPresent := item["normalize"]
+    rewrite, rIsPresent := item["rewrite"]
+    rule, ruleIsPresent := item["rule"]
     if vIsPresent {
-      // we need to add the virtual host to the list
-      vhosts[virtual] = statusToNumber(item["status"])
+      // we need to add the virtual host (or pattern) to the list
+      err := addStatusRule(vhosts, &vhostPatterns, virtual, statusToNumber(item["status"]))
+      if err != nil {
+        return logConfig{}, err
+      }
+      vhostTags[virtual] = splitTags(item["tags"])
 
     } else if sIsPresent {
       // record the site
-      sites[site] = statusToNumber(item["status"])
+      err := addStatusRule(sites, &sitePatterns, site, statusToNumber(item["status"]))
+      if err != nil {
+        return logConfig{}, err
+      }
+      siteTags[site] = splitTags(item["tags"])
+    } else if nIsPresent {
+      // steps to clean up base_uri before it is tracked
+      err := addNormalizeSteps(&normalizer, normalize)
+      if err != nil {
+        return logConfig{}, err
+      }
+    } else if rIsPresent {
+      // regex rewrite of base_uri (applied in config order after the normalize steps)
+      err := addRewrite(&normalizer, rewrite, item["replace"])
+      if err != nil {
+        return logConfig{}, err
+      }
+    } else if ruleIsPresent {
+      // a rule over any field of the entry (see ruleengine.go)
+      r, err := newEntryRule(rule, splitWhen(item["when"]), item["action"], item["value"])
+      if err != nil {
+        return logConfig{}, err
+      }
+      rules = append(rules, r)
     } else {
       // we presume it is a network entry
       trackHosts := false
@@ -175,53 +301,65 @@ func initIPRanges (data []map[string]string) (logConfig, error) {
         return logConfig{}, err
       }
 
-      ipranges[num] = network{ item["name"], ipnet, trackHosts, trackURI, ignore } 
+      ipranges[num] = network{ item["name"], ipnet, trackHosts, trackURI, ignore, splitTags(item["tags"]) }
     }
 
   }
 
   // now that we are done we need to build our structure
-  return logConfig{ ipranges, vhosts, sites }, nil
+  return logConfig{ ipranges: ipranges, vhosts: vhosts, sites: sites, vhostPatterns: vhostPatterns, sitePatterns: sitePatterns, vhostTags: vhostTags, siteTags: siteTags, normalizer: normalizer, rules: rules }, nil
 }
 
+// buildIPRanges loads the old ipnets.json array or a typed yaml/toml/json config
 func buildIPRanges (filename string) (logConfig, error) {
-  var data []map[string]string
-
-  file, err := ioutil.ReadFile(filename)
-  if err != nil {
-    return logConfig{}, err
-  }
-  err = json.Unmarshal(file, &data)
-  if err != nil {
-    return logConfig{}, err
-  }
-
-  return initIPRanges (data)
+  config, _, file, err := readConfigFile(filename)
+  config.hash = hashConfig(file)
+  return config, err
 }
 
 func findSite (config logConfig, site string) (bool, bool) {
+  ignore, track, _ := findSiteRule(config, site)
+  return ignore, track
+}
+
+// findSiteRule is findSite plus the entry that matched ("" for the default)
+func findSiteRule (config logConfig, site string) (bool, bool, string) {
 
-  status, isPresent := config.sites[site]
+  status, rule, isPresent := findStatusRule(config.sites, config.sitePatterns, site)
   if isPresent {
-    return numberToArray(status)
+    ignore, track := numberToArray(status)
+    return ignore, track, rule
   } 
 
   // default is to ignore most toplevels
-  return true, false
+  return true, false, ""
 }
 
 func findVirtual (config logConfig, vhost string) (bool, bool) {
+  ignore, track, _ := findVirtualRule(config, vhost)
+  return ignore, track
+}
+
+// findVirtualRule is findVirtual plus the entry that matched ("" for the default)
+func findVirtualRule (config logConfig, vhost string) (bool, bool, string) {
 
-  status, isPresent := config.vhosts[vhost]
+  status, rule, isPresent := findStatusRule(config.vhosts, config.vhostPatterns, vhost)
   if isPresent {
-    return numberToArray(status)
+    ignore, track := numberToArray(status)
+    return ignore, track, rule
   } 
 
   // default is to track all virtual hosts
-  return false, true
+  return false, true, ""
 }
 
 func findNetwork (config logConfig, ip string) (string, bool, bool, bool, string) {
+  address, trackHosts, trackURI, ignore, label, _ := findNetworkRule(config, ip)
+  return address, trackHosts, trackURI, ignore, label
+}
+
+// findNetworkRule is findNetwork plus the index of the ipranges entry that matched (-1 for none)
+func findNetworkRule (config logConfig, ip string) (string, bool, bool, bool, string, int) {
   var ipaddr net.IP
 
   // if the ip is actually a hostname then look it up (if in bu.edu)
@@ -237,26 +375,91 @@ func findNetwork (config logConfig, ip string) (string, bool, bool, bool, string
       ipaddr = ips[0]
     } else {
       //fmt.Printf("error looking up %s : %s\n", ip, err)
-      return "unknownDNS", true, false, false, "error"
+      return "unknownDNS", true, false, false, "error", -1
     }
   } else {
     // skip everything else
-    return ip, false, false, false, "outsideBUDNS" 
+    return ip, false, false, false, "outsideBUDNS", -1
   }
 
-  for _, item := range config.ipranges {
+  num := matchNetwork(config, ipaddr)
+  if num >= 0 {
+    item := config.ipranges[num]
+    return ipaddr.String(), item.trackHosts, item.trackURI, item.ignore, item.name, num
+  }
+
+  // otherwise return our default values
+  return ipaddr.String(), false, false, false, "default", -1
+}
+
+// matchNetwork returns the index of the first network containing the address (-1 when none do)
+func matchNetwork (config logConfig, ipaddr net.IP) (int) {
+  for num, item := range config.ipranges {
     //fmt.Printf("item=%+v\n", item)
     if item.net != nil && item.net.Contains(ipaddr) {
-      return ipaddr.String(), item.trackHosts, item.trackURI, item.ignore, item.name
+      return num
     }
   }
+  return -1
+}
 
-  // otherwise return our default values
-  return ipaddr.String(), false, false, false, "default"
+
+func addToSplit (split *campusSplit, ignore bool, onCampus bool, bytes int64) {
+  split.Total++
+  split.TotalBytes += bytes
+
+  if ignore {
+    return
+  }
+
+  if onCampus {
+    split.OnCampus++
+    split.OnCampusBytes += bytes
+  } else {
+    split.OffCampus++
+    split.OffCampusBytes += bytes
+  }
+}
+
+// hourCache remembers the last conversion of a scan since the log lines come in time order
+type hourCache struct {
+  prefix string
+  bucket string
 }
 
+// hourBucket converts the date and timezone fields ([01/Sep/2017:00:00:08 and -0400]) into a sortable
+// hour in UTC (2017-09-01T04) so logs written in different offsets (or either side of a DST change) line up
+func hourBucket (cache *hourCache, date string, timezone string) (string) {
+  if len(date) < 15 {
+    return ""
+  }
 
-func trackEntryItem (tracking map[string]trackedData, label string, ip string , base_uri string, trackHosts bool, trackURI bool ) {
+  prefix := date[1:15] + " " + timezone
+  if prefix == cache.prefix {
+    return cache.bucket
+  }
+
+  t, err := time.Parse("02/Jan/2006:15 -0700]", prefix)
+  if err != nil {
+    return ""
+  }
+
+  cache.prefix = prefix
+  cache.bucket = t.UTC().Format("2006-01-02T15")
+  return cache.bucket
+}
+
+func trackTimeline (timeline map[string]campusSplit, bucket string, ignore bool, onCampus bool, bytes int64) {
+  if bucket == "" {
+    return
+  }
+
+  split := timeline[bucket]
+  addToSplit(&split, ignore, onCampus, bytes)
+  timeline[bucket] = split
+}
+
+func trackEntryItem (tracking map[string]trackedData, label string, ip string , base_uri string, trackHosts bool, trackURI bool, onCampus bool, bytes int64) {
   element, isPresent := tracking[label]
   //fmt.Printf("trackEntryItem(label=%s isPresent=%b hosts=%b uri=%b tracking=%+v\n", label, isPresent, trackHosts, trackURI, element)
 
@@ -268,6 +471,7 @@ func trackEntryItem (tracking map[string]trackedData, label string, ip string ,
   }
 
   element.NumRequests++
+  addToSplit(&element.campusSplit, false, onCampus, bytes)
   element.Base_uri["_total"]++
   if trackHosts {
     element.Hosts[ip]++
@@ -276,81 +480,195 @@ func trackEntryItem (tracking map[string]trackedData, label string, ip string ,
     element.Base_uri[base_uri]++
   }
 
+  // element is a copy so store it back to keep the counters
+  tracking[label] = element
+
   //fmt.Printf("trackEntryItem end element=%+v", element)
 }
 
+func trackLatency (histogram *latencyHistogram, elapsed float64) {
+  histogram.Count++
+  histogram.Sum += elapsed
+
+  bucket := 0
+  for bucket < len(latencyBounds) && elapsed > latencyBounds[bucket] {
+    bucket++
+  }
+  histogram.Buckets[bucket]++
+}
+
+func trackCrossTab (crossTab map[string]map[string]crossTabCell, label string, site string, bytes int64) {
+  row, isPresent := crossTab[label]
+  if ! isPresent {
+    row = make(map[string]crossTabCell)
+    crossTab[label] = row
+  }
+
+  cell := row[site]
+  cell.Requests++
+  cell.Bytes += bytes
+  row[site] = cell
+}
+
+// entryDecision is what the config says to do with an entry - trackEntry and the export mode share it
+type entryDecision struct {
+  // the ip after any dns lookup and the network label it matched
+  IP string
+  Network string
+  // index of the ipranges entry that matched (-1 for none)
+  NetworkRule int
+  TrackHosts bool
+  TrackURI bool
+  Ignore bool
+  OnCampus bool
+  // the campus zone the ip is in
+  Zone string
+  VHost string
+  IgnoreVHost bool
+  TrackVHost bool
+  // the vhost/site entry of the config that decided the status ("" when it is the default)
+  VHostRule string
+  Site string
+  IgnoreSite bool
+  TrackSite bool
+  SiteRule string
+  // indexes of the rules that matched, the tags of the entries and rules that matched and whether a sample
+  // rule left the entry out
+  Rules []int
+  Tags []string
+  Drop bool
+}
+
+func classifyEntry (config logConfig, entry map[string]string, samples sampleCounts) (entryDecision) {
+  var d entryDecision
+
+  d.IP, d.TrackHosts, d.TrackURI, d.Ignore, d.Network, d.NetworkRule = findNetworkRule(config, entry["ip"])
+
+  // determine if we are on campus or off (ignored entries are only added to the totals)
+  if ! d.Ignore {
+    d.Zone, d.OnCampus = findCampus(config, entry["ip"])
+  }
+
+  virtual, virtualExists := entry["virtual"]
+  if ! virtualExists {
+    virtual = "_default"
+  }
+  d.VHost = virtual
+  d.IgnoreVHost, d.TrackVHost, d.VHostRule = findVirtualRule(config, virtual)
+
+  toplevel, tExists := entry["toplevel"]
+  if ! tExists {
+    toplevel = "_default"
+  }
+  d.Site = toplevel
+  d.IgnoreSite, d.TrackSite, d.SiteRule = findSiteRule(config, toplevel)
+
+  applyRules(config, entry, &d, samples)
+  d.Tags = entryTags(config, d)
+  return d
+}
+
 func trackEntry (config logConfig, tracking *trackedOverall, entry map[string]string ) {
-  ip, trackHosts, trackURI, ignore, label := findNetwork(config, entry["ip"])
+  normalizeEntry(config.normalizer, entry)
+
+  if tracking.samples == nil {
+    tracking.samples = make(sampleCounts)
+  }
+  d := classifyEntry(config, entry, tracking.samples)
+  countRules(tracking, d)
+  if d.Drop {
+    // left out by a sample rule so it is not counted anywhere
+    if tracking.Meta != nil {
+      tracking.Meta.SampledOut++
+    }
+    return
+  }
+  ip, trackHosts, trackURI, ignore, label, onCampus := d.IP, d.TrackHosts, d.TrackURI, d.Ignore, d.Network, d.OnCampus
 
   bytes, err := convertBytes(entry["size"])
   if err != nil {
-    fmt.Printf("error parsing size: %s\n", err);
+    fmt.Fprintf(diag, "error parsing size: %s\n", err);
   }
 
-  // always increment the total counter
-  tracking.Total++
-  tracking.TotalBytes += bytes
+  // always increment the total counter and record the bytes and number of requests
+  addToSplit(&tracking.campusSplit, ignore, onCampus, bytes)
+  tracking.Tags = trackTags(tracking.Tags, d.Tags, ignore, onCampus, bytes)
+  bucket := hourBucket(&tracking.hours, entry["date"], entry["timezone"])
+  trackTimeline(tracking.Timeline, bucket, ignore, onCampus, bytes)
 
-  // if we are to ignore this entry then skip it
+  // ignored entries only count in the totals, they never add vhost or site rows
   if ignore {
     return
   }
 
-  // determine if we are on campus or off and record the bytes and number of requests
-  if isOnCampus(entry["ip"]) {
-    tracking.OnCampus++
-    tracking.OnCampusBytes += bytes
+  // now we check what the virtual host wants us to do
+  virtual, ignoreVHost, trackVHost := d.VHost, d.IgnoreVHost, d.TrackVHost
+
+  if ignoreVHost {
+    return
+  }
+
+  // first we determine which virtual host we have and get its data
+  element, isPresent := tracking.Tracked[virtual]
+  if isPresent {
   } else {
-    tracking.OffCampus++
-    tracking.OffCampusBytes += bytes
+    element = initTrackedInfo()
   }
 
-  // now we check what the virtual host wants us to do
-  virtual, virtualExists := entry["virtual"]
-  if ! virtualExists {
-    virtual = "_default"
+  addToSplit(&element.campusSplit, ignore, onCampus, bytes)
+  trackTimeline(element.Timeline, bucket, ignore, onCampus, bytes)
+  element.Tags = trackTags(element.Tags, d.Tags, ignore, onCampus, bytes)
+
+  // next the toplevel decides what happens for the sites
+  toplevel, ignoreSite, trackSite := d.Site, d.IgnoreSite, d.TrackSite
+
+  element.Number++
+
+  // some logs have - for the elapsed time so only count the ones we have
+  if entry["elapsed"] != "-" {
+    elapsed, err := ConvertElapsed(entry["elapsed"])
+    if err == nil {
+      if element.Latency == nil {
+        element.Latency = &latencyHistogram{ Buckets: make([]int, len(latencyBounds)+1) }
+      }
+      trackLatency(element.Latency, elapsed)
+    }
   }
-  ignoreVHost, trackVHost := findVirtual(config, virtual)
 
-  //fmt.Printf("virtual=%s ignore=%b track=%b\n", entry["virtual"], ignoreVHost, trackVHost)
+  if config.pathDepth > 0 {
+    if element.Paths == nil {
+      element.Paths = initPathNode()
+    }
+    trackPath(element.Paths, entry["base_uri"], config.pathDepth, bytes)
+  }
 
-  if ignoreVHost {
+  // if track is false then override both the trackHosts and trackURI variables
+  if trackVHost {
+    trackEntryItem(element.Networks, label, ip, entry["base_uri"], trackHosts, trackURI, onCampus, bytes)
   } else {
-    // first we determine which virtual host we have and get its data
-    element, isPresent := tracking.Tracked[virtual]
-    if isPresent {
-    } else {
-      element = initTrackedInfo()
-      tracking.Tracked[virtual] = element
-    }
+    trackEntryItem(element.Networks, label, ip, entry["base_uri"], false, false, onCampus, bytes)
+  }
 
-    // if track is false then override both the trackHosts and trackURI variables
-    if trackVHost {
-      trackEntryItem(element.Networks, label, ip, entry["base_uri"], trackHosts, trackURI)
+  if ignoreSite {
+  } else {
+    if trackSite {
+      trackEntryItem(element.Sites, toplevel, ip, entry["base_uri"], true, true, onCampus, bytes)
     } else {
-      trackEntryItem(element.Networks, label, ip, entry["base_uri"], false, false)
+      trackEntryItem(element.Sites, toplevel, ip, entry["base_uri"], false, false, onCampus, bytes)
     }
 
-    // next track the toplevel if it exists
-    toplevel, tExists := entry["toplevel"]
-    if ! tExists {
-      toplevel = "_default"
+    if config.trackQuery {
+      trackSiteQuery(element.Sites, toplevel, entry["base_uri"], entry["query"])
     }
-  
-    ignoreSite, trackSite := findSite(config, toplevel)
 
-    //fmt.Printf("site=%s ignore=%b track=%b config=%+v\n", toplevel,  ignoreSite, trackSite, config.sites)
-  
-    if ignoreSite {
-    } else {
-      if trackSite {
-        trackEntryItem(element.Sites, toplevel, ip, entry["base_uri"], true, true)
-      } else {
-        trackEntryItem(element.Sites, toplevel, ip, entry["base_uri"], false, false)
-      }
+    // record which network hit this site (ignored sites are left out so the matrix stays small)
+    if config.crossTab {
+      trackCrossTab(element.CrossTab, label, toplevel, bytes)
     }
   }
 
+  // element is a copy so store it back to keep the counters
+  tracking.Tracked[virtual] = element
 }
 
 type keyValue struct {
@@ -365,76 +683,64 @@ func sortedMap (data map[string]int) ([]keyValue) {
     tempData = append(tempData, keyValue{ k, v })
   }
 
-  sort.Slice(tempData, func(i, j int) bool { return tempData[i].Value > tempData[j].Value } )
+  sortKeyValues(tempData)
 
   return tempData
 }
 
-func dumpTrackedData (label string, tracking map[string]trackedData) {
-  var hostname string
-
-  for k, v := range tracking {
+func crossTabKeys (data map[string]map[string]crossTabCell) ([]string, []string) {
+  var rows []string
+  columns := make(map[string]bool)
 
-    fmt.Printf("\n=======================================================================\n")
-    fmt.Printf("*** %s:%s (%s requests; %d unique hosts, %d base_uri)\n", 
-      label, k, addCommaToInt(v.Base_uri["_total"]), len(v.Hosts), len(v.Base_uri)-1 )
-
-    if v.TrackHosts {
-      fmt.Printf("\n * %s IPs\n", k)
-      tempData := sortedMap(v.Hosts)
-      for _, item := range tempData {
-        iplist, err := net.LookupAddr(item.Key)
-        if err != nil {
-          hostname = fmt.Sprintf("DNS-error:%s", err)
-        } else { 
-          hostname = iplist[0]
-        }
-        fmt.Printf("    %s: %s (%s:%s - hostname=%s)\n", addCommaToInt(item.Value), item.Key, label, k, hostname)
-      }
+  for row, cells := range data {
+    rows = append(rows, row)
+    for column := range cells {
+      columns[column] = true
     }
+  }
 
-    if v.TrackURI {
-      fmt.Printf("\n * %s base_uri requests\n", k)
-      tempData := sortedMap(v.Base_uri)
-      for _, item := range tempData {
-        if item.Key != "_total" {
-          fmt.Printf("    %s: %s (%s:%s)\n", addCommaToInt(item.Value), item.Key, label, k)
-        }
-      }
-    }
+  var cols []string
+  for column := range columns {
+    cols = append(cols, column)
   }
 
+  sort.Strings(rows)
+  sort.Strings(cols)
+  return rows, cols
 }
 
-func dumpTracked (tracking trackedOverall) {
-  total_requests := float64(tracking.Total)
-  total_bytes := float64(tracking.TotalBytes)
-  ignored_requests := tracking.Total - tracking.OnCampus - tracking.OffCampus
-  ignored_bytes := tracking.TotalBytes - tracking.OnCampusBytes - tracking.OffCampusBytes
-
-  fmt.Printf("### Total requests= %s kbytes=%.2f \n", addCommaToInt(tracking.Total), total_bytes/1024)
-  fmt.Printf("### On Campus: requests= %s (%.2f %%) kbytes= %s (%.2f %%)\n", 
-    addCommaToInt(tracking.OnCampus), 100*float64(tracking.OnCampus)/total_requests,
-    addCommaToInt64(tracking.OnCampusBytes/1024), 100*float64(tracking.OnCampusBytes)/total_bytes)
-  fmt.Printf("### Off Campus: requests= %s (%.2f %%) kbytes= %s (%.2f %%)\n", 
-    addCommaToInt(tracking.OffCampus), 100*float64(tracking.OffCampus)/total_requests,
-    addCommaToInt64(tracking.OffCampusBytes/1024), 100*float64(tracking.OffCampusBytes)/total_bytes)
-  fmt.Printf("### Ignored: requests= %s (%.2f %%) kbytes= %s (%.2f %%)\n", 
-    addCommaToInt(ignored_requests), 100*float64(ignored_requests)/total_requests,
-    addCommaToInt64(ignored_bytes/1024), 100*float64(ignored_bytes)/total_bytes)
-
-  for k, v := range tracking.Tracked {
-    dumpTrackedData("network-"+k, v.Networks)
-    dumpTrackedData("sites-"+k, v.Sites)
+// percentOf avoids printing NaN for vhosts/sites that only ever saw ignored requests
+func percentOf (value float64, total float64) (float64) {
+  if total == 0 {
+    return 0
   }
+  return 100*value/total
 }
 
-func jsonTracked (tracking trackedOverall) {
+func jsonTracked (w io.Writer, tracking trackedOverall) (error) {
   b, err := json.Marshal(tracking)
   if err != nil {
-    fmt.Println("error:", err)
+    return err
   }
-  os.Stderr.Write(b)
+  _, err = w.Write(b)
+  return err
+}
+
+// readTracked loads a summary written by jsonTracked (upgrading older versions)
+func readTracked (filename string) (trackedOverall, error) {
+  tracking := initTrackedOverall()
+
+  file, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return tracking, err
+  }
+  err = json.Unmarshal(file, &tracking)
+  if err != nil {
+    return tracking, err
+  }
+
+  err = upgradeTracked(&tracking)
+  return tracking, err
 }
 
 var whitespace = regexp.MustCompile(`\s+`)
@@ -446,6 +752,19 @@ var quotes = regexp.MustCompile(`".*?[^\\]?"`)
 // get the top-level and second level names
 var parseLevels = regexp.MustCompile(`^/+([^/]+)?(/+)?([^/]+)?`)
 
+// setLevels (re)calculates the toplevel and secondLevel from the base_uri of the entry
+func setLevels (entry map[string]string) {
+  topLevel := parseLevels.FindStringSubmatch(entry["base_uri"])
+  if len(topLevel) < 4 {
+    // no match 
+    topLevel = []string{ "", "-error-", "", "" }
+  }
+  //fmt.Printf("topLevel(%d)=%+v\n", len(topLevel), topLevel)
+
+  entry["toplevel"] = topLevel[1]
+  entry["secondLevel"] = topLevel[3]
+}
+
 func SpaceFreeze (input string) (string) {
   //fmt.Printf("SpaceFreeze: %s\n", input)
   output := whitespace.ReplaceAllLiteralString(input, "++++")
@@ -501,6 +820,7 @@ func ConvertElapsed (elapsed_s string) (float64, error) {
 
 func ParseAccess (lineno int, line string) (map[string]string) {
   var base_uri string
+  var query string
   var protocol string
   var uri string
   var method string
@@ -516,7 +836,7 @@ func ParseAccess (lineno int, line string) (map[string]string) {
   elements := whitespace.Split(quoted, -1)
 
   if len(elements) < 17 {
-    fmt.Printf("Error parsing: %s\n", quoted)
+    fmt.Fprintf(diag, "Error parsing: %s\n", quoted)
     return nil
   }
 
@@ -547,41 +867,32 @@ func ParseAccess (lineno int, line string) (map[string]string) {
     method = request_elements[0]
   } else{
     method = "(unknown)"
-    fmt.Printf("request_line error near method: (%s)\n", request_line)
-    fmt.Printf("  quoted=(%s)\n", quoted)
+    fmt.Fprintf(diag, "request_line error near method: (%s)\n", request_line)
+    fmt.Fprintf(diag, "  quoted=(%s)\n", quoted)
     for index := 0; index < len(elements) ; index++ {
-      fmt.Printf("       element[%d]=(%s)\n", index, elements[index])
+      fmt.Fprintf(diag, "       element[%d]=(%s)\n", index, elements[index])
     }
   }
 
   if len(request_elements) > 1 {
     uri = request_elements[1]
   } else {
-    fmt.Printf("request_line error near uri: (%s)\n", request_line)
-    fmt.Printf("  quoted=(%s)\n", quoted)
+    fmt.Fprintf(diag, "request_line error near uri: (%s)\n", request_line)
+    fmt.Fprintf(diag, "  quoted=(%s)\n", quoted)
     for index := 0; index < len(elements) ; index++ {
-      fmt.Printf("       element[%d]=(%s)\n", index, elements[index])
+      fmt.Fprintf(diag, "       element[%d]=(%s)\n", index, elements[index])
     }
     uri = "(unknown)"
   }
 
   if strings.Contains(uri, "?") {
-    base_uri = (strings.SplitN(uri, "?", 2))[0]
+    uri_elements := strings.SplitN(uri, "?", 2)
+    base_uri = uri_elements[0]
+    query = uri_elements[1]
   } else {
     base_uri = request_elements[1]
   }
 
-  // now we determine the top level and the second-level
-  topLevel := parseLevels.FindStringSubmatch(base_uri)
-  if len(topLevel) < 4 {
-    // no match 
-    topLevel = []string{ "", "-error-", "", "" }
-  }
-  //fmt.Printf("topLevel(%d)=%+v\n", len(topLevel), topLevel)
-  /* for k, v := range topLevel {
-    fmt.Printf("%d: %s\n", k, v)
-  } */
-  
   if len(request_elements) > 2 {
     elen := len(request_elements[2])
 
@@ -602,8 +913,7 @@ func ParseAccess (lineno int, line string) (map[string]string) {
     "method" : method,
     "uri" : uri,
     "base_uri" : base_uri,
-    "toplevel": topLevel[1],
-    "secondLevel": topLevel[3],
+    "query" : query,
     "protocol" : protocol,
     "ret" : elements[6],
     "size" : elements[7],
@@ -619,6 +929,9 @@ func ParseAccess (lineno int, line string) (map[string]string) {
     //"https" : elements[17],
     //"virtual" : elements[18],
   }
+  // now we determine the top level and the second-level
+  setLevels(entry)
+
   //fmt.Printf("done: entry=%+v\n", entry)
   //fmt.Printf("ip=%s\n", entry["ip"])
 
@@ -648,54 +961,359 @@ func ParseAccess (lineno int, line string) (map[string]string) {
 func initTrackedData (trackHosts, trackURI bool) (trackedData) {
   host := make(map[string]int)
   base_uri := make(map[string]int)
-  return trackedData{ 0, host, base_uri, trackHosts, trackURI }
+  return trackedData{ campusSplit{}, 0, host, base_uri, trackHosts, trackURI, nil }
 }
 
 func initTrackedInfo () (trackedInfo) {
   networks := make(map[string]trackedData)
   sites := make(map[string]trackedData)
-  return trackedInfo{ 0, networks, sites }
+  crossTab := make(map[string]map[string]crossTabCell)
+  timeline := make(map[string]campusSplit)
+  return trackedInfo{ campusSplit{}, 0, networks, sites, crossTab, nil, timeline, nil, nil }
 }
 
 func initTrackedOverall () (trackedOverall) {
   vhosts := make(map[string]trackedInfo)
-  return trackedOverall{ Tracked: vhosts }
+  timeline := make(map[string]campusSplit)
+  return trackedOverall{ Timeline: timeline, Tracked: vhosts }
 }
 
-func main() {
-  ipranges, err := buildIPRanges("ipnets.json")
-  if err != nil {
-    log.Fatal(err)
+var crossTabFlag = flag.Bool("crosstab", false, "track a network by site matrix for each virtual host")
+var pathDepthFlag = flag.Int("pathdepth", 0, "track a tree of the paths down to this many segments for each virtual host (0 disables)")
+var pathMinFlag = flag.Int("pathmin", 0, "fold path tree nodes with fewer requests than this into (other)")
+var queryFlag = flag.Bool("query", false, "track query string parameters and cache-busting for each site")
+var queryKeysFlag = flag.Int("querykeys", 1000, "most base_uri?query keys per site in the json summary and sqlite, the rest are only counted (0 keeps all)")
+var csvFlag destList
+var htmlFlag destList
+var reportFlag destList
+var jsonFlag destList
+var prometheusFlag destList
+var influxFlag destList
+var graphiteFlag destList
+var chargebackFlag destList
+var progressFlag = flag.String("progress", "", "where the processed=... lines go (- for stdout, defaults to stderr when -json is given)")
+
+func init() {
+  flag.Var(&reportFlag, "report", "write the text report here (file or - for stdout, can be repeated, default -)")
+  flag.Var(&jsonFlag, "json", "write the json summary here (file or - for stdout, can be repeated); without it the json goes to stderr")
+  flag.Var(&csvFlag, "csv", "write PREFIX-overall.csv, PREFIX-hosts.csv and PREFIX-base_uri.csv (- writes all three to stdout, can be repeated)")
+  flag.Var(&htmlFlag, "html", "write a self-contained html report here (file or - for stdout, can be repeated)")
+  flag.Var(&influxFlag, "influx", "write hourly and per network/site points in the influxdb line protocol here (file, - or tcp://host:port or udp://host:port, can be repeated)")
+  flag.Var(&graphiteFlag, "graphite", "write the same points as graphite plaintext here (file, - or tcp://host:port or udp://host:port, can be repeated)")
+  flag.Var(&prometheusFlag, "prometheus", "write the metrics in the prometheus text format here (file or - for stdout, can be repeated)")
+  flag.Var(&chargebackFlag, "chargeback", "write the chargeback report by department here (needs -departments, csv when it ends in .csv, can be repeated)")
+}
+var titleFlag = flag.String("title", "Web traffic report", "title of the html report")
+var templateFlag = flag.String("template", "", "render the text report with this text/template file instead of the default layout")
+var printTemplateFlag = flag.Bool("printtemplate", false, "print the default text report template and exit")
+var topFlag = flag.String("top", "", "only show the top N entries per report section (e.g. hosts=20,base_uri=50)")
+var minFlag = flag.String("min", "", "only show entries with at least N requests per report section (e.g. base_uri=5)")
+var sqliteFlag = flag.String("sqlite", "", "also store the aggregates in this sqlite database (the report command reads them back)")
+var sqlite3Flag = flag.String("sqlite3", "sqlite3", "the sqlite3 command line tool to use")
+var periodFlag = flag.String("period", "", "period the aggregates are stored under in sqlite (defaults to the month the logs start in)")
+var promLabelsFlag = flag.Int("promlabels", 50, "most networks/sites per vhost in the prometheus metrics, the rest are summed into other (0 keeps all)")
+var promTopFlag = flag.Int("promtop", 0, "also export the top N hosts and base_uri of each network/site to prometheus (0 leaves them out)")
+var graphitePrefixFlag = flag.String("graphiteprefix", "logparse", "prefix of the graphite metric paths")
+var formatFlag = flag.String("format", "jsonl", "format of the export command (jsonl, csv or bulk for the elasticsearch _bulk api)")
+var indexFlag = flag.String("index", "", "index of the bulk export, %Y %m %d are taken from the entry (default logparse-%Y.%m.%d)")
+var bulkURLFlag = flag.String("bulkurl", "", "post the bulk export to this url (e.g. http://localhost:9200/_bulk) instead of writing it to stdout")
+var bulkSizeFlag = flag.Int("bulksize", 1000, "documents per bulk post")
+var bulkRetriesFlag = flag.Int("bulkretries", 3, "times to retry a bulk post that failed with a connection error, 429 or 5xx")
+var columnsFlag = flag.String("columns", "", "comma separated columns of the export command (all for every column)")
+var toFlag = flag.String("to", "yaml", "format config convert and flatten write (yaml, toml or json)")
+var reloadFlag = flag.Bool("reload", false, "reload the config when it (or a file it includes) changes or on SIGHUP, for long running reads of stdin")
+var reloadIntervalFlag = flag.Duration("reloadinterval", 5 * time.Second, "how often -reload checks the config files (0 only reloads on SIGHUP)")
+var configFlag = flag.String("config", "", "config file to use (default the first of ipnets.json, ipnets.yaml, ipnets.yml and ipnets.toml that exists)")
+var unusedRulesFlag = flag.Bool("unusedrules", false, "end the text report with the config rules that never matched (config lint -fromjson checks them too)")
+var verboseFlag = flag.Bool("verbose", false, "config lint also lists the notes (overlapping ranges, statuses that are already the default)")
+var strictFlag = flag.Bool("strict", false, "config lint fails on warnings as well as errors")
+var departmentsFlag = flag.String("departments", "", "file mapping vhosts and sites to the departments -chargeback charges (yaml, toml or json)")
+var fromJSONFlag = flag.String("fromjson", "", "build the reports from this json summary instead of reading logs from stdin")
+
+// flagSettings are the scan settings given on the command line
+func flagSettings () (scanSettings) {
+  return scanSettings{ crossTab: *crossTabFlag, pathDepth: *pathDepthFlag, trackQuery: *queryFlag }
+}
+
+// withSettings is the loaded config with the command line settings (on the first load and every reload)
+func withSettings (lc loadedConfig, settings scanSettings) (logConfig) {
+  config := lc.config
+  config.scanSettings = settings
+  return config
+}
+
+// scanLog parses and tracks every line of input (the line numbers carry on across files in the meta)
+func scanLog (config logConfig, input io.Reader, tracking *trackedOverall) (error) {
+  return scanLogReloading(&config, input, tracking, nil)
+}
+
+// scanLogReloading is scanLog that swaps in the configs that come in on updates (see reload.go) between entries
+func scanLogReloading (config *logConfig, input io.Reader, tracking *trackedOverall, updates <-chan configUpdate) (error) {
+  // a zero trackedOverall works too (and still gets the line counts)
+  if tracking.Tracked == nil {
+    tracking.Tracked = make(map[string]trackedInfo)
   }
-  //tracking := make(map[string]trackedData)
-  number := 0
-  scanner := bufio.NewScanner(os.Stdin)
-  tracking := initTrackedOverall()
+  if tracking.Timeline == nil {
+    tracking.Timeline = make(map[string]campusSplit)
+  }
+  if tracking.Meta == nil {
+    tracking.Meta = initSummaryMeta()
+  }
+  meta := tracking.Meta
+  scanner := bufio.NewScanner(input)
 
   for scanner.Scan() {
+    select {
+    case update := <-updates:
+      applyConfigUpdate(config, tracking, update)
+    default:
+    }
+
+    number := meta.Lines
     line := scanner.Text()
     entry := ParseAccess(number, line)
     if entry != nil {
-      trackEntry(ipranges, &tracking, entry)
+      trackEntry(*config, tracking, entry)
     } else {
-      fmt.Printf("%d: parse line %s\n", number, line)
+      meta.ParseErrors++
+      fmt.Fprintf(diag, "%d: parse line %s\n", number, line)
     }
 
     if number % 500000 == 0 {
       t := time.Now()
-      fmt.Printf("processed=%d (%s)\n", number, t.Format("20060102150405"))
+      fmt.Fprintf(progress, "processed=%d (%s)\n", number, t.Format("20060102150405"))
     }
-    number++
+    meta.Lines++
   }
 
-  if err := scanner.Err(); err != nil {
-    fmt.Fprintln(os.Stderr, "error:", err)
-    os.Exit(1)
+  return scanner.Err()
+}
+
+func main() {
+  var tracking trackedOverall
+  var limits reportLimits
+  var err error
+
+  // "report" rebuilds the reports from the sqlite database instead of reading logs
+  args := os.Args[1:]
+  command := ""
+  if len(args) > 0 && (args[0] == "report" || args[0] == "export" || args[0] == "config" || args[0] == "explain") {
+    command = args[0]
+    args = args[1:]
+  }
+  // config has its own subcommands
+  subcommand := ""
+  if command == "config" && len(args) > 0 {
+    subcommand = args[0]
+    args = args[1:]
+  }
+  flag.CommandLine.Parse(args)
+
+  // with -json, export or another output on stdout (-csv -, -html - ...) the diagnostics go to stderr so they
+  // do not end up in it, otherwise keep the old stdout/stderr convention
+  if len(jsonFlag) > 0 || command == "export" ||
+    othersToStdout(csvFlag, htmlFlag, prometheusFlag, influxFlag, graphiteFlag, chargebackFlag) {
+    diag = os.Stderr
+    progress = os.Stderr
+  }
+  if *progressFlag != "" {
+    w, closer, err := openOutput(*progressFlag)
+    if err != nil {
+      log.Fatal(err)
+    }
+    defer closer()
+    progress = w
+  }
+  if len(reportFlag) == 0 {
+    reportFlag = destList{ "-" }
   }
 
-  dumpTracked(tracking)
+  if command == "config" {
+    err = configMain(subcommand, flag.Args())
+    if err != nil {
+      fmt.Fprintln(os.Stderr, "error:", err)
+      os.Exit(1)
+    }
+    return
+  }
 
-  // output the json form for future combining of stuff
-  jsonTracked(tracking)
-}
+  if command == "explain" {
+    err = explainMain(configFileName(), flag.Args())
+    if err != nil {
+      fmt.Fprintln(os.Stderr, "error:", err)
+      os.Exit(1)
+    }
+    return
+  }
 
+  if *printTemplateFlag {
+    os.Stdout.WriteString(defaultTextTemplate)
+    return
+  }
+
+  limits.top, err = parseReportLimits(*topFlag)
+  if err != nil {
+    log.Fatal(err)
+  }
+  limits.min, err = parseReportLimits(*minFlag)
+  if err != nil {
+    log.Fatal(err)
+  }
+  limits.unusedRules = *unusedRulesFlag
+
+  // read the departments up front so a bad file does not waste a run over the logs
+  var depts departmentMap
+  if len(chargebackFlag) > 0 {
+    if *departmentsFlag == "" {
+      log.Fatal("-chargeback needs -departments FILE")
+    }
+    depts, err = readDepartments(*departmentsFlag)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  if command == "report" {
+    if *sqliteFlag == "" {
+      log.Fatal("report needs -sqlite DB and -period")
+    }
+    tracking, err = sqliteRead(*sqlite3Flag, *sqliteFlag, *periodFlag)
+    if err != nil {
+      log.Fatal(err)
+    }
+  } else if *fromJSONFlag != "" {
+    // rebuild the reports from an earlier (or merged) json summary instead of reading logs
+    tracking, err = readTracked(*fromJSONFlag)
+    if err != nil {
+      log.Fatal(err)
+    }
+  } else {
+    configName := configFileName()
+    loaded, err := loadConfig(configName)
+    if err != nil {
+      log.Fatal(err)
+    }
+    ipranges := withSettings(loaded, flagSettings())
+
+    // the export mode writes each entry out instead of tracking them
+    if command == "export" {
+      err = exportMain(ipranges, flag.Args())
+      if err != nil {
+        fmt.Fprintln(os.Stderr, "error:", err)
+        os.Exit(1)
+      }
+      return
+    }
+
+    tracking = initTrackedOverall()
+    tracking.Meta = initSummaryMeta()
+    tracking.Meta.ConfigFile = configName
+    tracking.Meta.ConfigHash = ipranges.hash
+    if len(loaded.files) > 1 {
+      tracking.Meta.ConfigIncludes = loaded.files[:len(loaded.files)-1]
+    }
+    initRuleHits(&tracking, loaded)
+
+    var updates <-chan configUpdate
+    if *reloadFlag {
+      stop := make(chan struct{})
+      defer close(stop)
+      updates = watchConfig(loaded, *reloadIntervalFlag, reloadSignals(), stop)
+    }
+
+    // read the log files on the command line (or stdin when there are none)
+    inputs := flag.Args()
+    if len(inputs) == 0 {
+      inputs = []string{ "-" }
+    }
+    for _, filename := range inputs {
+      input, closer, err := openLog(filename)
+      if err == nil {
+        tracking.Meta.InputFiles = append(tracking.Meta.InputFiles, filename)
+        err = scanLogReloading(&ipranges, input, &tracking, updates)
+        closer()
+      }
+      if err != nil {
+        fmt.Fprintln(os.Stderr, "error:", err)
+        os.Exit(1)
+      }
+    }
+    finishSummary(&tracking)
+  }
+
+  // prune before either output so the text and the json agree
+  if *pathMinFlag > 0 {
+    for _, v := range tracking.Tracked {
+      prunePathTree(v.Paths, *pathMinFlag)
+    }
+  }
+
+  tmpl, name, err := loadReportTemplate(*templateFlag)
+  if err != nil {
+    log.Fatal(err)
+  }
+  err = writeOutputs(reportFlag, func(w io.Writer) (error) { return writeTextReport(w, tmpl, name, limits, tracking) })
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  // output the json form for future combining of stuff (the scan scripts expect it on stderr)
+  summary := limitTrackedQueries(tracking, *queryKeysFlag)
+  if len(jsonFlag) == 0 {
+    err = jsonTracked(os.Stderr, summary)
+  } else {
+    err = writeOutputs(jsonFlag, func(w io.Writer) (error) { return jsonTracked(w, summary) })
+  }
+  if err != nil {
+    log.Fatal(err)
+  }
+
+  for _, prefix := range csvFlag {
+    err = csvTracked(prefix, tracking)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  for _, dest := range htmlFlag {
+    err = htmlTracked(dest, *titleFlag, tracking)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  for _, dest := range chargebackFlag {
+    err = chargebackTracked(dest, depts, tracking)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  for _, dest := range prometheusFlag {
+    err = prometheusTracked(dest, promLimits{ labels: *promLabelsFlag, top: *promTopFlag }, tracking)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  for _, dest := range influxFlag {
+    err = writeMetrics(dest, func(w io.Writer) (error) { return writeInflux(w, tracking) })
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  for _, dest := range graphiteFlag {
+    err = writeMetrics(dest, func(w io.Writer) (error) { return writeGraphite(w, *graphitePrefixFlag, tracking) })
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+
+  if *sqliteFlag != "" && command != "report" {
+    err = sqliteWrite(*sqlite3Flag, *sqliteFlag, *periodFlag, summary)
+    if err != nil {
+      log.Fatal(err)
+    }
+  }
+}
@@ -553,3 +553,83 @@ func TestErrorBytes (t *testing.T) {
   testConvertBytes(t, "Z14500", 14500, true);
 }
 
+
+func TestCrossTab (t *testing.T) {
+  var lines = []string {
+    `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/wp-includes/js/wp-embed.min.js?ver=4.6.6 HTTP/1.1" 200 1403 0.007192 0.000000 0.000000 "http://www.bu.edu/met/programs/graduate/arts-administration/" "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+    `10.241.26.101 - - [01/Sep/2017:00:00:09 -0400] "GET /htbin/index.html HTTP/1.1" 200 597 0.007192 0.000000 0.000000 "-" "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+    `10.241.26.101 - - [01/Sep/2017:00:00:09 -0400] "GET /met/index.html HTTP/1.1" 200 597 0.007192 0.000000 0.000000 "-" "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  }
+
+  config, err := testIPRanges()
+  if err != nil {
+    t.Errorf("error=%+v", err)
+    return
+  }
+  config.crossTab = true
+
+  tracking := initTrackedOverall()
+  for number, line := range lines {
+    entry := ParseAccess(number, line)
+    trackEntry(config, &tracking, entry)
+  }
+
+  vHostEntry, isPresent := tracking.Tracked["_default"]
+  if ! isPresent {
+    t.Errorf("Did not have _default vhost")
+    return
+  }
+
+  cell := vHostEntry.CrossTab["10net"]["htbin"]
+  if cell.Requests != 2 || cell.Bytes != 2000 {
+    t.Errorf("10net x htbin should be 2 requests/2000 bytes but is %+v", cell)
+  }
+
+  // met is not a tracked site so it should not show up in the matrix
+  if _, mIsPresent := vHostEntry.CrossTab["10net"]["met"]; mIsPresent {
+    t.Errorf("ignored site met should not be in the crosstab: %+v", vHostEntry.CrossTab)
+  }
+}
+
+func TestCrossTabDisabled (t *testing.T) {
+  var lines = []string {
+    `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/wp-includes/js/wp-embed.min.js?ver=4.6.6 HTTP/1.1" 200 1403 0.007192 0.000000 0.000000 "http://www.bu.edu/met/programs/graduate/arts-administration/" "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_9_5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/60.0.3112.113 Safari/537.36" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  }
+
+  tracking, _ := testTrackStuff(t, lines, 1, 1403)
+
+  if len(tracking.Tracked["_default"].CrossTab) != 0 {
+    t.Errorf("crosstab should be empty when disabled: %+v", tracking.Tracked["_default"].CrossTab)
+  }
+}
+
+func TestVHostSplit (t *testing.T) {
+  var lines = []string {
+    `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 1000 10359:10360 0.000000 0.000000 "-" "-" 3104 + -ZFabgrnCRgAAAwgIzYAAABD 10.231.9.24 off:http wwwv.bu.edu testdomain2`,
+    `100.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 3000 10359:10360 0.000000 0.000000 "-" "-" 3104 + -ZFabgrnCRgAAAwgIzYAAABD 10.231.9.24 off:http wwwv.bu.edu testdomain2`,
+    `10.231.9.92 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 500 10359:10360 0.000000 0.000000 "-" "-" 3104 + -ZFabgrnCRgAAAwgIzYAAABD 10.231.9.24 off:http wwwv.bu.edu testdomain2`,
+    `100.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /met/index.html HTTP/1.1" 200 7000 10359:10360 0.000000 0.000000 "-" "-" 3104 + -ZFabgrnCRgAAAwgIzYAAABD 10.231.9.24 off:http wwwv.bu.edu testdomain3`,
+  }
+
+  tracking, _ := testTrackStuff(t, lines, 1, 1000)
+
+  // the ignored 10.231.9.92 request is only in the overall totals
+  expected := campusSplit{ 2, 4000, 1, 1000, 1, 3000 }
+  if tracking.Tracked["testdomain2"].campusSplit != expected {
+    t.Errorf("testdomain2 split should be %+v but is %+v", expected, tracking.Tracked["testdomain2"].campusSplit)
+  }
+  if tracking.Tracked["testdomain2"].Number != 2 {
+    t.Errorf("testdomain2 should have 2 tracked requests but has %d", tracking.Tracked["testdomain2"].Number)
+  }
+  if tracking.Tracked["testdomain2"].Sites["htbin"].campusSplit != expected {
+    t.Errorf("htbin split should be %+v but is %+v", expected, tracking.Tracked["testdomain2"].Sites["htbin"].campusSplit)
+  }
+
+  expected = campusSplit{ 1, 7000, 0, 0, 1, 7000 }
+  if tracking.Tracked["testdomain3"].campusSplit != expected {
+    t.Errorf("testdomain3 split should be %+v but is %+v", expected, tracking.Tracked["testdomain3"].campusSplit)
+  }
+  if tracking.Tracked["testdomain3"].Networks["default"].NumRequests != 1 {
+    t.Errorf("default network should have 1 request: %+v", tracking.Tracked["testdomain3"].Networks["default"])
+  }
+}
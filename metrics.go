@@ -0,0 +1,189 @@
+package main
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "net"
+  "regexp"
+  "sort"
+  "strings"
+  "time"
+)
+
+// metricField is one value of a point
+type metricField struct {
+  Name string
+  Value int64
+}
+
+// metricPoint is a measurement at a point in time - the influx and graphite writers both work from these
+type metricPoint struct {
+  Name string
+  // name/value pairs in the order they are written
+  Tags []string
+  Fields []metricField
+  Time time.Time
+}
+
+func splitFields (split campusSplit) ([]metricField) {
+  return []metricField {
+    { "requests", int64(split.Total) },
+    { "bytes", split.TotalBytes },
+    { "oncampus", int64(split.OnCampus) },
+    { "oncampus_bytes", split.OnCampusBytes },
+    { "offcampus", int64(split.OffCampus) },
+    { "offcampus_bytes", split.OffCampusBytes },
+  }
+}
+
+// bucketTime turns a timeline bucket (2017-09-01T00) back into a time - the hour is the one from the
+// log lines and is taken as UTC
+func bucketTime (bucket string) (time.Time, bool) {
+  t, err := time.Parse("2006-01-02T15", bucket)
+  return t, err == nil
+}
+
+func timelinePoints (name string, tags []string, timeline map[string]campusSplit) ([]metricPoint) {
+  var buckets []string
+  for bucket := range timeline {
+    buckets = append(buckets, bucket)
+  }
+  sort.Strings(buckets)
+
+  var points []metricPoint
+  for _, bucket := range buckets {
+    t, ok := bucketTime(bucket)
+    if !ok {
+      continue
+    }
+    points = append(points, metricPoint{ name, tags, splitFields(timeline[bucket]), t })
+  }
+  return points
+}
+
+func trackedDataPoints (name string, vhost string, label string, data map[string]trackedData, t time.Time) ([]metricPoint) {
+  var points []metricPoint
+  for _, k := range sortedTrackedKeys(data) {
+    points = append(points, metricPoint{ name, []string{ "vhost", vhost, label, k }, splitFields(data[k].campusSplit), t })
+  }
+  return points
+}
+
+// metricPoints builds the hourly points for the whole run and each vhost and one point per network and
+// site stamped with the start of the period (so a rerun over the same logs overwrites the same points)
+func metricPoints (tracking trackedOverall) ([]metricPoint) {
+  start, _ := timelinePeriod(tracking.Timeline)
+  periodTime, ok := bucketTime(start)
+  if !ok {
+    periodTime = time.Now().UTC().Truncate(time.Hour)
+  }
+
+  points := timelinePoints("logparse_hourly", []string{ "vhost", "_all" }, tracking.Timeline)
+  for _, vhost := range sortedVHosts(tracking) {
+    element := tracking.Tracked[vhost]
+    points = append(points, timelinePoints("logparse_hourly", []string{ "vhost", vhost }, element.Timeline)...)
+    points = append(points, metricPoint{ "logparse_vhost", []string{ "vhost", vhost }, splitFields(element.campusSplit), periodTime })
+    points = append(points, trackedDataPoints("logparse_network", vhost, "network", element.Networks, periodTime)...)
+    points = append(points, trackedDataPoints("logparse_site", vhost, "site", element.Sites, periodTime)...)
+  }
+  return points
+}
+
+var influxNameEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+var influxTagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// influxLine formats a point in the influxdb line protocol (integer fields, nanosecond timestamps)
+func influxLine (point metricPoint) (string) {
+  line := influxNameEscaper.Replace(point.Name)
+  for i := 0; i+1 < len(point.Tags); i += 2 {
+    if point.Tags[i+1] == "" {
+      // influx does not allow empty tag values
+      continue
+    }
+    line += "," + influxTagEscaper.Replace(point.Tags[i]) + "=" + influxTagEscaper.Replace(point.Tags[i+1])
+  }
+
+  var fields []string
+  for _, field := range point.Fields {
+    fields = append(fields, influxTagEscaper.Replace(field.Name) + "=" + fmt.Sprintf("%di", field.Value))
+  }
+  return fmt.Sprintf("%s %s %d\n", line, strings.Join(fields, ","), point.Time.UnixNano())
+}
+
+var graphiteUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// graphiteName makes a label safe to use as one component of a graphite path
+func graphiteName (name string) (string) {
+  name = graphiteUnsafe.ReplaceAllString(name, "_")
+  if name == "" {
+    return "_"
+  }
+  return name
+}
+
+// graphiteLines formats a point as graphite plaintext lines - prefix.name.tagvalue....field value timestamp
+func graphiteLines (prefix string, point metricPoint) (string) {
+  path := []string{ graphiteName(strings.TrimPrefix(point.Name, "logparse_")) }
+  if prefix != "" {
+    path = append([]string{ prefix }, path...)
+  }
+  for i := 0; i+1 < len(point.Tags); i += 2 {
+    path = append(path, graphiteName(point.Tags[i+1]))
+  }
+
+  var lines string
+  for _, field := range point.Fields {
+    lines += fmt.Sprintf("%s.%s %d %d\n", strings.Join(path, "."), graphiteName(field.Name), field.Value, point.Time.Unix())
+  }
+  return lines
+}
+
+func writeInflux (w io.Writer, tracking trackedOverall) (error) {
+  for _, point := range metricPoints(tracking) {
+    _, err := io.WriteString(w, influxLine(point))
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func writeGraphite (w io.Writer, prefix string, tracking trackedOverall) (error) {
+  for _, point := range metricPoints(tracking) {
+    _, err := io.WriteString(w, graphiteLines(prefix, point))
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// writeMetrics sends the lines to tcp://host:port or udp://host:port (one datagram per point)
+// and anything else is treated like the other outputs (a file or - for stdout)
+func writeMetrics (dest string, write func(io.Writer) (error)) (error) {
+  for _, network := range []string{ "tcp", "udp" } {
+    if !strings.HasPrefix(dest, network + "://") {
+      continue
+    }
+
+    conn, err := net.DialTimeout(network, strings.TrimPrefix(dest, network + "://"), 10 * time.Second)
+    if err != nil {
+      return err
+    }
+    defer conn.Close()
+
+    if network == "udp" {
+      return write(conn)
+    }
+
+    buffered := bufio.NewWriter(conn)
+    err = write(buffered)
+    if err != nil {
+      return err
+    }
+    return buffered.Flush()
+  }
+
+  return writeOutput(dest, write)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+  "bytes"
+  "io"
+  "net"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestInfluxLine (t *testing.T) {
+  point := metricPoint{ "logparse site", []string{ "vhost", "a,b", "site", "x=y z", "empty", "" },
+    []metricField{ { "requests", 3 }, { "bytes", 100 } }, time.Unix(1504224000, 0) }
+
+  got := influxLine(point)
+  want := `logparse\ site,vhost=a\,b,site=x\=y\ z requests=3i,bytes=100i 1504224000000000000` + "\n"
+  if got != want {
+    t.Errorf("got %q want %q", got, want)
+  }
+}
+
+func TestGraphiteLines (t *testing.T) {
+  point := metricPoint{ "logparse_network", []string{ "vhost", "www.bu.edu", "network", "campus net" },
+    []metricField{ { "requests", 3 } }, time.Unix(1504224000, 0) }
+
+  got := graphiteLines("web", point)
+  if got != "web.network.www_bu_edu.campus_net.requests 3 1504224000\n" {
+    t.Errorf("wrong graphite line %q", got)
+  }
+}
+
+func TestMetricPoints (t *testing.T) {
+  var buf bytes.Buffer
+  err := writeInflux(&buf, testCSVTracking(t))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  // the test lines are all in the 2017-09-01T04 (UTC) hour
+  for _, line := range []string {
+    "logparse_hourly,vhost=_all requests=3i,bytes=5000i,oncampus=2i,oncampus_bytes=2000i,offcampus=1i,offcampus_bytes=3000i 1504238400000000000",
+    "logparse_site,vhost=_default,site=htbin requests=3i,bytes=5000i,oncampus=2i,oncampus_bytes=2000i,offcampus=1i,offcampus_bytes=3000i 1504238400000000000",
+  } {
+    if !strings.Contains(buf.String(), line + "\n") {
+      t.Errorf("missing %q in:\n%s", line, buf.String())
+    }
+  }
+}
+
+func TestMetricsFile (t *testing.T) {
+  dest := filepath.Join(t.TempDir(), "metrics.txt")
+  err := writeMetrics(dest, func(w io.Writer) (error) { return writeGraphite(w, "logparse", testCSVTracking(t)) })
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  data, _ := os.ReadFile(dest)
+  if !bytes.Contains(data, []byte("logparse.hourly._all.requests 3 1504238400\n")) {
+    t.Errorf("wrong graphite file:\n%s", data)
+  }
+}
+
+func TestMetricsTCP (t *testing.T) {
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Skipf("cannot listen: %s", err)
+  }
+  defer listener.Close()
+
+  received := make(chan []byte)
+  go func() {
+    conn, err := listener.Accept()
+    if err != nil {
+      received <- nil
+      return
+    }
+    data, _ := io.ReadAll(conn)
+    conn.Close()
+    received <- data
+  }()
+
+  err = writeMetrics("tcp://" + listener.Addr().String(), func(w io.Writer) (error) { return writeInflux(w, testCSVTracking(t)) })
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  data := <-received
+  if !bytes.HasPrefix(data, []byte("logparse_hourly,vhost=_all ")) {
+    t.Errorf("wrong data over tcp:\n%s", data)
+  }
+}
+
+func TestMetricsUDP (t *testing.T) {
+  conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil {
+    t.Skipf("cannot listen: %s", err)
+  }
+  defer conn.Close()
+
+  err = writeMetrics("udp://" + conn.LocalAddr().String(), func(w io.Writer) (error) { return writeInflux(w, testCSVTracking(t)) })
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  buf := make([]byte, 65536)
+  conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+  n, _, err := conn.ReadFrom(buf)
+  if err != nil {
+    t.Errorf("nothing received: %s", err)
+    return
+  }
+  // one point per datagram
+  if strings.Count(string(buf[:n]), "\n") != 1 || !strings.HasPrefix(string(buf[:n]), "logparse_hourly,vhost=_all ") {
+    t.Errorf("wrong datagram %q", buf[:n])
+  }
+}
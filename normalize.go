@@ -0,0 +1,116 @@
+package main
+
+import (
+  "fmt"
+  "net/url"
+  "regexp"
+  "strings"
+)
+
+// a regex rewrite applied to base_uri (e.g. collapsing numeric ids into :id)
+type uriRewrite struct {
+  match *regexp.Regexp
+  replace string
+}
+
+// uriNormalizer holds the steps to apply to base_uri before the toplevel/secondLevel are
+// extracted and the entry is tracked.  The steps are always applied in the order of the fields.
+type uriNormalizer struct {
+  decode bool
+  collapseSlashes bool
+  lowercase bool
+  stripIndex bool
+  stripTrailingSlash bool
+  rewrites []uriRewrite
+}
+
+var multipleSlashes = regexp.MustCompile(`/{2,}`)
+var indexFile = regexp.MustCompile(`/index\.html?$`)
+
+// addNormalizeSteps parses a "normalize" config value like "decode,slashes,lowercase,index,trailing"
+func addNormalizeSteps (normalizer *uriNormalizer, steps string) (error) {
+  for _, step := range strings.Split(steps, ",") {
+    switch strings.TrimSpace(step) {
+    case "decode":
+      normalizer.decode = true
+    case "slashes":
+      normalizer.collapseSlashes = true
+    case "lowercase":
+      normalizer.lowercase = true
+    case "index":
+      normalizer.stripIndex = true
+    case "trailing":
+      normalizer.stripTrailingSlash = true
+    default:
+      return fmt.Errorf("unknown normalize step: %s", step)
+    }
+  }
+
+  return nil
+}
+
+// addRewrite parses a "rewrite"/"replace" config entry
+func addRewrite (normalizer *uriNormalizer, match string, replace string) (error) {
+  re, err := regexp.Compile(match)
+  if err != nil {
+    return err
+  }
+
+  normalizer.rewrites = append(normalizer.rewrites, uriRewrite{ re, replace })
+  return nil
+}
+
+func normalizerIsEmpty (normalizer uriNormalizer) (bool) {
+  return ! (normalizer.decode || normalizer.collapseSlashes || normalizer.lowercase ||
+    normalizer.stripIndex || normalizer.stripTrailingSlash || len(normalizer.rewrites) > 0)
+}
+
+func normalizeURI (normalizer uriNormalizer, base_uri string) (string) {
+  if normalizer.decode {
+    // leave the uri alone if it has bad escapes in it
+    decoded, err := url.PathUnescape(base_uri)
+    if err == nil {
+      base_uri = decoded
+    }
+  }
+
+  if normalizer.collapseSlashes {
+    base_uri = multipleSlashes.ReplaceAllLiteralString(base_uri, "/")
+  }
+
+  if normalizer.lowercase {
+    base_uri = strings.ToLower(base_uri)
+  }
+
+  if normalizer.stripIndex {
+    base_uri = indexFile.ReplaceAllLiteralString(base_uri, "/")
+  }
+
+  if normalizer.stripTrailingSlash && len(base_uri) > 1 {
+    base_uri = strings.TrimRight(base_uri, "/")
+    if base_uri == "" {
+      base_uri = "/"
+    }
+  }
+
+  for _, rewrite := range normalizer.rewrites {
+    base_uri = rewrite.match.ReplaceAllString(base_uri, rewrite.replace)
+  }
+
+  return base_uri
+}
+
+// normalizeEntry rewrites base_uri and recalculates the levels derived from it
+func normalizeEntry (normalizer uriNormalizer, entry map[string]string) {
+  if normalizerIsEmpty(normalizer) {
+    return
+  }
+
+  base_uri, isPresent := entry["base_uri"]
+  if ! isPresent {
+    return
+  }
+
+  entry["base_uri"] = normalizeURI(normalizer, base_uri)
+  setLevels(entry)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+  "testing"
+)
+
+var testNormalizeData = []map[string]string {
+  { "normalize": "decode,slashes,lowercase,index,trailing" },
+  { "rewrite": "/[0-9]+(/|$)", "replace": "/:id$1" },
+  { "site": "met", "status": "track" },
+  { "name": "10net", "net": "10.0.0.0/8", "track": "hosts,uri" },
+}
+
+var testNormalizeURI = []struct {
+  base_uri string
+  expected string
+} {
+  { "/", "/" },
+  { "/met//programs", "/met/programs" },
+  { "///met", "/met" },
+  { "/MET/Programs/", "/met/programs" },
+  { "/met/index.html", "/met" },
+  { "/met/programs/index.htm", "/met/programs" },
+  { "/met/%70rograms", "/met/programs" },
+  { "/met/bad%zzescape", "/met/bad%zzescape" },
+  { "/met/news/12345/story", "/met/news/:id/story" },
+  { "/met/news/12345", "/met/news/:id" },
+}
+
+func TestNormalizeURI (t *testing.T) {
+  config, err := initIPRanges(testNormalizeData)
+  if err != nil {
+    t.Errorf("error=%+v", err)
+    return
+  }
+
+  for _, tt := range testNormalizeURI {
+    result := normalizeURI(config.normalizer, tt.base_uri)
+    if result != tt.expected {
+      t.Errorf("normalizeURI(%s): expected=%s got=%s", tt.base_uri, tt.expected, result)
+    }
+  }
+}
+
+func TestNormalizeBadConfig (t *testing.T) {
+  _, err := initIPRanges([]map[string]string { { "normalize": "slashes,upcase" } })
+  if err == nil {
+    t.Errorf("unknown normalize step should be an error")
+  }
+
+  _, err = initIPRanges([]map[string]string { { "rewrite": "([0-9]+", "replace": ":id" } })
+  if err == nil {
+    t.Errorf("bad rewrite regex should be an error")
+  }
+}
+
+func TestNormalizeEntry (t *testing.T) {
+  config, err := initIPRanges(testNormalizeData)
+  if err != nil {
+    t.Errorf("error=%+v", err)
+    return
+  }
+
+  var lines = []string {
+    `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET //MET/programs/index.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+    `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /met/programs/ HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  }
+
+  tracking := initTrackedOverall()
+  for number, line := range lines {
+    entry := ParseAccess(number, line)
+    trackEntry(config, &tracking, entry)
+    if entry["toplevel"] != "met" || entry["secondLevel"] != "programs" {
+      t.Errorf("levels should be recalculated after normalizing: %+v", entry)
+    }
+  }
+
+  site := tracking.Tracked["_default"].Sites["met"]
+  if site.Base_uri["/met/programs"] != 2 || len(site.Base_uri) != 2 {
+    t.Errorf("both requests should be counted as /met/programs: %+v", site.Base_uri)
+  }
+}
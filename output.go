@@ -0,0 +1,77 @@
+package main
+
+import (
+  "io"
+  "os"
+  "strings"
+)
+
+// where the parse errors and other diagnostics go (stdout in the old mode so the json on stderr stays clean)
+var diag io.Writer = os.Stdout
+
+// where the processed=... lines go
+var progress io.Writer = os.Stdout
+
+// destList is a flag that can be given more than once - each value is a file name or - for stdout
+type destList []string
+
+func (d *destList) String () (string) {
+  return strings.Join(*d, ",")
+}
+
+func (d *destList) Set (value string) (error) {
+  *d = append(*d, value)
+  return nil
+}
+
+// othersToStdout is true when any of the outputs (other than the text report, which has always shared stdout
+// with the diagnostics) is written to stdout
+func othersToStdout (lists ...destList) (bool) {
+  for _, dests := range lists {
+    for _, dest := range dests {
+      if dest == "-" {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// openOutput opens a destination for writing (- is stdout which is never closed)
+func openOutput (dest string) (io.Writer, func() (error), error) {
+  if dest == "-" {
+    return os.Stdout, func() (error) { return nil }, nil
+  }
+
+  file, err := os.Create(dest)
+  if err != nil {
+    return nil, nil, err
+  }
+  return file, file.Close, nil
+}
+
+// writeOutput opens the destination, writes to it and closes it again
+func writeOutput (dest string, write func(io.Writer) (error)) (error) {
+  w, closer, err := openOutput(dest)
+  if err != nil {
+    return err
+  }
+
+  err = write(w)
+  if err != nil {
+    closer()
+    return err
+  }
+  return closer()
+}
+
+// writeOutputs writes to every destination in the list
+func writeOutputs (dests []string, write func(io.Writer) (error)) (error) {
+  for _, dest := range dests {
+    err := writeOutput(dest, write)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "flag"
+  "io"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestDestList (t *testing.T) {
+  var dests destList
+  flags := flag.NewFlagSet("test", flag.ContinueOnError)
+  flags.Var(&dests, "json", "test")
+
+  err := flags.Parse([]string{ "-json", "a.json", "--json", "-" })
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  if len(dests) != 2 || dests[0] != "a.json" || dests[1] != "-" {
+    t.Errorf("both destinations should be kept: %+v", dests)
+  }
+}
+
+func TestWriteOutputs (t *testing.T) {
+  dir := t.TempDir()
+  dests := []string{ filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt") }
+
+  err := writeOutputs(dests, func(w io.Writer) (error) {
+    _, err := w.Write([]byte("hello"))
+    return err
+  })
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  for _, dest := range dests {
+    data, err := os.ReadFile(dest)
+    if err != nil || string(data) != "hello" {
+      t.Errorf("%s should contain hello: (%s) err=%s", dest, data, err)
+    }
+  }
+
+  err = writeOutput(filepath.Join(dir, "missing", "c.txt"), func(w io.Writer) (error) { return nil })
+  if err == nil {
+    t.Errorf("writing into a missing directory should be an error")
+  }
+}
+
+func TestJSONTracked (t *testing.T) {
+  tracking, _ := testTrackStuff(t, testCSVLines, 2, 2000)
+
+  var buf bytes.Buffer
+  err := jsonTracked(&buf, tracking)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  // the top level keys are what calc_aws_costs.py reads
+  var data map[string]interface{}
+  err = json.Unmarshal(buf.Bytes(), &data)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  for _, key := range []string{ "Total", "TotalBytes", "OnCampus", "OnCampusBytes", "OffCampus", "OffCampusBytes", "Tracked" } {
+    if _, isPresent := data[key]; ! isPresent {
+      t.Errorf("json is missing %s", key)
+    }
+  }
+}
+
+func TestOthersToStdout (t *testing.T) {
+  if othersToStdout(destList{ "a.csv" }, nil, destList{ "b.html", "c.html" }) {
+    t.Errorf("no output on stdout")
+  }
+  if !othersToStdout(destList{ "a.csv" }, destList{ "b.html", "-" }) {
+    t.Errorf("-html - is on stdout")
+  }
+}
+
+func TestDiagnosticsRouting (t *testing.T) {
+  var buf bytes.Buffer
+  saved := diag
+  diag = &buf
+  defer func() { diag = saved }()
+
+  if ParseAccess(1, "garbage line") != nil {
+    t.Errorf("garbage should not parse")
+  }
+  if ! bytes.Contains(buf.Bytes(), []byte("Error parsing: garbage line")) {
+    t.Errorf("parse error should go to diag: (%s)", buf.String())
+  }
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+  "sort"
+  "strings"
+)
+
+// pathNode is one segment of the path tree (the root is the vhost itself)
+type pathNode struct {
+  Requests int
+  Bytes int64
+  Children map[string]*pathNode `json:",omitempty"`
+}
+
+// name used for the children folded together by prunePathTree
+const prunedPathName = "(other)"
+
+func initPathNode () (*pathNode) {
+  return &pathNode{}
+}
+
+// pathSegments splits base_uri into at most depth segments ignoring empty ones (so // is /)
+func pathSegments (base_uri string, depth int) ([]string) {
+  var segments []string
+
+  for _, segment := range strings.Split(base_uri, "/") {
+    if len(segments) >= depth {
+      break
+    }
+    if segment != "" {
+      segments = append(segments, segment)
+    }
+  }
+
+  return segments
+}
+
+// trackPath adds the request to the root and every node on the way down to depth
+func trackPath (root *pathNode, base_uri string, depth int, bytes int64) {
+  node := root
+  node.Requests++
+  node.Bytes += bytes
+
+  for _, segment := range pathSegments(base_uri, depth) {
+    if node.Children == nil {
+      node.Children = make(map[string]*pathNode)
+    }
+    child, isPresent := node.Children[segment]
+    if ! isPresent {
+      child = initPathNode()
+      node.Children[segment] = child
+    }
+    child.Requests++
+    child.Bytes += bytes
+    node = child
+  }
+}
+
+// prunePathTree folds every child with less than minRequests requests into a single (other) child
+func prunePathTree (node *pathNode, minRequests int) {
+  if node == nil {
+    return
+  }
+
+  var other *pathNode
+  for name, child := range node.Children {
+    if child.Requests < minRequests && name != prunedPathName {
+      if other == nil {
+        other = node.Children[prunedPathName]
+        if other == nil {
+          other = initPathNode()
+        }
+      }
+      other.Requests += child.Requests
+      other.Bytes += child.Bytes
+      delete(node.Children, name)
+    } else {
+      prunePathTree(child, minRequests)
+    }
+  }
+
+  if other != nil {
+    node.Children[prunedPathName] = other
+  }
+}
+
+// sortedPathNames orders the children by number of requests (largest first)
+func sortedPathNames (node *pathNode) ([]string) {
+  var names []string
+
+  for name := range node.Children {
+    names = append(names, name)
+  }
+
+  sort.Slice(names, func(i, j int) bool {
+    a := node.Children[names[i]]
+    b := node.Children[names[j]]
+    if a.Requests != b.Requests {
+      return a.Requests > b.Requests
+    }
+    return names[i] < names[j]
+  })
+
+  return names
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+  "testing"
+)
+
+var testPathSegments = []struct {
+  base_uri string
+  depth int
+  expected []string
+} {
+  { "/", 3, nil },
+  { "/met", 3, []string{ "met" } },
+  { "/met/programs/graduate/arts-administration/", 3, []string{ "met", "programs", "graduate" } },
+  { "//met//programs", 3, []string{ "met", "programs" } },
+  { "/met/programs/graduate", 1, []string{ "met" } },
+}
+
+func TestPathSegments (t *testing.T) {
+  for _, tt := range testPathSegments {
+    result := pathSegments(tt.base_uri, tt.depth)
+    if len(result) != len(tt.expected) {
+      t.Errorf("pathSegments(%s, %d): expected=%v got=%v", tt.base_uri, tt.depth, tt.expected, result)
+      continue
+    }
+    for i := range result {
+      if result[i] != tt.expected[i] {
+        t.Errorf("pathSegments(%s, %d): expected=%v got=%v", tt.base_uri, tt.depth, tt.expected, result)
+      }
+    }
+  }
+}
+
+func TestTrackPath (t *testing.T) {
+  root := initPathNode()
+  trackPath(root, "/met/programs/graduate/arts-administration/", 3, 100)
+  trackPath(root, "/met/programs/undergraduate", 3, 200)
+  trackPath(root, "/met", 3, 300)
+  trackPath(root, "/htbin/test", 3, 400)
+
+  if root.Requests != 4 || root.Bytes != 1000 {
+    t.Errorf("root should have 4 requests/1000 bytes: %+v", root)
+  }
+
+  met := root.Children["met"]
+  if met == nil || met.Requests != 3 || met.Bytes != 600 {
+    t.Errorf("met should have 3 requests/600 bytes: %+v", met)
+    return
+  }
+
+  programs := met.Children["programs"]
+  if programs == nil || programs.Requests != 2 {
+    t.Errorf("met/programs should have 2 requests: %+v", programs)
+    return
+  }
+
+  graduate := programs.Children["graduate"]
+  if graduate == nil || len(graduate.Children) != 0 {
+    t.Errorf("met/programs/graduate should be a leaf at depth 3: %+v", graduate)
+  }
+}
+
+func TestPrunePathTree (t *testing.T) {
+  root := initPathNode()
+  for i := 0; i < 5; i++ {
+    trackPath(root, "/met/programs", 2, 10)
+  }
+  trackPath(root, "/htbin", 2, 20)
+  trackPath(root, "/sph", 2, 30)
+  trackPath(root, "/met/about", 2, 40)
+
+  prunePathTree(root, 2)
+
+  if _, isPresent := root.Children["htbin"]; isPresent {
+    t.Errorf("htbin should have been pruned: %+v", root.Children)
+  }
+
+  other := root.Children[prunedPathName]
+  if other == nil || other.Requests != 2 || other.Bytes != 50 {
+    t.Errorf("(other) should have 2 requests/50 bytes: %+v", other)
+  }
+
+  met := root.Children["met"]
+  if met == nil || met.Children["programs"] == nil || met.Children[prunedPathName] == nil {
+    t.Errorf("met should keep programs and fold about into (other): %+v", met)
+  }
+
+  if root.Requests != 8 {
+    t.Errorf("pruning should not change the root totals: %+v", root)
+  }
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+  "fmt"
+  "path"
+  "regexp"
+  "strings"
+)
+
+// statusPattern is a vhost or site entry that matches more than one name - "*.bu.edu" style globs or
+// regexes starting with ^ (e.g. "^wp-.*")
+type statusPattern struct {
+  pattern string
+  re *regexp.Regexp
+  status int
+}
+
+func isRegexPattern (name string) (bool) {
+  return strings.HasPrefix(name, "^")
+}
+
+func isGlobPattern (name string) (bool) {
+  return !isRegexPattern(name) && strings.ContainsAny(name, "*?[")
+}
+
+// addStatusRule adds a vhost/site entry - exact names go in the map and patterns in the list
+// (a later entry for the same name or pattern replaces the status of the earlier one)
+func addStatusRule (exact map[string]int, patterns *[]statusPattern, name string, status int) (error) {
+  if !isRegexPattern(name) && !isGlobPattern(name) {
+    exact[name] = status
+    return nil
+  }
+
+  item := statusPattern{ pattern: name, status: status }
+  if isRegexPattern(name) {
+    re, err := regexp.Compile(name)
+    if err != nil {
+      return fmt.Errorf("bad pattern %s: %s", name, err)
+    }
+    item.re = re
+  } else if _, err := path.Match(name, ""); err != nil {
+    return fmt.Errorf("bad pattern %s: %s", name, err)
+  }
+
+  for num, existing := range *patterns {
+    if existing.pattern == name {
+      (*patterns)[num] = item
+      return nil
+    }
+  }
+  *patterns = append(*patterns, item)
+  return nil
+}
+
+// findStatusRule returns the status for a name and the entry that decided it: an exact match first,
+// then the globs in config order and then the regexes in config order
+func findStatusRule (exact map[string]int, patterns []statusPattern, name string) (int, string, bool) {
+  if status, ok := exact[name]; ok {
+    return status, name, true
+  }
+
+  for _, item := range patterns {
+    if item.re != nil {
+      continue
+    }
+    if matched, _ := path.Match(item.pattern, name); matched {
+      return item.status, item.pattern, true
+    }
+  }
+  for _, item := range patterns {
+    if item.re != nil && item.re.MatchString(name) {
+      return item.status, item.pattern, true
+    }
+  }
+
+  return 0, "", false
+}
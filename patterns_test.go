@@ -0,0 +1,114 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+var testPatternData = []map[string]string {
+  { "virtual": "^www\\..*", "status": "summarize" },
+  { "virtual": "*.bu.edu", "status": "ignore" },
+  { "virtual": "www.bu.edu", "status": "track" },
+  { "virtual": "*.example.*", "status": "track" },
+  { "virtual": "*.example.com", "status": "ignore" },
+  { "site": "wp-*", "status": "track" },
+  { "site": "^wp-admin$", "status": "ignore" },
+  { "site": "^[0-9]+$", "status": "summarize" },
+}
+
+func TestPatternPrecedence (t *testing.T) {
+  config, err := initIPRanges(testPatternData)
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+
+  for _, test := range []struct { vhost string; ignore bool; track bool; rule string } {
+    // the exact name beats every pattern
+    { "www.bu.edu", false, true, "www.bu.edu" },
+    // globs come before regexes even when the regex is first in the config
+    { "www.cs.bu.edu", true, false, "*.bu.edu" },
+    // the first glob in config order wins
+    { "a.example.com", false, true, "*.example.*" },
+    // regexes after the globs
+    { "www.example", false, false, "^www\\..*" },
+    // nothing matches so the default
+    { "other", false, true, "" },
+  } {
+    ignore, track, rule := findVirtualRule(config, test.vhost)
+    if ignore != test.ignore || track != test.track || rule != test.rule {
+      t.Errorf("%s: got %v %v %q want %v %v %q", test.vhost, ignore, track, rule, test.ignore, test.track, test.rule)
+    }
+  }
+
+  for _, test := range []struct { site string; ignore bool; track bool; rule string } {
+    { "wp-admin", false, true, "wp-*" },
+    { "wp-content", false, true, "wp-*" },
+    { "2017", false, false, "^[0-9]+$" },
+    { "met", true, false, "" },
+  } {
+    ignore, track, rule := findSiteRule(config, test.site)
+    if ignore != test.ignore || track != test.track || rule != test.rule {
+      t.Errorf("%s: got %v %v %q want %v %v %q", test.site, ignore, track, rule, test.ignore, test.track, test.rule)
+    }
+  }
+}
+
+func TestPatternTypedConfig (t *testing.T) {
+  config, err := buildIPRanges(testConfigFile(t, "ipnets.yaml", `
+vhosts:
+  - name: "*.bu.edu"
+    status: ignore
+  - name: "*.bu.edu"
+    status: summarize
+sites:
+  - name: "^wp-"
+    status: track
+`))
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+
+  // a later entry for the same pattern replaces the earlier one
+  if ignore, track := findVirtual(config, "www.bu.edu"); ignore || track {
+    t.Errorf("*.bu.edu is not summarize: %v %v", ignore, track)
+  }
+  if len(config.vhostPatterns) != 1 {
+    t.Errorf("duplicate pattern kept: %+v", config.vhostPatterns)
+  }
+  if _, track := findSite(config, "wp-assets"); !track {
+    t.Errorf("^wp- did not match wp-assets")
+  }
+}
+
+func TestPatternErrors (t *testing.T) {
+  _, err := initIPRanges([]map[string]string{ { "virtual": "^www(", "status": "track" } })
+  if err == nil || !strings.Contains(err.Error(), "bad pattern") {
+    t.Errorf("bad regex accepted: %v", err)
+  }
+  _, err = initIPRanges([]map[string]string{ { "site": "wp-[", "status": "track" } })
+  if err == nil || !strings.Contains(err.Error(), "bad pattern") {
+    t.Errorf("bad glob accepted: %v", err)
+  }
+}
+
+func TestPatternRuleHits (t *testing.T) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.json", `[ { "site": "ht*", "status": "track" } ]`))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  tracking := initTrackedOverall()
+  initRuleHits(&tracking, lc)
+  for num, line := range testCSVLines {
+    trackEntry(lc.config, &tracking, ParseAccess(num, line))
+  }
+
+  if rule := findRule(tracking.Rules, "site", "ht*"); rule.Hits != 3 {
+    t.Errorf("wrong ht* rule %+v", rule)
+  }
+  if _, ok := tracking.Tracked["_default"].Sites["htbin"]; !ok {
+    t.Errorf("htbin not tracked through the pattern")
+  }
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// promLimits keeps the number of series down - hosts and base_uri would otherwise explode
+type promLimits struct {
+  // most network/site label values per vhost (the rest are summed into "other")
+  labels int
+  // top hosts/base_uri per network/site (0 leaves those metrics out)
+  top int
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabels formats name/value pairs as {a="b",c="d"}
+func promLabels (pairs ...string) (string) {
+  var labels []string
+  for i := 0; i+1 < len(pairs); i += 2 {
+    labels = append(labels, pairs[i] + `="` + promEscaper.Replace(pairs[i+1]) + `"`)
+  }
+  return "{" + strings.Join(labels, ",") + "}"
+}
+
+func promHeader (w io.Writer, name string, kind string, help string) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// promSplit writes the on/off campus and ignored series for one set of labels
+func promSplit (w io.Writer, name string, labels []string, split campusSplit, bytes bool) {
+  values := []struct { campus string; requests int; bytes int64 } {
+    { "on", split.OnCampus, split.OnCampusBytes },
+    { "off", split.OffCampus, split.OffCampusBytes },
+    { "ignored", split.Total - split.OnCampus - split.OffCampus, split.TotalBytes - split.OnCampusBytes - split.OffCampusBytes },
+  }
+
+  for _, v := range values {
+    value := strconv.Itoa(v.requests)
+    if bytes {
+      value = strconv.FormatInt(v.bytes, 10)
+    }
+    fmt.Fprintf(w, "%s%s %s\n", name, promLabels(append(labels, "campus", v.campus)...), value)
+  }
+}
+
+// promLimitLabels returns the labels to keep and the split of the ones folded into "other"
+func promLimitLabels (limits promLimits, data map[string]trackedData) ([]string, campusSplit, bool) {
+  var labels []keyValue
+  for label, v := range data {
+    labels = append(labels, keyValue{ label, v.Total })
+  }
+  sortKeyValues(labels)
+
+  var kept []string
+  var other campusSplit
+  folded := false
+  for num, item := range labels {
+    if limits.labels > 0 && num >= limits.labels {
+      split := data[item.Key].campusSplit
+      other.Total += split.Total
+      other.TotalBytes += split.TotalBytes
+      other.OnCampus += split.OnCampus
+      other.OnCampusBytes += split.OnCampusBytes
+      other.OffCampus += split.OffCampus
+      other.OffCampusBytes += split.OffCampusBytes
+      folded = true
+    } else {
+      kept = append(kept, item.Key)
+    }
+  }
+
+  sort.Strings(kept)
+  return kept, other, folded
+}
+
+func promTrackedData (w io.Writer, name string, label string, limits promLimits, tracking trackedOverall, bytes bool) {
+  for _, vhost := range sortedVHosts(tracking) {
+    data := tracking.Tracked[vhost].Networks
+    if label == "site" {
+      data = tracking.Tracked[vhost].Sites
+    }
+
+    kept, other, folded := promLimitLabels(limits, data)
+    for _, k := range kept {
+      promSplit(w, name, []string{ "vhost", vhost, label, k }, data[k].campusSplit, bytes)
+    }
+    if folded {
+      promSplit(w, name, []string{ "vhost", vhost, label, "other" }, other, bytes)
+    }
+  }
+}
+
+func promTopCounts (w io.Writer, name string, label string, key string, limits promLimits, tracking trackedOverall) {
+  for _, vhost := range sortedVHosts(tracking) {
+    data := tracking.Tracked[vhost].Networks
+    if label == "site" {
+      data = tracking.Tracked[vhost].Sites
+    }
+
+    kept, _, _ := promLimitLabels(limits, data)
+    for _, k := range kept {
+      counts := data[k].Hosts
+      if key == "base_uri" {
+        counts = data[k].Base_uri
+      }
+      for _, item := range limitCounts(reportLimits{ top: map[string]int{ key: limits.top } }, key, sortedMap(counts)) {
+        fmt.Fprintf(w, "%s%s %d\n", name, promLabels("vhost", vhost, label, k, key, item.Key), item.Value)
+      }
+    }
+  }
+}
+
+func promLatency (w io.Writer, tracking trackedOverall) {
+  name := "logparse_request_duration_seconds"
+  promHeader(w, name, "histogram", "Elapsed time of the tracked requests.")
+
+  for _, vhost := range sortedVHosts(tracking) {
+    histogram := tracking.Tracked[vhost].Latency
+    if histogram == nil {
+      continue
+    }
+
+    cumulative := 0
+    for num, bound := range latencyBounds {
+      cumulative += histogram.Buckets[num]
+      fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels("vhost", vhost, "le", strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+    }
+    fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels("vhost", vhost, "le", "+Inf"), histogram.Count)
+    fmt.Fprintf(w, "%s_sum%s %s\n", name, promLabels("vhost", vhost), strconv.FormatFloat(histogram.Sum, 'g', -1, 64))
+    fmt.Fprintf(w, "%s_count%s %d\n", name, promLabels("vhost", vhost), histogram.Count)
+  }
+}
+
+// writePrometheus renders the summary in the prometheus text exposition format
+func writePrometheus (w io.Writer, limits promLimits, tracking trackedOverall) (error) {
+  for _, kind := range []struct { suffix string; help string; bytes bool } {
+    { "requests_total", "Requests", false },
+    { "bytes_total", "Bytes sent", true },
+  } {
+    name := "logparse_" + kind.suffix
+    promHeader(w, name, "counter", kind.help + " by vhost and campus.")
+    for _, vhost := range sortedVHosts(tracking) {
+      promSplit(w, name, []string{ "vhost", vhost }, tracking.Tracked[vhost].campusSplit, kind.bytes)
+    }
+
+    name = "logparse_network_" + kind.suffix
+    promHeader(w, name, "counter", kind.help + " by vhost, network and campus.")
+    promTrackedData(w, name, "network", limits, tracking, kind.bytes)
+
+    name = "logparse_site_" + kind.suffix
+    promHeader(w, name, "counter", kind.help + " by vhost, site and campus.")
+    promTrackedData(w, name, "site", limits, tracking, kind.bytes)
+  }
+
+  if limits.top > 0 {
+    promHeader(w, "logparse_host_requests_total", "counter", "Requests from the top hosts of the networks and sites that track hosts.")
+    promTopCounts(w, "logparse_host_requests_total", "network", "host", limits, tracking)
+    promTopCounts(w, "logparse_host_requests_total", "site", "host", limits, tracking)
+    promHeader(w, "logparse_base_uri_requests_total", "counter", "Requests for the top base_uri of the networks and sites that track uri.")
+    promTopCounts(w, "logparse_base_uri_requests_total", "network", "base_uri", limits, tracking)
+    promTopCounts(w, "logparse_base_uri_requests_total", "site", "base_uri", limits, tracking)
+  }
+
+  promLatency(w, tracking)
+  return nil
+}
+
+// prometheusTracked writes to a temporary file and renames it into place so the node_exporter
+// textfile collector never sees half a file
+func prometheusTracked (dest string, limits promLimits, tracking trackedOverall) (error) {
+  if dest == "-" {
+    return writePrometheus(os.Stdout, limits, tracking)
+  }
+
+  err := writeOutput(dest + ".tmp", func(w io.Writer) (error) { return writePrometheus(w, limits, tracking) })
+  if err != nil {
+    return err
+  }
+  return os.Rename(dest + ".tmp", dest)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func testPrometheus (t *testing.T, limits promLimits) (string) {
+  var buf bytes.Buffer
+  err := writePrometheus(&buf, limits, testCSVTracking(t))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  return buf.String()
+}
+
+func TestPromLabels (t *testing.T) {
+  got := promLabels("vhost", `a"b\c`, "site", "x\ny")
+  if got != `{vhost="a\"b\\c",site="x\ny"}` {
+    t.Errorf("wrong escaping: %s", got)
+  }
+}
+
+func TestPrometheus (t *testing.T) {
+  out := testPrometheus(t, promLimits{ labels: 50 })
+
+  for _, line := range []string {
+    "# TYPE logparse_requests_total counter",
+    `logparse_requests_total{vhost="_default",campus="on"} 2`,
+    `logparse_bytes_total{vhost="_default",campus="off"} 3000`,
+    `logparse_site_requests_total{vhost="_default",site="htbin",campus="off"} 1`,
+    "# TYPE logparse_request_duration_seconds histogram",
+    `logparse_request_duration_seconds_bucket{vhost="_default",le="0.005"} 0`,
+    `logparse_request_duration_seconds_bucket{vhost="_default",le="0.01"} 3`,
+    `logparse_request_duration_seconds_bucket{vhost="_default",le="+Inf"} 3`,
+    `logparse_request_duration_seconds_count{vhost="_default"} 3`,
+  } {
+    if !strings.Contains(out, line + "\n") {
+      t.Errorf("missing %q in:\n%s", line, out)
+    }
+  }
+
+  if strings.Contains(out, "logparse_base_uri_requests_total") {
+    t.Errorf("top base_uri exported without -promtop")
+  }
+  if testPrometheus(t, promLimits{ labels: 50 }) != out {
+    t.Errorf("output is not deterministic")
+  }
+}
+
+func TestPrometheusLimits (t *testing.T) {
+  out := testPrometheus(t, promLimits{ labels: 1, top: 1 })
+
+  if !strings.Contains(out, `site="other",campus=`) && !strings.Contains(out, `network="other",campus=`) {
+    t.Errorf("nothing folded into other:\n%s", out)
+  }
+  if !strings.Contains(out, "# TYPE logparse_base_uri_requests_total counter") {
+    t.Errorf("missing top base_uri:\n%s", out)
+  }
+}
+
+func TestPrometheusTextfile (t *testing.T) {
+  dest := filepath.Join(t.TempDir(), "logparse.prom")
+  err := prometheusTracked(dest, promLimits{}, testCSVTracking(t))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  data, err := os.ReadFile(dest)
+  if err != nil || !bytes.Contains(data, []byte("logparse_requests_total")) {
+    t.Errorf("textfile not written: %s", err)
+  }
+  if _, err := os.Stat(dest + ".tmp"); err == nil {
+    t.Errorf("temporary file left behind")
+  }
+}
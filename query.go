@@ -0,0 +1,229 @@
+package main
+
+import (
+  "regexp"
+  "strings"
+)
+
+// we only keep this many distinct values per parameter - the rest are counted as (other)
+const maxQueryValues = 100
+
+// and this many distinct base_uri?query keys per site - the requests of the rest are counted as (other)
+const maxQueryKeys = 10000
+
+type queryParam struct {
+  Requests int
+  Values map[string]int
+}
+
+type queryStats struct {
+  Requests int
+  WithQuery int
+  Params map[string]*queryParam
+  // base_uri?query -> requests (used to estimate the number of CDN cache keys)
+  Keys map[string]int `json:",omitempty"`
+  // the keys -querykeys left out of the summary - how many there were and their requests
+  OverflowKeys int `json:",omitempty"`
+  OverflowRequests int `json:",omitempty"`
+}
+
+// parameter names commonly used to bust caches (WordPress uses ?ver= on every script and stylesheet)
+var cacheBustingNames = map[string]bool {
+  "ver": true,
+  "v": true,
+  "version": true,
+  "_": true,
+  "cb": true,
+  "cachebuster": true,
+  "nocache": true,
+  "t": true,
+  "ts": true,
+  "timestamp": true,
+  "rand": true,
+}
+
+// versions (4.6.6), timestamps (1504238408) and hashes (a1b2c3d4e5f6) all look like this
+var cacheBustingValue = regexp.MustCompile(`^([0-9][0-9.\-_]*|[0-9a-f]{8,})$`)
+
+func initQueryStats () (*queryStats) {
+  return &queryStats{ Params: make(map[string]*queryParam), Keys: make(map[string]int) }
+}
+
+// parseQuery splits the raw query string into name/value pairs in the order they appear
+func parseQuery (query string) ([][2]string) {
+  var pairs [][2]string
+
+  for _, item := range strings.Split(query, "&") {
+    if item == "" {
+      continue
+    }
+    if strings.Contains(item, "=") {
+      elements := strings.SplitN(item, "=", 2)
+      pairs = append(pairs, [2]string{ elements[0], elements[1] })
+    } else {
+      pairs = append(pairs, [2]string{ item, "" })
+    }
+  }
+
+  return pairs
+}
+
+func trackQuery (stats *queryStats, base_uri string, query string) {
+  stats.Requests++
+  key := base_uri + "?" + query
+  if _, isPresent := stats.Keys[key]; isPresent || len(stats.Keys) < maxQueryKeys {
+    stats.Keys[key]++
+  } else {
+    stats.Keys["(other)"]++
+  }
+
+  if query == "" {
+    return
+  }
+  stats.WithQuery++
+
+  for _, pair := range parseQuery(query) {
+    param, isPresent := stats.Params[pair[0]]
+    if ! isPresent {
+      param = &queryParam{ Values: make(map[string]int) }
+      stats.Params[pair[0]] = param
+    }
+    param.Requests++
+
+    _, vIsPresent := param.Values[pair[1]]
+    if vIsPresent || len(param.Values) < maxQueryValues {
+      param.Values[pair[1]]++
+    } else {
+      param.Values["(other)"]++
+    }
+  }
+}
+
+func trackSiteQuery (tracking map[string]trackedData, label string, base_uri string, query string) {
+  element := tracking[label]
+  if element.Query == nil {
+    element.Query = initQueryStats()
+    tracking[label] = element
+  }
+
+  trackQuery(element.Query, base_uri, query)
+}
+
+// isCacheBusting decides if the parameter looks like it is only there to change the url
+func isCacheBusting (name string, param *queryParam) (bool) {
+  if cacheBustingNames[strings.ToLower(name)] {
+    return true
+  }
+
+  // otherwise all the values have to look like versions, timestamps or hashes (the ones past
+  // maxQueryValues are not known but having that many is a sign of busting anyway)
+  for value := range param.Values {
+    if value != "(other)" && ! cacheBustingValue.MatchString(value) {
+      return false
+    }
+  }
+  return len(param.Values) > 0
+}
+
+// queryKeyCount is the number of distinct urls with their full query string - every request past
+// maxQueryKeys counts as a key of its own so it is the worst case once the keys were capped
+func queryKeyCount (stats *queryStats) (int) {
+  other, isPresent := stats.Keys["(other)"]
+  if isPresent {
+    return len(stats.Keys) - 1 + other + stats.OverflowKeys
+  }
+  return len(stats.Keys) + stats.OverflowKeys
+}
+
+// queryCacheKeys counts the distinct urls a CDN would cache if the strip parameters
+// were dropped from the query string (stripAll drops the whole query string)
+func queryCacheKeys (stats *queryStats, strip map[string]bool, stripAll bool) (int) {
+  keys := make(map[string]bool)
+
+  // the requests past maxQueryKeys are not known so they each count as a key (and so does every key
+  // left out of the summary)
+  other := stats.Keys["(other)"] + stats.OverflowKeys
+  for key := range stats.Keys {
+    if key == "(other)" {
+      continue
+    }
+    elements := strings.SplitN(key, "?", 2)
+    if stripAll {
+      keys[elements[0]] = true
+      continue
+    }
+
+    var kept []string
+    for _, pair := range parseQuery(elements[1]) {
+      if ! strip[pair[0]] {
+        kept = append(kept, pair[0] + "=" + pair[1])
+      }
+    }
+    keys[elements[0] + "?" + strings.Join(kept, "&")] = true
+  }
+
+  return len(keys) + other
+}
+
+// limitQueryKeys keeps the limit busiest keys (and (other)) and only counts the rest - the stats are
+// copied so the report still has them all
+func limitQueryKeys (stats *queryStats, limit int) (*queryStats) {
+  _, hasOther := stats.Keys["(other)"]
+  known := len(stats.Keys)
+  if hasOther {
+    known--
+  }
+  if limit <= 0 || known <= limit {
+    return stats
+  }
+
+  var keys []keyValue
+  for key, requests := range stats.Keys {
+    if key != "(other)" {
+      keys = append(keys, keyValue{ key, requests })
+    }
+  }
+  sortKeyValues(keys)
+
+  limited := *stats
+  limited.Keys = make(map[string]int)
+  if hasOther {
+    limited.Keys["(other)"] = stats.Keys["(other)"]
+  }
+  for num, item := range keys {
+    if num < limit {
+      limited.Keys[item.Key] = item.Value
+    } else {
+      limited.OverflowKeys++
+      limited.OverflowRequests += item.Value
+    }
+  }
+  return &limited
+}
+
+// limitTrackedQueries is the tracking with the query keys of every site limited for the json and sqlite
+func limitTrackedQueries (tracking trackedOverall, limit int) (trackedOverall) {
+  if limit <= 0 {
+    return tracking
+  }
+
+  limited := tracking
+  limited.Tracked = make(map[string]trackedInfo)
+  for vhost, info := range tracking.Tracked {
+    sites := make(map[string]trackedData)
+    for site, data := range info.Sites {
+      if data.Query != nil {
+        data.Query = limitQueryKeys(data.Query, limit)
+      }
+      sites[site] = data
+    }
+    info.Sites = sites
+    limited.Tracked[vhost] = info
+  }
+  return limited
+}
+
+// cacheHitRatio is the best case hit ratio where each cache key only misses once
+func cacheHitRatio (requests int, keys int) (float64) {
+  return percentOf(float64(requests - keys), float64(requests))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+  "encoding/json"
+  "strconv"
+  "testing"
+)
+
+func TestParseQuery (t *testing.T) {
+  pairs := parseQuery("ver=4.6.6&&s=hello=world&flag")
+
+  if len(pairs) != 3 {
+    t.Errorf("expected 3 pairs and got %+v", pairs)
+    return
+  }
+  if pairs[0] != [2]string{ "ver", "4.6.6" } || pairs[1] != [2]string{ "s", "hello=world" } || pairs[2] != [2]string{ "flag", "" } {
+    t.Errorf("parsed wrong: %+v", pairs)
+  }
+}
+
+var testCacheBusting = []struct {
+  name string
+  values []string
+  expected bool
+} {
+  { "ver", []string{ "4.6.6" }, true },
+  { "VER", []string{ "abc" }, true },
+  { "build", []string{ "1504238408", "1504238409" }, true },
+  { "rev", []string{ "a1b2c3d4e5f6" }, true },
+  { "s", []string{ "4.6.6", "hello" }, false },
+  { "page", []string{ "about" }, false },
+}
+
+func TestIsCacheBusting (t *testing.T) {
+  for _, tt := range testCacheBusting {
+    param := &queryParam{ Values: make(map[string]int) }
+    for _, value := range tt.values {
+      param.Values[value]++
+    }
+
+    result := isCacheBusting(tt.name, param)
+    if result != tt.expected {
+      t.Errorf("isCacheBusting(%s, %v): expected=%t got=%t", tt.name, tt.values, tt.expected, result)
+    }
+  }
+}
+
+func TestQueryCacheKeys (t *testing.T) {
+  stats := initQueryStats()
+  trackQuery(stats, "/met/style.css", "ver=1")
+  trackQuery(stats, "/met/style.css", "ver=2")
+  trackQuery(stats, "/met/style.css", "ver=2")
+  trackQuery(stats, "/met/search", "s=a&ver=1")
+  trackQuery(stats, "/met/search", "s=b&ver=1")
+  trackQuery(stats, "/met/search", "")
+
+  if stats.Requests != 6 || stats.WithQuery != 5 {
+    t.Errorf("expected 6 requests with 5 query strings: %+v", stats)
+  }
+  if stats.Params["ver"].Requests != 5 || stats.Params["ver"].Values["1"] != 3 {
+    t.Errorf("ver should be in 5 requests with 1 three times: %+v", stats.Params["ver"])
+  }
+
+  if keys := queryCacheKeys(stats, nil, false); keys != 5 {
+    t.Errorf("full query string should have 5 keys and has %d", keys)
+  }
+  if keys := queryCacheKeys(stats, map[string]bool{ "ver": true }, false); keys != 4 {
+    t.Errorf("without ver should have 4 keys and has %d", keys)
+  }
+  if keys := queryCacheKeys(stats, nil, true); keys != 2 {
+    t.Errorf("without query string should have 2 keys and has %d", keys)
+  }
+}
+
+func TestQueryMaxValues (t *testing.T) {
+  stats := initQueryStats()
+  for i := 0; i < maxQueryValues + 10; i++ {
+    trackQuery(stats, "/search", "s=" + addCommaToInt(i*1000))
+  }
+
+  param := stats.Params["s"]
+  if len(param.Values) != maxQueryValues + 1 || param.Values["(other)"] != 10 {
+    t.Errorf("values should be capped at %d plus (other): %d values (other)=%d", maxQueryValues, len(param.Values), param.Values["(other)"])
+  }
+}
+
+func TestQueryOverflowBusting (t *testing.T) {
+  stats := initQueryStats()
+  for i := 0; i < maxQueryValues + 10; i++ {
+    trackQuery(stats, "/met/app.js", "build=" + strconv.Itoa(1504238408 + i))
+  }
+
+  // the (other) values do not make a timestamp param look like anything else
+  if !isCacheBusting("build", stats.Params["build"]) {
+    t.Errorf("build should be cache-busting with its values capped: %+v", stats.Params["build"].Values)
+  }
+}
+
+func TestQueryMaxKeys (t *testing.T) {
+  stats := initQueryStats()
+  for i := 0; i < maxQueryKeys + 10; i++ {
+    trackQuery(stats, "/met/app.js", "build=" + strconv.Itoa(i))
+  }
+
+  if len(stats.Keys) != maxQueryKeys + 1 || stats.Keys["(other)"] != 10 {
+    t.Errorf("keys should be capped at %d plus (other): %d keys (other)=%d", maxQueryKeys, len(stats.Keys), stats.Keys["(other)"])
+  }
+  if keys := queryKeyCount(stats); keys != maxQueryKeys + 10 {
+    t.Errorf("every request past the cap counts as a key: %d", keys)
+  }
+  if keys := queryCacheKeys(stats, nil, true); keys != 11 {
+    t.Errorf("without query string should have 1 key plus the 10 unknown ones and has %d", keys)
+  }
+
+  // the keys go in the json so the reports from -fromjson see the same numbers
+  data, _ := json.Marshal(stats)
+  var back queryStats
+  json.Unmarshal(data, &back)
+  if queryKeyCount(&back) != queryKeyCount(stats) {
+    t.Errorf("keys did not survive the json: %d", queryKeyCount(&back))
+  }
+}
+
+func TestLimitQueryKeys (t *testing.T) {
+  stats := initQueryStats()
+  for i := 0; i < 5; i++ {
+    for j := 0; j <= i; j++ {
+      trackQuery(stats, "/met/app.js", "build=" + strconv.Itoa(i))
+    }
+  }
+  stats.Keys["(other)"] = 2
+
+  limited := limitQueryKeys(stats, 2)
+  if len(limited.Keys) != 3 || limited.Keys["/met/app.js?build=4"] != 5 || limited.Keys["/met/app.js?build=3"] != 4 ||
+    limited.OverflowKeys != 3 || limited.OverflowRequests != 6 {
+    t.Errorf("should keep the 2 busiest keys and (other) and count the rest: %+v", limited)
+  }
+  if len(stats.Keys) != 6 {
+    t.Errorf("the stats the report uses should keep every key: %+v", stats.Keys)
+  }
+  if queryKeyCount(limited) != queryKeyCount(stats) || queryCacheKeys(limited, nil, false) != queryCacheKeys(stats, nil, false) {
+    t.Errorf("the left out keys should still count: %d %d", queryKeyCount(limited), queryCacheKeys(limited, nil, false))
+  }
+  if limitQueryKeys(stats, 0) != stats || limitQueryKeys(stats, 5) != stats {
+    t.Errorf("nothing to leave out should give the same stats back")
+  }
+
+  tracking := initTrackedOverall()
+  tracking.Tracked["_default"] = trackedInfo{ Sites: map[string]trackedData{ "met": { Query: stats } } }
+  summary := limitTrackedQueries(tracking, 2)
+  if summary.Tracked["_default"].Sites["met"].Query.OverflowKeys != 3 || tracking.Tracked["_default"].Sites["met"].Query != stats {
+    t.Errorf("the summary should have the limited keys and the tracking the full ones")
+  }
+}
+
+func TestSiteQuery (t *testing.T) {
+  config, err := testIPRanges()
+  if err != nil {
+    t.Errorf("error=%+v", err)
+    return
+  }
+  config.trackQuery = true
+
+  tracking := initTrackedOverall()
+  entry := ParseAccess(1, `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/wp-includes/js/wp-embed.min.js?ver=4.6.6 HTTP/1.1" 200 1403 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`)
+  if entry["query"] != "ver=4.6.6" {
+    t.Errorf("query should be ver=4.6.6 and is (%s)", entry["query"])
+  }
+  trackEntry(config, &tracking, entry)
+
+  query := tracking.Tracked["_default"].Sites["htbin"].Query
+  if query == nil || query.Params["ver"].Values["4.6.6"] != 1 {
+    t.Errorf("htbin should have the ver query parameter: %+v", query)
+  }
+}
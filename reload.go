@@ -0,0 +1,165 @@
+package main
+
+import (
+  "fmt"
+  "os"
+  "os/signal"
+  "syscall"
+  "time"
+)
+
+// configReload records a reload of the config during a run so the counts can be tied to the config that made them
+type configReload struct {
+  // when the new config was read (RFC 3339)
+  Time string
+  // the first line counted with it (the meta Lines count at the time)
+  Line int
+  // changed (the file or one of its includes changed) or signal (SIGHUP)
+  Reason string
+  ConfigHash string `json:",omitempty"`
+  // why the new config was not used (the old one carries on)
+  Error string `json:",omitempty"`
+  // the rules the new config no longer has with the hits they had up to the reload
+  DroppedRules []ruleHit `json:",omitempty"`
+}
+
+// configUpdate is a config the watcher loaded (err when it did not load)
+type configUpdate struct {
+  lc loadedConfig
+  reason string
+  err error
+  when time.Time
+}
+
+// configStamps are the modification time and size of each file of the config
+func configStamps (files []string) (map[string]string) {
+  stamps := make(map[string]string)
+  for _, filename := range files {
+    info, err := os.Stat(filename)
+    if err != nil {
+      stamps[filename] = "missing"
+      continue
+    }
+    stamps[filename] = fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+  }
+  return stamps
+}
+
+func stampsChanged (old map[string]string, now map[string]string) (bool) {
+  for filename, stamp := range now {
+    if old[filename] != stamp {
+      return true
+    }
+  }
+  return false
+}
+
+// watchConfig checks the config files every interval and reloads on a signal - each load (good or bad) is sent
+// on the channel for the scan to pick up between entries.  Closing stop ends the watch.
+func watchConfig (lc loadedConfig, interval time.Duration, signals <-chan os.Signal, stop <-chan struct{}) (<-chan configUpdate) {
+  updates := make(chan configUpdate, 1)
+
+  go func() {
+    files := lc.files
+    stamps := configStamps(files)
+    var tick <-chan time.Time
+    if interval > 0 {
+      ticker := time.NewTicker(interval)
+      defer ticker.Stop()
+      tick = ticker.C
+    }
+
+    for {
+      reason := ""
+      select {
+      case <-stop:
+        return
+      case <-signals:
+        reason = "signal"
+      case <-tick:
+        if !stampsChanged(stamps, configStamps(files)) {
+          continue
+        }
+        reason = "changed"
+      }
+
+      update := configUpdate{ reason: reason, when: time.Now() }
+      update.lc, update.err = loadConfig(lc.filename)
+      if update.err == nil {
+        // an include may have been added or dropped
+        files = update.lc.files
+      }
+      // a broken file is only tried again once it changes
+      stamps = configStamps(files)
+
+      select {
+      case updates <- update:
+      case <-stop:
+        return
+      }
+    }
+  }()
+
+  return updates
+}
+
+// reloadSignals are the signals that reload the config
+func reloadSignals () (<-chan os.Signal) {
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGHUP)
+  return signals
+}
+
+// reloadRuleHits starts the rule hits over for the new config and keeps the counts of the rules it still has
+// (the same kind, name and match wherever they moved to).  The rules that are gone are returned with their hits.
+func reloadRuleHits (tracking *trackedOverall, lc loadedConfig) ([]ruleHit) {
+  if tracking.ruleIndex == nil {
+    return nil
+  }
+
+  old := tracking.Rules
+  kept := make([]bool, len(old))
+  initRuleHits(tracking, lc)
+  for num, rule := range tracking.Rules {
+    for i, before := range old {
+      if before.Kind == rule.Kind && before.Name == rule.Name && before.Match == rule.Match {
+        tracking.Rules[num].Hits = before.Hits
+        kept[i] = true
+      }
+    }
+  }
+
+  var dropped []ruleHit
+  for i, before := range old {
+    if !kept[i] && before.Hits > 0 {
+      dropped = append(dropped, before)
+    }
+  }
+  return dropped
+}
+
+// applyConfigUpdate swaps the config used for the entries that follow (when the new one loaded) and records it
+func applyConfigUpdate (config *logConfig, tracking *trackedOverall, update configUpdate) {
+  reload := configReload{ Time: update.when.Format(time.RFC3339), Reason: update.reason }
+  if tracking.Meta != nil {
+    reload.Line = tracking.Meta.Lines
+  }
+
+  if update.err != nil {
+    reload.Error = update.err.Error()
+    fmt.Fprintf(diag, "config reload failed, keeping the old config: %s\n", update.err)
+  } else {
+    // the settings from the command line carry over
+    next := withSettings(update.lc, config.scanSettings)
+    *config = next
+    reload.ConfigHash = next.hash
+    reload.DroppedRules = reloadRuleHits(tracking, update.lc)
+    // the sample counts are by rules index which the new config may have moved around
+    tracking.samples = nil
+    fmt.Fprintf(diag, "config reloaded (%s) at line %d\n", update.reason, reload.Line)
+  }
+
+  if tracking.Meta != nil {
+    tracking.Meta.Reloads = append(tracking.Meta.Reloads, reload)
+  }
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+  "os"
+  "strings"
+  "testing"
+  "time"
+)
+
+const testReloadBefore = `[
+  { "name": "10net", "net": "10.0.0.0/8" },
+  { "site": "htbin", "status": "track" }
+]`
+
+const testReloadAfter = `[
+  { "name": "ignore:10net", "net": "10.0.0.0/8", "ignore": "true" },
+  { "site": "met", "status": "track" },
+  { "site": "htbin", "status": "track" }
+]`
+
+func TestScanLogReload (t *testing.T) {
+  saved := diag
+  diag = &strings.Builder{}
+  defer func() { diag = saved }()
+
+  filename := testConfigFile(t, "ipnets.json", testReloadBefore)
+  lc, err := loadConfig(filename)
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  settings := scanSettings{ crossTab: true, pathDepth: 2, trackQuery: true }
+  config := withSettings(lc, settings)
+
+  tracking := initTrackedOverall()
+  tracking.Meta = initSummaryMeta()
+  initRuleHits(&tracking, lc)
+  scanLogReloading(&config, strings.NewReader(testCSVLines[0] + "\n" + testCSVLines[2] + "\n"), &tracking, nil)
+
+  // the new config applies from the next entry on
+  os.WriteFile(filename, []byte(testReloadAfter), 0644)
+  updates := make(chan configUpdate, 1)
+  update := configUpdate{ reason: "signal", when: time.Now() }
+  update.lc, update.err = loadConfig(filename)
+  updates <- update
+  scanLogReloading(&config, strings.NewReader(testCSVLines[0] + "\n"), &tracking, updates)
+
+  if tracking.Total != 3 || tracking.OnCampus != 2 {
+    t.Errorf("expected 2 on campus before the reload and 1 ignored after: %+v", tracking.campusSplit)
+  }
+  if config.scanSettings != settings {
+    t.Errorf("the command line settings should carry over: %+v", config.scanSettings)
+  }
+  reloads := tracking.Meta.Reloads
+  if len(reloads) != 1 || reloads[0].Line != 2 || reloads[0].Reason != "signal" || reloads[0].ConfigHash != update.lc.config.hash || reloads[0].Error != "" {
+    t.Errorf("wrong reloads %+v", reloads)
+  }
+
+  // the site kept its hits across the reload (it moved down one entry) and the renamed network starts again
+  if rule := findRule(tracking.Rules, "site", "htbin"); rule.Hits != 3 || !strings.HasSuffix(rule.Where, ":4") {
+    t.Errorf("wrong htbin rule %+v", rule)
+  }
+  if rule := findRule(tracking.Rules, "network", "ignore:10net"); rule.Hits != 1 {
+    t.Errorf("wrong ignore:10net rule %+v", rule)
+  }
+  // the hits of the old network are in the reload
+  if len(reloads[0].DroppedRules) != 1 || reloads[0].DroppedRules[0].Name != "10net" || reloads[0].DroppedRules[0].Hits != 2 {
+    t.Errorf("the dropped network should be in the reload: %+v", reloads[0].DroppedRules)
+  }
+}
+
+func TestReloadBrokenConfig (t *testing.T) {
+  saved := diag
+  log := &strings.Builder{}
+  diag = log
+  defer func() { diag = saved }()
+
+  config, _ := testIPRanges()
+  tracking := initTrackedOverall()
+  tracking.Meta = initSummaryMeta()
+
+  _, err := loadConfig(testConfigFile(t, "ipnets.json", `[ { "name": "bad", "net": "10.0.0.0/33" } ]`))
+  applyConfigUpdate(&config, &tracking, configUpdate{ reason: "changed", err: err, when: time.Now() })
+
+  if len(config.ipranges) != len(testIPData) {
+    t.Errorf("the old config should have been kept")
+  }
+  if len(tracking.Meta.Reloads) != 1 || !strings.Contains(tracking.Meta.Reloads[0].Error, "invalid CIDR") {
+    t.Errorf("wrong reloads %+v", tracking.Meta.Reloads)
+  }
+  if !strings.Contains(log.String(), "keeping the old config") {
+    t.Errorf("the failure should be reported: %s", log.String())
+  }
+}
+
+func TestWatchConfig (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.json", testReloadBefore)
+  lc, err := loadConfig(filename)
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  signals := make(chan os.Signal, 1)
+  stop := make(chan struct{})
+  defer close(stop)
+  updates := watchConfig(lc, 10 * time.Millisecond, signals, stop)
+
+  signals <- os.Interrupt
+  select {
+  case update := <-updates:
+    if update.reason != "signal" || update.err != nil {
+      t.Errorf("wrong update %+v", update)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("no reload after the signal")
+  }
+
+  // a different size is enough to count as a change even within the mtime resolution
+  os.WriteFile(filename, []byte(testReloadAfter), 0644)
+  select {
+  case update := <-updates:
+    if update.reason != "changed" || update.err != nil || update.lc.config.ipranges[0].name != "ignore:10net" {
+      t.Errorf("wrong update %+v", update)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("no reload after the change")
+  }
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "net"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "text/template"
+)
+
+// reportLimits holds the top-N and minimum count per section of the text report (0 means no limit)
+type reportLimits struct {
+  top map[string]int
+  min map[string]int
+  // list the config rules that never matched at the end (-unusedrules)
+  unusedRules bool
+}
+
+// the sections that -top and -min know about
+var reportSections = []string{ "networks", "sites", "hosts", "base_uri", "params", "paths" }
+
+type reportSplit struct {
+  Prefix string
+  campusSplit
+}
+
+type reportParam struct {
+  Name string
+  Requests int
+  NumValues int
+  CacheBusting bool
+  Values []keyValue
+}
+
+type reportQuery struct {
+  Requests int
+  WithQuery int
+  Params []reportParam
+  Keys int
+  KeysWithoutBusting int
+  KeysWithoutQuery int
+}
+
+type reportData struct {
+  Label string
+  Name string
+  Requests int
+  UniqueHosts int
+  UniqueURIs int
+  Split *reportSplit
+  TrackHosts bool
+  Hosts []keyValue
+  TrackURI bool
+  Base_uri []keyValue
+  Query *reportQuery
+}
+
+type reportCrossTab struct {
+  Label string
+  Kind string
+  RowWidth int
+  ColWidth int
+  Columns []string
+  Rows [][]string
+}
+
+type reportPath struct {
+  Indent string
+  Path string
+  Requests int
+  Bytes int64
+  Percent float64
+}
+
+type reportPaths struct {
+  Label string
+  Requests int
+  Bytes int64
+  Nodes []reportPath
+}
+
+type reportVHost struct {
+  Name string
+  Number int
+  Split reportSplit
+  Networks []reportData
+  Sites []reportData
+  CrossTabs []reportCrossTab
+  Paths *reportPaths
+  Tags *reportTags
+}
+
+type reportTag struct {
+  Name string
+  Split reportSplit
+}
+
+type reportTags struct {
+  Label string
+  Tags []reportTag
+}
+
+type reportRules struct {
+  Total int
+  Unused []ruleHit
+}
+
+// reportSampled says how much the sample rules left out - every count in the report is of the kept entries
+type reportSampled struct {
+  Kept int
+  Left int
+  Rules []ruleHit
+}
+
+type textReport struct {
+  Split reportSplit
+  // nil unless a sample rule left entries out
+  Sampled *reportSampled
+  VHosts []reportVHost
+  // every vhost rolled up by tag (nil when nothing is tagged)
+  Tags *reportTags
+  // config rules that never matched (nil unless asked for or when the summary has no rule hits)
+  Rules *reportRules
+}
+
+// parseReportLimits parses "hosts=20,base_uri=50" into section -> number
+func parseReportLimits (value string) (map[string]int, error) {
+  limits := make(map[string]int)
+  if value == "" {
+    return limits, nil
+  }
+
+  for _, item := range strings.Split(value, ",") {
+    elements := strings.SplitN(item, "=", 2)
+    if len(elements) != 2 {
+      return limits, fmt.Errorf("limit should be section=number: %s", item)
+    }
+
+    known := false
+    for _, section := range reportSections {
+      if section == elements[0] {
+        known = true
+      }
+    }
+    if ! known {
+      return limits, fmt.Errorf("unknown report section %s (one of %s)", elements[0], strings.Join(reportSections, ","))
+    }
+
+    number, err := strconv.Atoi(elements[1])
+    if err != nil {
+      return limits, err
+    }
+    limits[elements[0]] = number
+  }
+
+  return limits, nil
+}
+
+// limitCounts drops the _total entry and applies the section limits to a sorted list
+func limitCounts (limits reportLimits, section string, data []keyValue) ([]keyValue) {
+  var result []keyValue
+
+  for _, item := range data {
+    if item.Key == "_total" {
+      continue
+    }
+    if limits.min[section] > 0 && item.Value < limits.min[section] {
+      continue
+    }
+    if limits.top[section] > 0 && len(result) >= limits.top[section] {
+      break
+    }
+    result = append(result, item)
+  }
+
+  return result
+}
+
+func buildReportQuery (limits reportLimits, stats *queryStats) (*reportQuery) {
+  query := &reportQuery{ Requests: stats.Requests, WithQuery: stats.WithQuery }
+
+  var params []keyValue
+  for name, param := range stats.Params {
+    params = append(params, keyValue{ name, param.Requests })
+  }
+  sortKeyValues(params)
+
+  busting := make(map[string]bool)
+  for _, item := range params {
+    if isCacheBusting(item.Key, stats.Params[item.Key]) {
+      busting[item.Key] = true
+    }
+  }
+
+  for _, item := range limitCounts(limits, "params", params) {
+    param := stats.Params[item.Key]
+    values := sortedMap(param.Values)
+    if len(values) > 5 {
+      values = values[:5]
+    }
+    query.Params = append(query.Params, reportParam{ item.Key, param.Requests, len(param.Values), busting[item.Key], values })
+  }
+
+  // estimate what the query string variance costs the CDN
+  query.Keys = queryKeyCount(stats)
+  query.KeysWithoutBusting = queryCacheKeys(stats, busting, false)
+  query.KeysWithoutQuery = queryCacheKeys(stats, nil, true)
+  return query
+}
+
+func buildReportData (limits reportLimits, section string, label string, tracking map[string]trackedData, showSplit bool) ([]reportData) {
+  var result []reportData
+
+  // by name unless only the top entries are shown, then the busiest go first like limitCounts does
+  keys := sortedTrackedKeys(tracking)
+  if limits.top[section] > 0 {
+    sort.SliceStable(keys, func(i, j int) bool {
+      return tracking[keys[i]].Base_uri["_total"] > tracking[keys[j]].Base_uri["_total"]
+    })
+  }
+
+  for _, k := range keys {
+    v := tracking[k]
+    if limits.min[section] > 0 && v.Base_uri["_total"] < limits.min[section] {
+      continue
+    }
+    if limits.top[section] > 0 && len(result) >= limits.top[section] {
+      break
+    }
+
+    data := reportData{
+      Label: label,
+      Name: k,
+      Requests: v.Base_uri["_total"],
+      UniqueHosts: len(v.Hosts),
+      UniqueURIs: len(v.Base_uri)-1,
+      TrackHosts: v.TrackHosts,
+      TrackURI: v.TrackURI,
+    }
+    if showSplit {
+      data.Split = &reportSplit{ " *", v.campusSplit }
+    }
+    if v.TrackHosts {
+      data.Hosts = limitCounts(limits, "hosts", sortedMap(v.Hosts))
+    }
+    if v.TrackURI {
+      data.Base_uri = limitCounts(limits, "base_uri", sortedMap(v.Base_uri))
+    }
+    if v.Query != nil {
+      data.Query = buildReportQuery(limits, v.Query)
+    }
+    result = append(result, data)
+  }
+
+  return result
+}
+
+func buildReportCrossTabs (label string, crossTab map[string]map[string]crossTabCell) ([]reportCrossTab) {
+  var result []reportCrossTab
+  if len(crossTab) == 0 {
+    return result
+  }
+
+  rows, cols := crossTabKeys(crossTab)
+
+  // size the columns so that the labels and the numbers line up
+  rowWidth := len("network")
+  for _, row := range rows {
+    if len(row) > rowWidth {
+      rowWidth = len(row)
+    }
+  }
+  colWidth := 12
+  for _, col := range cols {
+    if len(col) > colWidth {
+      colWidth = len(col)
+    }
+  }
+
+  for _, kind := range []string{ "requests", "kbytes" } {
+    table := reportCrossTab{ Label: label, Kind: kind, RowWidth: rowWidth, ColWidth: colWidth, Columns: cols }
+    for _, row := range rows {
+      cells := []string{ row }
+      for _, col := range cols {
+        cell := crossTab[row][col]
+        if kind == "requests" {
+          cells = append(cells, addCommaToInt(cell.Requests))
+        } else {
+          cells = append(cells, addCommaToInt64(cell.Bytes/1024))
+        }
+      }
+      table.Rows = append(table.Rows, cells)
+    }
+    result = append(result, table)
+  }
+
+  return result
+}
+
+func buildReportPathNodes (limits reportLimits, node *pathNode, path string, indent string, total int, result []reportPath) ([]reportPath) {
+  shown := 0
+  for _, name := range sortedPathNames(node) {
+    child := node.Children[name]
+    if limits.min["paths"] > 0 && child.Requests < limits.min["paths"] {
+      continue
+    }
+    if limits.top["paths"] > 0 && shown >= limits.top["paths"] {
+      break
+    }
+    shown++
+
+    childPath := path + "/" + name
+    result = append(result, reportPath{ indent, childPath, child.Requests, child.Bytes, percentOf(float64(child.Requests), float64(total)) })
+    result = buildReportPathNodes(limits, child, childPath, indent + "  ", total, result)
+  }
+
+  return result
+}
+
+// reportSampling is nil unless the summary has entries a sample rule left out
+func reportSampling (tracking trackedOverall) (*reportSampled) {
+  if tracking.Meta == nil || tracking.Meta.SampledOut == 0 {
+    return nil
+  }
+  return &reportSampled{ tracking.Total, tracking.Meta.SampledOut, sampleRules(tracking.Rules) }
+}
+
+func buildTextReport (limits reportLimits, tracking trackedOverall) (textReport) {
+  report := textReport{ Split: reportSplit{ "###", tracking.campusSplit }, Sampled: reportSampling(tracking) }
+
+  for _, k := range sortedVHosts(tracking) {
+    v := tracking.Tracked[k]
+    vhost := reportVHost{
+      Name: k,
+      Number: v.Number,
+      Split: reportSplit{ "###", v.campusSplit },
+      Networks: buildReportData(limits, "networks", "network-"+k, v.Networks, false),
+      Sites: buildReportData(limits, "sites", "sites-"+k, v.Sites, true),
+      CrossTabs: buildReportCrossTabs("crosstab-"+k, v.CrossTab),
+    }
+    if v.Paths != nil && v.Paths.Requests > 0 {
+      vhost.Paths = &reportPaths{ "paths-"+k, v.Paths.Requests, v.Paths.Bytes,
+        buildReportPathNodes(limits, v.Paths, "", "  ", v.Paths.Requests, nil) }
+    }
+    vhost.Tags = buildReportTags("tags-"+k, v.Tags)
+    report.VHosts = append(report.VHosts, vhost)
+  }
+  report.Tags = buildReportTags("tags (all vhosts)", tracking.Tags)
+
+  if limits.unusedRules && len(tracking.Rules) > 0 {
+    report.Rules = &reportRules{ len(tracking.Rules), unusedRules(tracking.Rules) }
+  }
+
+  return report
+}
+
+func reportHostname (ip string) (string) {
+  iplist, err := net.LookupAddr(ip)
+  if err != nil {
+    return fmt.Sprintf("DNS-error:%s", err)
+  }
+  return iplist[0]
+}
+
+var reportFuncs = template.FuncMap{
+  "comma": addCommaToInt,
+  "comma64": addCommaToInt64,
+  "kbytes": func(bytes int64) (string) { return addCommaToInt64(bytes/1024) },
+  "kbytesf": func(bytes int64) (float64) { return float64(bytes)/1024 },
+  "percent": func(value int, total int) (float64) { return percentOf(float64(value), float64(total)) },
+  "percent64": func(value int64, total int64) (float64) { return percentOf(float64(value), float64(total)) },
+  "sum": func(a int, b int) (int) { return a + b },
+  "ignored": func(split reportSplit) (int) { return split.Total - split.OnCampus - split.OffCampus },
+  "ignoredBytes": func(split reportSplit) (int64) { return split.TotalBytes - split.OnCampusBytes - split.OffCampusBytes },
+  "hitRatio": cacheHitRatio,
+  "hostname": reportHostname,
+  "padLeft": func(width int, value string) (string) { return fmt.Sprintf("%*s", width, value) },
+  "padRight": func(width int, value string) (string) { return fmt.Sprintf("%-*s", width, value) },
+}
+
+// defaultTextTemplate is the layout dumpTracked has always printed.  The named templates can be
+// reused (or redefined) by a template given with -template.
+const defaultTextTemplate = `{{define "split"}}
+{{- .Prefix}} Total requests= {{comma .Total}} kbytes={{printf "%.2f" (kbytesf .TotalBytes)}} 
+{{.Prefix}} On Campus: requests= {{comma .OnCampus}} ({{printf "%.2f" (percent .OnCampus .Total)}} %) kbytes= {{kbytes .OnCampusBytes}} ({{printf "%.2f" (percent64 .OnCampusBytes .TotalBytes)}} %)
+{{.Prefix}} Off Campus: requests= {{comma .OffCampus}} ({{printf "%.2f" (percent .OffCampus .Total)}} %) kbytes= {{kbytes .OffCampusBytes}} ({{printf "%.2f" (percent64 .OffCampusBytes .TotalBytes)}} %)
+{{.Prefix}} Ignored: requests= {{comma (ignored .)}} ({{printf "%.2f" (percent (ignored .) .Total)}} %) kbytes= {{kbytes (ignoredBytes .)}} ({{printf "%.2f" (percent64 (ignoredBytes .) .TotalBytes)}} %)
+{{end}}
+
+{{- define "query"}}{{$site := .Name}}{{with .Query}}
+ * {{$site}} query strings ({{comma .WithQuery}} of {{comma .Requests}} requests)
+{{range .Params}}{{$name := .Name}}    {{comma .Requests}}: {{.Name}} ({{.NumValues}} values{{if .CacheBusting}} cache-busting{{end}})
+{{range .Values}}        {{comma .Value}}: {{$name}}={{.Key}}
+{{end}}{{end}}
+ * {{$site}} cache keys (best case hit ratio)
+    full query string: {{comma .Keys}} keys ({{printf "%.2f" (hitRatio .Requests .Keys)}} %)
+    without cache-busting params: {{comma .KeysWithoutBusting}} keys ({{printf "%.2f" (hitRatio .Requests .KeysWithoutBusting)}} %)
+    without query string: {{comma .KeysWithoutQuery}} keys ({{printf "%.2f" (hitRatio .Requests .KeysWithoutQuery)}} %)
+{{end}}{{end}}
+
+{{- define "data"}}{{range .}}{{$label := .Label}}{{$name := .Name}}
+=======================================================================
+*** {{.Label}}:{{.Name}} ({{comma .Requests}} requests; {{.UniqueHosts}} unique hosts, {{.UniqueURIs}} base_uri)
+{{with .Split}}{{template "split" .}}{{end}}
+{{- if .TrackHosts}}
+ * {{.Name}} IPs
+{{range .Hosts}}    {{comma .Value}}: {{.Key}} ({{$label}}:{{$name}} - hostname={{hostname .Key}})
+{{end}}{{end}}
+{{- if .TrackURI}}
+ * {{.Name}} base_uri requests
+{{range .Base_uri}}    {{comma .Value}}: {{.Key}} ({{$label}}:{{$name}})
+{{end}}{{end}}
+{{- template "query" .}}
+{{- end}}{{end}}
+
+{{- define "crosstab"}}{{range .}}{{$t := .}}
+=======================================================================
+*** {{.Label}}: network x site ({{.Kind}})
+
+  {{padRight .RowWidth "network"}}{{range .Columns}} {{padLeft $t.ColWidth .}}{{end}}
+{{range .Rows}}{{range $i, $cell := .}}{{if eq $i 0}}  {{padRight $t.RowWidth $cell}}{{else}} {{padLeft $t.ColWidth $cell}}{{end}}{{end}}
+{{end}}{{end}}{{end}}
+
+{{- define "paths"}}{{with .}}
+=======================================================================
+*** {{.Label}} ({{comma .Requests}} requests; kbytes= {{kbytes .Bytes}})
+
+{{range .Nodes}}{{.Indent}}{{.Path}}: {{comma .Requests}} ({{printf "%.2f" .Percent}} %) kbytes= {{kbytes .Bytes}}
+{{end}}{{end}}{{end}}
+
+{{- define "tags"}}{{with .}}
+=======================================================================
+*** {{.Label}}
+{{range .Tags}}  {{.Name}}: requests= {{comma .Split.Total}} (on campus {{comma .Split.OnCampus}}, off campus {{comma .Split.OffCampus}}, ignored {{comma (ignored .Split)}}) kbytes= {{kbytes .Split.TotalBytes}}
+{{end}}{{end}}{{end}}
+
+{{- define "sampled"}}{{with .}}### Sampled: {{comma .Left}} entries were left out by sample rules, every count is of the {{comma .Kept}} kept ({{printf "%.2f" (percent .Kept (sum .Kept .Left))}} % of the entries)
+{{range .Rules}}###   rule {{.Name}} {{.Action}} matched {{comma .Hits}} ({{.Where}})
+{{end}}{{end}}{{end}}
+
+{{- define "vhost"}}
+#######################################################################
+### vhost {{.Name}} ({{comma .Number}} tracked requests)
+{{template "split" .Split}}
+{{- template "data" .Networks}}
+{{- template "data" .Sites}}
+{{- template "crosstab" .CrossTabs}}
+{{- template "paths" .Paths}}
+{{- template "tags" .Tags}}
+{{- end}}
+
+{{- define "rules"}}{{with .}}{{if .Unused}}
+=======================================================================
+*** config rules that never matched ({{len .Unused}} of {{.Total}})
+{{range .Unused}}  {{.Kind}} {{.Name}}{{if .Match}} {{.Match}}{{end}} ({{.Where}})
+{{end}}{{end}}{{end}}{{end}}
+
+{{- template "split" .Split}}
+{{- template "sampled" .Sampled}}
+{{- range .VHosts}}{{template "vhost" .}}{{end}}
+{{- template "tags" .Tags}}
+{{- template "rules" .Rules}}`
+
+// loadReportTemplate returns the default template or, when filename is set, the default
+// named templates plus the ones in filename (which becomes the template that is executed)
+func loadReportTemplate (filename string) (*template.Template, string, error) {
+  tmpl, err := template.New("report").Funcs(reportFuncs).Parse(defaultTextTemplate)
+  if err != nil || filename == "" {
+    return tmpl, "report", err
+  }
+
+  tmpl, err = tmpl.ParseFiles(filename)
+  return tmpl, filepath.Base(filename), err
+}
+
+func writeTextReport (w io.Writer, tmpl *template.Template, name string, limits reportLimits, tracking trackedOverall) (error) {
+  return tmpl.ExecuteTemplate(w, name, buildTextReport(limits, tracking))
+}
+
+// sortKeyValues orders by value (largest first) and then by key so reports are the same every run
+func sortKeyValues (data []keyValue) {
+  sort.Slice(data, func(i, j int) bool {
+    if data[i].Value != data[j].Value {
+      return data[i].Value > data[j].Value
+    }
+    return data[i].Key < data[j].Key
+  })
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+var testReportLines = []string {
+  `10.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `10.241.26.101 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/a.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `10.241.26.101 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/b.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `10.241.26.101 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/index.html HTTP/1.1" 200 1000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+  `100.241.26.100 - - [01/Sep/2017:00:00:08 -0400] "GET /htbin/c.html HTTP/1.1" 200 3000 0.007192 0.000000 0.000000 "-" "-" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`,
+}
+
+func TestParseReportLimits (t *testing.T) {
+  limits, err := parseReportLimits("hosts=20,base_uri=50")
+  if err != nil || limits["hosts"] != 20 || limits["base_uri"] != 50 {
+    t.Errorf("parsed wrong: %+v err=%s", limits, err)
+  }
+
+  for _, bad := range []string{ "hosts", "hosts=x", "uris=10" } {
+    if _, err := parseReportLimits(bad); err == nil {
+      t.Errorf("%s should be an error", bad)
+    }
+  }
+}
+
+func TestLimitCounts (t *testing.T) {
+  data := []keyValue{ { "_total", 10 }, { "a", 5 }, { "b", 3 }, { "c", 1 }, { "d", 1 } }
+
+  result := limitCounts(reportLimits{ top: map[string]int{ "hosts": 2 } }, "hosts", data)
+  if len(result) != 2 || result[0].Key != "a" || result[1].Key != "b" {
+    t.Errorf("top 2 should be a and b: %+v", result)
+  }
+
+  result = limitCounts(reportLimits{ min: map[string]int{ "hosts": 2 } }, "hosts", data)
+  if len(result) != 2 {
+    t.Errorf("min 2 should leave a and b: %+v", result)
+  }
+
+  result = limitCounts(reportLimits{}, "hosts", data)
+  if len(result) != 4 {
+    t.Errorf("no limits should only drop _total: %+v", result)
+  }
+}
+
+func TestSortedMapDeterministic (t *testing.T) {
+  data := map[string]int{ "d": 1, "c": 1, "b": 2, "a": 1 }
+  result := sortedMap(data)
+  expected := []string{ "b", "a", "c", "d" }
+  for i := range expected {
+    if result[i].Key != expected[i] {
+      t.Errorf("sortedMap should order by value then key: %+v", result)
+      break
+    }
+  }
+}
+
+func testReportOutput (t *testing.T, filename string, limits reportLimits) (string) {
+  tracking, _ := testTrackStuff(t, testReportLines, 4, 4000)
+
+  // turn off the hosts so that we don't do dns lookups
+  for _, v := range tracking.Tracked {
+    for k, data := range v.Networks {
+      data.TrackHosts = false
+      v.Networks[k] = data
+    }
+    for k, data := range v.Sites {
+      data.TrackHosts = false
+      v.Sites[k] = data
+    }
+  }
+
+  tmpl, name, err := loadReportTemplate(filename)
+  if err != nil {
+    t.Errorf("error loading template: %s", err)
+    return ""
+  }
+
+  var buf bytes.Buffer
+  err = writeTextReport(&buf, tmpl, name, limits, tracking)
+  if err != nil {
+    t.Errorf("error writing report: %s", err)
+  }
+  return buf.String()
+}
+
+func TestDefaultReport (t *testing.T) {
+  output := testReportOutput(t, "", reportLimits{})
+
+  for _, expected := range []string{
+    "### Total requests= 5 kbytes=6.84 \n",
+    "### On Campus: requests= 4 (80.00 %) kbytes= 3 (57.14 %)\n",
+    "### vhost _default (5 tracked requests)\n",
+    "*** network-_default:10net (4 requests; 2 unique hosts, 3 base_uri)\n",
+    "    2: /htbin/index.html (network-_default:10net)\n    1: /htbin/a.html (network-_default:10net)\n",
+    " * Off Campus: requests= 1 (20.00 %) kbytes= 2 (42.86 %)\n",
+  } {
+    if ! strings.Contains(output, expected) {
+      t.Errorf("report is missing (%s):\n%s", expected, output)
+    }
+  }
+
+  // the output has to be the same every time
+  for i := 0; i < 5; i++ {
+    if again := testReportOutput(t, "", reportLimits{}); again != output {
+      t.Errorf("report changed between runs:\n%s\n%s", output, again)
+      break
+    }
+  }
+}
+
+func TestReportLimits (t *testing.T) {
+  output := testReportOutput(t, "", reportLimits{ top: map[string]int{ "base_uri": 1 }, min: map[string]int{} })
+
+  if ! strings.Contains(output, "/htbin/index.html (network-_default:10net)") {
+    t.Errorf("top base_uri should still be shown:\n%s", output)
+  }
+  if strings.Contains(output, "/htbin/a.html (network-_default:10net)") {
+    t.Errorf("only the top base_uri should be shown:\n%s", output)
+  }
+}
+
+func TestReportTopNetworksAndSites (t *testing.T) {
+  data := make(map[string]trackedData)
+  for name, requests := range map[string]int{ "a": 1, "b": 5, "c": 3, "d": 5 } {
+    item := initTrackedData(false, false)
+    item.Base_uri["_total"] = requests
+    data[name] = item
+  }
+
+  for _, section := range []string{ "networks", "sites" } {
+    var names []string
+    for _, item := range buildReportData(reportLimits{ top: map[string]int{ section: 3 } }, section, section, data, false) {
+      names = append(names, item.Name)
+    }
+    if strings.Join(names, " ") != "b d c" {
+      t.Errorf("%s: top 3 should be the busiest: %v", section, names)
+    }
+  }
+
+  // without a top they stay in name order
+  var names []string
+  for _, item := range buildReportData(reportLimits{}, "sites", "sites", data, false) {
+    names = append(names, item.Name)
+  }
+  if strings.Join(names, " ") != "a b c d" {
+    t.Errorf("wrong order %v", names)
+  }
+}
+
+func TestCustomReportTemplate (t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "custom.tmpl")
+  custom := `{{template "split" .Split}}{{range .VHosts}}vhost={{.Name}}{{range .Networks}} {{.Name}}={{.Requests}}{{end}}
+{{end}}`
+  err := os.WriteFile(filename, []byte(custom), 0644)
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+
+  output := testReportOutput(t, filename, reportLimits{})
+  if ! strings.HasPrefix(output, "### Total requests= 5 ") || ! strings.HasSuffix(output, "vhost=_default 10net=4 default=1\n") {
+    t.Errorf("custom template output wrong:\n%s", output)
+  }
+}
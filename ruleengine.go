@@ -0,0 +1,237 @@
+package main
+
+import (
+  "fmt"
+  "math"
+  "net"
+  "regexp"
+  "strconv"
+  "strings"
+)
+
+// ruleCondition is one "field op value" test of a rule:
+//   base_uri ~ ^/healthz$      regex (!~ for does not match)
+//   method = HEAD              equals (!= for not equal)
+//   ip in 10.231.9.0/24,...    the address is in one of the ranges (!in for none of them)
+//   ret in 500..599            number range (either end can be left off: size in 1000000..)
+type ruleCondition struct {
+  field string
+  op string
+  negate bool
+  value string
+  re *regexp.Regexp
+  nets []*net.IPNet
+  min float64
+  max float64
+}
+
+// entryRule is an entry of the rules section - every rule that matches applies its action in config order
+type entryRule struct {
+  name string
+  conditions []ruleCondition
+  // ignore, network, site, tag or sample
+  action string
+  value string
+  // sample keeps one in every matches
+  every int
+}
+
+// sampleCounts is how many entries each sample rule (by rules index) has matched so far - it belongs to
+// the scan so explain and export do not move the sampling of the counts along
+type sampleCounts map[int]int
+
+// firstWord splits off the text up to the first space or tab and the rest without the spaces and tabs around it
+func firstWord (text string) (string, string) {
+  text = strings.TrimSpace(text)
+  end := strings.IndexAny(text, " \t")
+  if end < 0 {
+    return text, ""
+  }
+  return text[:end], strings.TrimSpace(text[end:])
+}
+
+// parseCondition reads a "field op value" condition (any spaces or tabs between them, the value is the rest)
+func parseCondition (condition string) (ruleCondition, error) {
+  field, rest := firstWord(condition)
+  op, value := firstWord(rest)
+  if value == "" {
+    return ruleCondition{}, fmt.Errorf("condition %q should be field op value", condition)
+  }
+
+  c := ruleCondition{ field: field, op: strings.TrimPrefix(op, "!"), negate: strings.HasPrefix(op, "!"), value: value }
+  switch c.op {
+  case "=":
+  case "~":
+    re, err := regexp.Compile(c.value)
+    if err != nil {
+      return c, fmt.Errorf("condition %q: %s", condition, err)
+    }
+    c.re = re
+  case "in":
+    if strings.Contains(c.value, "..") {
+      bounds := strings.SplitN(c.value, "..", 2)
+      c.min, c.max = math.Inf(-1), math.Inf(1)
+      for num, bound := range bounds {
+        if bound == "" {
+          continue
+        }
+        value, err := strconv.ParseFloat(bound, 64)
+        if err != nil {
+          return c, fmt.Errorf("condition %q: bad range %s", condition, c.value)
+        }
+        if num == 0 {
+          c.min = value
+        } else {
+          c.max = value
+        }
+      }
+    } else {
+      for _, cidr := range strings.Split(c.value, ",") {
+        _, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+        if err != nil {
+          return c, fmt.Errorf("condition %q: %s", condition, err)
+        }
+        c.nets = append(c.nets, ipnet)
+      }
+    }
+  default:
+    return c, fmt.Errorf("condition %q: unknown op %s (~ = in and their ! versions)", condition, op)
+  }
+  return c, nil
+}
+
+// sampleEvery turns "1/10" or "0.1" into keeping one entry in 10
+func sampleEvery (rate string) (int, error) {
+  if strings.HasPrefix(rate, "1/") {
+    every, err := strconv.Atoi(rate[2:])
+    if err != nil || every < 1 {
+      return 0, fmt.Errorf("bad sample rate %s", rate)
+    }
+    return every, nil
+  }
+
+  fraction, err := strconv.ParseFloat(rate, 64)
+  if err != nil || fraction <= 0 || fraction > 1 {
+    return 0, fmt.Errorf("bad sample rate %s (1/N or a fraction up to 1)", rate)
+  }
+  return int(math.Round(1 / fraction)), nil
+}
+
+// newEntryRule checks a rule from the config
+func newEntryRule (name string, when []string, action string, value string) (*entryRule, error) {
+  rule := &entryRule{ name: name, action: action, value: value }
+  if len(when) == 0 {
+    return nil, fmt.Errorf("rule %s has no conditions", name)
+  }
+  for _, condition := range when {
+    c, err := parseCondition(condition)
+    if err != nil {
+      return nil, fmt.Errorf("rule %s: %s", name, err)
+    }
+    rule.conditions = append(rule.conditions, c)
+  }
+
+  switch action {
+  case "ignore":
+  case "network", "site", "tag":
+    if value == "" {
+      return nil, fmt.Errorf("rule %s: %s needs a value", name, action)
+    }
+  case "sample":
+    every, err := sampleEvery(value)
+    if err != nil {
+      return nil, fmt.Errorf("rule %s: %s", name, err)
+    }
+    rule.every = every
+  default:
+    return nil, fmt.Errorf("rule %s: unknown action %q (ignore, network, site, tag or sample)", name, action)
+  }
+  return rule, nil
+}
+
+// splitWhen splits the legacy "a && b" conditions
+func splitWhen (when string) ([]string) {
+  var conditions []string
+  for _, condition := range strings.Split(when, "&&") {
+    if strings.TrimSpace(condition) != "" {
+      conditions = append(conditions, strings.TrimSpace(condition))
+    }
+  }
+  return conditions
+}
+
+// ruleField is the value a condition looks at - any field of the entry (without the quotes ParseAccess
+// leaves) or the network, vhost and site the entry has been given so far
+func ruleField (entry map[string]string, d *entryDecision, field string) (string) {
+  switch field {
+  case "network":
+    return d.Network
+  case "vhost":
+    return d.VHost
+  case "site":
+    return d.Site
+  }
+  return unquoteField(entry[field])
+}
+
+func conditionMatches (c ruleCondition, value string) (bool) {
+  matched := false
+  switch {
+  case c.re != nil:
+    matched = c.re.MatchString(value)
+  case c.op == "=":
+    matched = value == c.value
+  case c.nets != nil:
+    ipaddr := net.ParseIP(value)
+    for _, ipnet := range c.nets {
+      matched = matched || (ipaddr != nil && ipnet.Contains(ipaddr))
+    }
+  default:
+    number, err := strconv.ParseFloat(value, 64)
+    matched = err == nil && number >= c.min && number <= c.max
+  }
+  return matched != c.negate
+}
+
+func ruleMatches (rule *entryRule, entry map[string]string, d *entryDecision) (bool) {
+  for _, c := range rule.conditions {
+    if !conditionMatches(c, ruleField(entry, d, c.field)) {
+      return false
+    }
+  }
+  return true
+}
+
+// applyRules runs the rules over an entry after the network, vhost and site have been looked up.
+// ignore and a sample that leaves the entry out stop the rules after them.  Without samples every
+// entry is taken as the first match (so kept).
+func applyRules (config logConfig, entry map[string]string, d *entryDecision, samples sampleCounts) {
+  for num, rule := range config.rules {
+    if !ruleMatches(rule, entry, d) {
+      continue
+    }
+    d.Rules = append(d.Rules, num)
+
+    switch rule.action {
+    case "ignore":
+      d.Ignore, d.OnCampus, d.Zone = true, false, ""
+      return
+    case "network":
+      d.Network = rule.value
+    case "site":
+      d.Site = rule.value
+      d.IgnoreSite, d.TrackSite, d.SiteRule = findSiteRule(config, rule.value)
+    case "tag":
+      d.Tags = append(d.Tags, rule.value)
+    case "sample":
+      seen := samples[num]
+      if samples != nil {
+        samples[num]++
+      }
+      if seen % rule.every != 0 {
+        d.Drop = true
+        return
+      }
+    }
+  }
+}
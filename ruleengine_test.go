@@ -0,0 +1,190 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+const testRulesConfig = `
+networks:
+  - name: 10net
+    net: 10.0.0.0/8
+    track: [hosts, uri]
+
+sites:
+  - name: htbin
+    status: track
+  - name: probes
+    status: track
+
+rules:
+  - name: f5 probes
+    when: ["browser ~ ^F5-", "method = HEAD"]
+    action: ignore
+  - name: vpn
+    when: ["ip in 10.241.0.0/16"]
+    action: network
+    value: vpn
+  - name: errors
+    when: ["ret in 500..599"]
+    action: tag
+    value: error
+  - name: health
+    when: ["base_uri ~ ^/htbin/health"]
+    action: site
+    value: probes
+`
+
+func testRulesLine (ip string, request string, ret string, browser string) (string) {
+  return ip + ` - - [01/Sep/2017:00:00:08 -0400] "` + request + ` HTTP/1.1" ` + ret + ` 1000 0.007192 0.000000 0.000000 "-" "` + browser + `" 10673 + WajbSArxHDYAACmxCSUAAAVW 128.197.26.35 off:http`
+}
+
+func TestParseCondition (t *testing.T) {
+  for _, test := range []struct { condition string; value string; matches bool } {
+    { "base_uri ~ ^/healthz$", "/healthz", true },
+    { "base_uri !~ ^/healthz$", "/healthz", false },
+    { "method = HEAD", "HEAD", true },
+    { "method != HEAD", "GET", true },
+    { "ip in 10.231.9.0/24, 192.168.0.0/16", "192.168.1.1", true },
+    { "ip in 10.231.9.0/24", "10.231.10.1", false },
+    { "ip !in 10.231.9.0/24", "10.231.10.1", true },
+    { "ip in 10.231.9.0/24", "host.bu.edu", false },
+    { "ret in 500..599", "503", true },
+    { "ret in 500..599", "200", false },
+    { "size in 1000000..", "2000000", true },
+    { "elapsed in ..0.5", "0.007192", true },
+    { "elapsed in ..0.5", "-", false },
+    { "browser ~ with spaces here", "agent with spaces here", true },
+    { "method  =   HEAD", "HEAD", true },
+    { "\tret\tin\t500..599 ", "503", true },
+  } {
+    c, err := parseCondition(test.condition)
+    if err != nil {
+      t.Errorf("%s: error=%s", test.condition, err)
+      continue
+    }
+    if conditionMatches(c, test.value) != test.matches {
+      t.Errorf("%s on %s should be %t", test.condition, test.value, test.matches)
+    }
+  }
+}
+
+func TestEntryRuleErrors (t *testing.T) {
+  for _, test := range []struct { when []string; action string; value string; want string } {
+    { nil, "ignore", "", "no conditions" },
+    { []string{ "method HEAD" }, "ignore", "", "should be field op value" },
+    { []string{ "method =  " }, "ignore", "", "should be field op value" },
+    { []string{ "method == HEAD" }, "ignore", "", "unknown op" },
+    { []string{ "base_uri ~ (" }, "ignore", "", "missing closing" },
+    { []string{ "ip in 10.0.0.0/33" }, "ignore", "", "invalid CIDR" },
+    { []string{ "ret in 5xx..599" }, "ignore", "", "bad range" },
+    { []string{ "method = HEAD" }, "drop", "", "unknown action" },
+    { []string{ "method = HEAD" }, "tag", "", "needs a value" },
+    { []string{ "method = HEAD" }, "sample", "2", "bad sample rate" },
+  } {
+    _, err := newEntryRule("test", test.when, test.action, test.value)
+    if err == nil || !strings.Contains(err.Error(), test.want) {
+      t.Errorf("%v %s %s: expected %q got %v", test.when, test.action, test.value, test.want, err)
+    }
+  }
+}
+
+func TestSampleEvery (t *testing.T) {
+  for rate, every := range map[string]int{ "1/10": 10, "0.25": 4, "1": 1, "1/1": 1 } {
+    got, err := sampleEvery(rate)
+    if err != nil || got != every {
+      t.Errorf("%s: expected %d got %d (%v)", rate, every, got, err)
+    }
+  }
+}
+
+func TestApplyRules (t *testing.T) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.yaml", testRulesConfig))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  lines := []string {
+    testRulesLine("10.241.26.100", "GET /htbin/index.html", "200", "Mozilla"),
+    testRulesLine("10.1.2.3", "HEAD /", "200", "F5-Monitor"),
+    testRulesLine("10.1.2.3", "GET /", "200", "F5-Monitor"),
+    testRulesLine("10.1.2.3", "GET /htbin/health", "503", "curl"),
+  }
+  tracking := initTrackedOverall()
+  initRuleHits(&tracking, lc)
+  for num, line := range lines {
+    trackEntry(lc.config, &tracking, ParseAccess(num, line))
+  }
+
+  if tracking.Total != 4 || tracking.OnCampus + tracking.OffCampus != 3 {
+    t.Errorf("expected 4 requests with the F5 HEAD one ignored: %+v", tracking.campusSplit)
+  }
+  info := tracking.Tracked["_default"]
+  if info.Networks["vpn"].Total != 1 || info.Networks["10net"].Total != 2 {
+    t.Errorf("expected 10.241 to be relabelled vpn: %+v", info.Networks)
+  }
+  if info.Sites["probes"].Total != 1 || info.Sites["htbin"].Total != 1 {
+    t.Errorf("expected the health check under probes: %+v", info.Sites)
+  }
+  if info.Tags["error"].Total != 1 || len(info.Tags) != 1 {
+    t.Errorf("expected the 503 tagged error: %+v", info.Tags)
+  }
+
+  if rule := findRule(tracking.Rules, "rule", "f5 probes"); rule.Hits != 1 || rule.Match != "browser ~ ^F5- && method = HEAD" {
+    t.Errorf("wrong f5 probes rule %+v", rule)
+  }
+  if rule := findRule(tracking.Rules, "rule", "health"); rule.Hits != 1 || !strings.HasSuffix(rule.Where, ":25") {
+    t.Errorf("wrong health rule %+v", rule)
+  }
+}
+
+func TestSampleRule (t *testing.T) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.json", `[
+  { "name": "10net", "net": "10.0.0.0/8" },
+  { "rule": "static", "when": "base_uri ~ \\.html$ && ret = 200", "action": "sample", "value": "1/2" }
+]`))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  tracking := initTrackedOverall()
+  tracking.Meta = initSummaryMeta()
+  initRuleHits(&tracking, lc)
+  other := initTrackedOverall()
+  for num := 0; num < 5; num++ {
+    trackEntry(lc.config, &tracking, ParseAccess(num, testCSVLines[0]))
+    // explaining or exporting (or another scan) in between does not move the sampling of this one along
+    classifyEntry(lc.config, ParseAccess(num, testCSVLines[0]), nil)
+    classifyEntry(lc.config, ParseAccess(num, testCSVLines[0]), make(sampleCounts))
+    trackEntry(lc.config, &other, ParseAccess(num, testCSVLines[0]))
+  }
+
+  // the first match is kept then every second one
+  if tracking.Total != 3 || tracking.Meta.SampledOut != 2 {
+    t.Errorf("expected 3 kept and 2 sampled out: %d %d", tracking.Total, tracking.Meta.SampledOut)
+  }
+
+  // the report says the counts are only of the kept entries and what the rate was
+  var buf bytes.Buffer
+  tmpl, name, _ := loadReportTemplate("")
+  writeTextReport(&buf, tmpl, name, reportLimits{}, tracking)
+  if !strings.Contains(buf.String(), "### Sampled: 2 entries were left out by sample rules, every count is of the 3 kept (60.00 % of the entries)\n") ||
+    !strings.Contains(buf.String(), "###   rule static sample 1/2 matched 5 (") {
+    t.Errorf("the report should show the sampling:\n%s", buf.String())
+  }
+}
+
+func TestExplainRules (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.yaml", testRulesConfig)
+  out := testExplain(t, filename, ParseAccess(0, testRulesLine("10.241.26.100", "GET /htbin/health", "500", "curl")))
+
+  checkExplain(t, out, []string {
+    "rule       vpn matched (" + filename + ":17): network vpn",
+    "rule       errors matched (" + filename + ":21): tag error",
+    "rule       health matched (" + filename + ":25): site probes",
+    "network    10net (" + filename + ":3 10.0.0.0/8, the first entry containing 10.241.26.100)",
+    "site       htbin (from /htbin/health) is track (" + filename + ":8)",
+    "outcome    counted on campus in vhost _default under network vpn with its hosts and base_uri and site probes with its hosts and base_uri tagged error",
+  })
+}
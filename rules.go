@@ -0,0 +1,99 @@
+package main
+
+import (
+  "strconv"
+  "strings"
+)
+
+// ruleHit counts how often a network, vhost, site or rules entry of the config matched during the run
+type ruleHit struct {
+  // network, vhost, site or rule
+  Kind string
+  Name string
+  // the range of a network or the conditions of a rule
+  Match string `json:",omitempty"`
+  // file:line of the entry
+  Where string
+  Hits int
+  // what a rules entry does (sample 1/10, tag bots...)
+  Action string `json:",omitempty"`
+}
+
+// initRuleHits lists every rule of the config (in config order) so the ones that never match show up
+func initRuleHits (tracking *trackedOverall, lc loadedConfig) {
+  tracking.Rules = []ruleHit{}
+  tracking.ruleIndex = make(map[string]int)
+  add := func(key string, hit ruleHit) {
+    if num, ok := tracking.ruleIndex[key]; ok {
+      // a later vhost/site entry with the same name is the one that counts
+      tracking.Rules[num] = hit
+      return
+    }
+    tracking.ruleIndex[key] = len(tracking.Rules)
+    tracking.Rules = append(tracking.Rules, hit)
+  }
+
+  for num, item := range lc.config.ipranges {
+    if item.net == nil {
+      continue
+    }
+    add("network:" + strconv.Itoa(num), ruleHit{ "network", item.name, item.net.String(), configWhere(lc, "networks", num), 0, "" })
+  }
+  for num, item := range lc.typed.VHosts {
+    add("vhost:" + item.Name, ruleHit{ "vhost", item.Name, "", configWhere(lc, "vhosts", num), 0, "" })
+  }
+  for num, item := range lc.typed.Sites {
+    add("site:" + item.Name, ruleHit{ "site", item.Name, "", configWhere(lc, "sites", num), 0, "" })
+  }
+  for num, item := range lc.typed.Rules {
+    add("rule:" + strconv.Itoa(num), ruleHit{ "rule", item.Name, strings.Join(item.When, " && "), configWhere(lc, "rules", num), 0,
+      strings.TrimSpace(item.Action + " " + item.Value) })
+  }
+}
+
+func countRule (tracking *trackedOverall, key string) {
+  if num, ok := tracking.ruleIndex[key]; ok {
+    tracking.Rules[num].Hits++
+  }
+}
+
+// countRules records the rules that decided an entry (every one that matched, even when the vhost is ignored)
+func countRules (tracking *trackedOverall, d entryDecision) {
+  if tracking.ruleIndex == nil {
+    return
+  }
+  if d.NetworkRule >= 0 {
+    countRule(tracking, "network:" + strconv.Itoa(d.NetworkRule))
+  }
+  if d.VHostRule != "" {
+    countRule(tracking, "vhost:" + d.VHostRule)
+  }
+  if d.SiteRule != "" {
+    countRule(tracking, "site:" + d.SiteRule)
+  }
+  for _, num := range d.Rules {
+    countRule(tracking, "rule:" + strconv.Itoa(num))
+  }
+}
+
+// sampleRules are the sample rules of the run (they have their rate in Action)
+func sampleRules (rules []ruleHit) ([]ruleHit) {
+  var samples []ruleHit
+  for _, rule := range rules {
+    if rule.Kind == "rule" && strings.HasPrefix(rule.Action, "sample ") {
+      samples = append(samples, rule)
+    }
+  }
+  return samples
+}
+
+// unusedRules are the rules that never matched
+func unusedRules (rules []ruleHit) ([]ruleHit) {
+  var unused []ruleHit
+  for _, rule := range rules {
+    if rule.Hits == 0 {
+      unused = append(unused, rule)
+    }
+  }
+  return unused
+}
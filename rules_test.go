@@ -0,0 +1,117 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+func testRuleTracking (t *testing.T, lines []string) (trackedOverall) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.json", testExplainConfig))
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+
+  tracking := initTrackedOverall()
+  initRuleHits(&tracking, lc)
+  for num, line := range lines {
+    trackEntry(lc.config, &tracking, ParseAccess(num, line))
+  }
+  return tracking
+}
+
+func findRule (rules []ruleHit, kind string, name string) (ruleHit) {
+  for _, rule := range rules {
+    if rule.Kind == kind && rule.Name == name {
+      return rule
+    }
+  }
+  return ruleHit{ Hits: -1 }
+}
+
+func TestRuleHits (t *testing.T) {
+  tracking := testRuleTracking(t, testCSVLines)
+
+  if len(tracking.Rules) != 4 {
+    t.Errorf("expected 2 networks, a vhost and a site: %+v", tracking.Rules)
+  }
+  if rule := findRule(tracking.Rules, "network", "10net"); rule.Hits != 2 || rule.Match != "10.0.0.0/8" || !strings.HasSuffix(rule.Where, ":4") {
+    t.Errorf("wrong 10net rule %+v", rule)
+  }
+  if rule := findRule(tracking.Rules, "site", "htbin"); rule.Hits != 3 {
+    t.Errorf("wrong htbin rule %+v", rule)
+  }
+
+  unused := unusedRules(tracking.Rules)
+  if len(unused) != 2 || unused[0].Name != "ignore:F5-1" || unused[1].Name != "testdomain1" {
+    t.Errorf("wrong unused rules %+v", unused)
+  }
+}
+
+func TestRuleHitsIgnoredVHost (t *testing.T) {
+  // the vhost rule matches even though the entry is then ignored
+  line := strings.Replace(testCSVLines[0], "off:http", "off:http x testdomain1", 1)
+  tracking := testRuleTracking(t, []string{ line })
+
+  if rule := findRule(tracking.Rules, "vhost", "testdomain1"); rule.Hits != 1 {
+    t.Errorf("wrong testdomain1 rule %+v", rule)
+  }
+  if _, ok := tracking.Tracked["testdomain1"]; ok {
+    t.Errorf("ignored vhost was tracked")
+  }
+}
+
+func TestRulesReport (t *testing.T) {
+  tracking := testRuleTracking(t, testCSVLines)
+
+  tmpl, name, err := loadReportTemplate("")
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  // only when asked for (it is long for a real config and config lint -fromjson has it too)
+  var buf bytes.Buffer
+  writeTextReport(&buf, tmpl, name, reportLimits{}, tracking)
+  if strings.Contains(buf.String(), "never matched") {
+    t.Errorf("rules section without -unusedrules:\n%s", buf.String())
+  }
+
+  buf.Reset()
+  writeTextReport(&buf, tmpl, name, reportLimits{ unusedRules: true }, tracking)
+  if !strings.Contains(buf.String(), "*** config rules that never matched (2 of 4)\n  network ignore:F5-1 10.231.9.92/32 (") {
+    t.Errorf("missing rules section:\n%s", buf.String())
+  }
+
+  // no section without rule hits (summaries from before they were counted)
+  tracking.Rules = nil
+  buf.Reset()
+  writeTextReport(&buf, tmpl, name, reportLimits{ unusedRules: true }, tracking)
+  if strings.Contains(buf.String(), "never matched") {
+    t.Errorf("rules section without rules")
+  }
+}
+
+func TestLintUnusedRules (t *testing.T) {
+  filename := testConfigFile(t, "ipnets.json", testExplainConfig)
+  lc, err := loadConfig(filename)
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  tracking := initTrackedOverall()
+  initRuleHits(&tracking, lc)
+  for num, line := range testCSVLines {
+    trackEntry(lc.config, &tracking, ParseAccess(num, line))
+  }
+
+  var buf bytes.Buffer
+  jsonTracked(&buf, tracking)
+  summary := testConfigFile(t, "summary.json", buf.String())
+
+  issues, err := lintUnusedRules(filename, summary)
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  if len(issues) != 2 || issues[0].level != "warning" || issues[0].line == 0 ||
+    !strings.HasPrefix(issues[0].message, "network ignore:F5-1 10.231.9.92/32 never matched in ") {
+    t.Errorf("wrong issues %+v", issues)
+  }
+}
@@ -26,10 +26,19 @@ if [ "x$DAY" = x ]; then
   DAY='*'
 fi
 
+# a landscape can have its own config (usually an overlay that includes the shared networks)
+CONFIG=""
+for f in "${dir}/ipnets-${LANDSCAPE}".{json,yaml,yml,toml}; do
+  if [ -f "$f" ]; then
+    CONFIG="-config $f"
+    break
+  fi
+done
+
 if [ "$ACTION" = "list" ]; then
   ls -l /archive/ServerLogs/usoftware/logs/apache/wp-w3v-${LANDSCAPE}/$YEAR/$MONTH/$DAY/access_log*gz
 elif [ "$ACTION" = cat ]; then
   zcat /archive/ServerLogs/usoftware/logs/apache/wp-w3v-${LANDSCAPE}/$YEAR/$MONTH/$DAY/access_log*gz
 else
-  zcat /archive/ServerLogs/usoftware/logs/apache/wp-w3v-${LANDSCAPE}/$YEAR/$MONTH/$DAY/access_log*gz | "${dir}/httplogs"
+  zcat /archive/ServerLogs/usoftware/logs/apache/wp-w3v-${LANDSCAPE}/$YEAR/$MONTH/$DAY/access_log*gz | "${dir}/httplogs" $CONFIG
 fi
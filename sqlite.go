@@ -0,0 +1,476 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os/exec"
+  "strings"
+)
+
+// We talk to the sqlite3 command line tool rather than linking a driver in so the build stays
+// pure Go.  Every table is keyed on the period so a month can be rewritten (or upserted into)
+// without touching the others.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS periods (
+  period TEXT PRIMARY KEY,
+  schema_version INTEGER,
+  tool_version TEXT,
+  generated TEXT,
+  period_start TEXT,
+  period_end TEXT,
+  lines INTEGER,
+  parse_errors INTEGER,
+  config_hash TEXT
+);
+CREATE TABLE IF NOT EXISTS entries (
+  period TEXT,
+  vhost TEXT,
+  kind TEXT,
+  label TEXT,
+  number INTEGER,
+  track_hosts INTEGER,
+  track_uri INTEGER,
+  total INTEGER,
+  total_bytes INTEGER,
+  on_campus INTEGER,
+  on_campus_bytes INTEGER,
+  off_campus INTEGER,
+  off_campus_bytes INTEGER,
+  PRIMARY KEY (period, vhost, kind, label)
+);
+CREATE TABLE IF NOT EXISTS hosts (
+  period TEXT,
+  vhost TEXT,
+  kind TEXT,
+  label TEXT,
+  host TEXT,
+  requests INTEGER,
+  PRIMARY KEY (period, vhost, kind, label, host)
+);
+CREATE TABLE IF NOT EXISTS base_uri (
+  period TEXT,
+  vhost TEXT,
+  kind TEXT,
+  label TEXT,
+  base_uri TEXT,
+  requests INTEGER,
+  PRIMARY KEY (period, vhost, kind, label, base_uri)
+);
+CREATE TABLE IF NOT EXISTS timeline (
+  period TEXT,
+  vhost TEXT,
+  hour TEXT,
+  total INTEGER,
+  total_bytes INTEGER,
+  on_campus INTEGER,
+  on_campus_bytes INTEGER,
+  off_campus INTEGER,
+  off_campus_bytes INTEGER,
+  PRIMARY KEY (period, vhost, hour)
+);
+CREATE TABLE IF NOT EXISTS extras (
+  period TEXT,
+  vhost TEXT,
+  kind TEXT,
+  label TEXT,
+  data TEXT,
+  PRIMARY KEY (period, vhost, kind, label)
+);
+CREATE TABLE IF NOT EXISTS rules (
+  period TEXT,
+  num INTEGER,
+  kind TEXT,
+  name TEXT,
+  match TEXT,
+  location TEXT,
+  hits INTEGER,
+  action TEXT,
+  PRIMARY KEY (period, num)
+);
+`
+
+var sqliteTables = []string{ "periods", "entries", "hosts", "base_uri", "timeline", "extras", "rules" }
+
+// sqliteExtras are the optional parts of the summary - they are stored as json since nothing queries into them.
+// The overall row also has the whole Meta (the periods table only has the columns worth querying).
+type sqliteExtras struct {
+  Meta *summaryMeta `json:",omitempty"`
+  CrossTab map[string]map[string]crossTabCell `json:",omitempty"`
+  Paths *pathNode `json:",omitempty"`
+  Latency *latencyHistogram `json:",omitempty"`
+  Tags map[string]campusSplit `json:",omitempty"`
+  Query *queryStats `json:",omitempty"`
+}
+
+// sqlQuote makes a string literal (the sqlite3 tool reads statements so NULs have to go)
+func sqlQuote (value string) (string) {
+  value = strings.Replace(value, "\x00", "", -1)
+  return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+func sqlBool (value bool) (int) {
+  if value {
+    return 1
+  }
+  return 0
+}
+
+// summaryPeriod is the month the summary starts in (2017-09) unless a period is given
+func summaryPeriod (period string, tracking trackedOverall) (string, error) {
+  if period != "" {
+    return period, nil
+  }
+  if tracking.Meta != nil && len(tracking.Meta.PeriodStart) >= 7 {
+    return tracking.Meta.PeriodStart[:7], nil
+  }
+  return "", fmt.Errorf("no period in the summary - use -period")
+}
+
+func sqlEntry (w io.Writer, period string, vhost string, kind string, label string, number int, trackHosts bool, trackURI bool, split campusSplit) {
+  fmt.Fprintf(w, "INSERT INTO entries VALUES (%s, %s, %s, %s, %d, %d, %d, %d, %d, %d, %d, %d, %d);\n",
+    sqlQuote(period), sqlQuote(vhost), sqlQuote(kind), sqlQuote(label), number, sqlBool(trackHosts), sqlBool(trackURI),
+    split.Total, split.TotalBytes, split.OnCampus, split.OnCampusBytes, split.OffCampus, split.OffCampusBytes)
+}
+
+func sqlTimeline (w io.Writer, period string, vhost string, timeline map[string]campusSplit) {
+  for hour, split := range timeline {
+    fmt.Fprintf(w, "INSERT INTO timeline VALUES (%s, %s, %s, %d, %d, %d, %d, %d, %d);\n",
+      sqlQuote(period), sqlQuote(vhost), sqlQuote(hour),
+      split.Total, split.TotalBytes, split.OnCampus, split.OnCampusBytes, split.OffCampus, split.OffCampusBytes)
+  }
+}
+
+// sqlExtras stores the optional parts (nothing when there are none)
+func sqlExtras (w io.Writer, period string, vhost string, kind string, label string, extras sqliteExtras) {
+  if extras.Meta == nil && len(extras.CrossTab) == 0 && extras.Paths == nil && extras.Latency == nil && len(extras.Tags) == 0 && extras.Query == nil {
+    return
+  }
+  if data, err := json.Marshal(extras); err == nil {
+    fmt.Fprintf(w, "INSERT INTO extras VALUES (%s, %s, %s, %s, %s);\n",
+      sqlQuote(period), sqlQuote(vhost), sqlQuote(kind), sqlQuote(label), sqlQuote(string(data)))
+  }
+}
+
+func sqlTrackedData (w io.Writer, period string, vhost string, kind string, data map[string]trackedData) {
+  for label, v := range data {
+    sqlEntry(w, period, vhost, kind, label, v.NumRequests, v.TrackHosts, v.TrackURI, v.campusSplit)
+    sqlExtras(w, period, vhost, kind, label, sqliteExtras{ Query: v.Query })
+    for host, requests := range v.Hosts {
+      fmt.Fprintf(w, "INSERT INTO hosts VALUES (%s, %s, %s, %s, %s, %d);\n",
+        sqlQuote(period), sqlQuote(vhost), sqlQuote(kind), sqlQuote(label), sqlQuote(host), requests)
+    }
+    for base_uri, requests := range v.Base_uri {
+      if base_uri != "_total" {
+        fmt.Fprintf(w, "INSERT INTO base_uri VALUES (%s, %s, %s, %s, %s, %d);\n",
+          sqlQuote(period), sqlQuote(vhost), sqlQuote(kind), sqlQuote(label), sqlQuote(base_uri), requests)
+      }
+    }
+  }
+}
+
+// sqliteStatements writes the sql that replaces everything stored for the period
+func sqliteStatements (w io.Writer, period string, tracking trackedOverall) {
+  fmt.Fprintf(w, "%s\nBEGIN;\n", sqliteSchema)
+  for _, table := range sqliteTables {
+    fmt.Fprintf(w, "DELETE FROM %s WHERE period = %s;\n", table, sqlQuote(period))
+  }
+
+  meta := tracking.Meta
+  if meta == nil {
+    meta = &summaryMeta{}
+  }
+  fmt.Fprintf(w, "INSERT INTO periods VALUES (%s, %d, %s, %s, %s, %s, %d, %d, %s);\n",
+    sqlQuote(period), tracking.SchemaVersion, sqlQuote(meta.ToolVersion), sqlQuote(meta.Generated),
+    sqlQuote(meta.PeriodStart), sqlQuote(meta.PeriodEnd), meta.Lines, meta.ParseErrors, sqlQuote(meta.ConfigHash))
+
+  sqlEntry(w, period, "", "overall", "", tracking.Total, false, false, tracking.campusSplit)
+  sqlTimeline(w, period, "", tracking.Timeline)
+  sqlExtras(w, period, "", "overall", "", sqliteExtras{ Meta: tracking.Meta, Tags: tracking.Tags })
+  for num, rule := range tracking.Rules {
+    fmt.Fprintf(w, "INSERT INTO rules VALUES (%s, %d, %s, %s, %s, %s, %d, %s);\n", sqlQuote(period), num,
+      sqlQuote(rule.Kind), sqlQuote(rule.Name), sqlQuote(rule.Match), sqlQuote(rule.Where), rule.Hits, sqlQuote(rule.Action))
+  }
+  for vhost, v := range tracking.Tracked {
+    sqlEntry(w, period, vhost, "vhost", "", v.Number, false, false, v.campusSplit)
+    sqlTimeline(w, period, vhost, v.Timeline)
+    sqlExtras(w, period, vhost, "vhost", "", sqliteExtras{ CrossTab: v.CrossTab, Paths: v.Paths, Latency: v.Latency, Tags: v.Tags })
+    sqlTrackedData(w, period, vhost, "network", v.Networks)
+    sqlTrackedData(w, period, vhost, "site", v.Sites)
+  }
+
+  fmt.Fprintf(w, "COMMIT;\n")
+}
+
+// sqliteWrite stores the aggregates for the period in db (replacing what was there for that period)
+func sqliteWrite (sqlite3 string, db string, period string, tracking trackedOverall) (error) {
+  period, err := summaryPeriod(period, tracking)
+  if err != nil {
+    return err
+  }
+
+  var stderr bytes.Buffer
+  cmd := exec.Command(sqlite3, "-bail", db)
+  cmd.Stderr = &stderr
+  stdin, err := cmd.StdinPipe()
+  if err != nil {
+    return err
+  }
+  err = cmd.Start()
+  if err != nil {
+    return err
+  }
+
+  w := bufio.NewWriter(stdin)
+  sqliteStatements(w, period, tracking)
+  w.Flush()
+  stdin.Close()
+
+  err = cmd.Wait()
+  if err != nil {
+    return fmt.Errorf("%s: %s %s", sqlite3, err, stderr.String())
+  }
+  return nil
+}
+
+// sqliteQuery runs a select and decodes the rows (sqlite3 prints nothing at all for no rows)
+func sqliteQuery (sqlite3 string, db string, query string, rows interface{}) (error) {
+  var stderr bytes.Buffer
+  cmd := exec.Command(sqlite3, "-bail", "-readonly", "-json", db, query)
+  cmd.Stderr = &stderr
+  out, err := cmd.Output()
+  if err != nil {
+    return fmt.Errorf("%s: %s %s", sqlite3, err, stderr.String())
+  }
+  if len(bytes.TrimSpace(out)) == 0 {
+    return nil
+  }
+  return json.Unmarshal(out, rows)
+}
+
+type sqliteSplit struct {
+  Total int `json:"total"`
+  TotalBytes int64 `json:"total_bytes"`
+  OnCampus int `json:"on_campus"`
+  OnCampusBytes int64 `json:"on_campus_bytes"`
+  OffCampus int `json:"off_campus"`
+  OffCampusBytes int64 `json:"off_campus_bytes"`
+}
+
+func sqliteToSplit (split sqliteSplit) (campusSplit) {
+  return campusSplit{ split.Total, split.TotalBytes, split.OnCampus, split.OnCampusBytes, split.OffCampus, split.OffCampusBytes }
+}
+
+type sqliteEntryRow struct {
+  sqliteSplit
+  Vhost string `json:"vhost"`
+  Kind string `json:"kind"`
+  Label string `json:"label"`
+  Number int `json:"number"`
+  TrackHosts int `json:"track_hosts"`
+  TrackURI int `json:"track_uri"`
+}
+
+type sqliteCountRow struct {
+  Vhost string `json:"vhost"`
+  Kind string `json:"kind"`
+  Label string `json:"label"`
+  Key string `json:"key"`
+  Requests int `json:"requests"`
+}
+
+type sqliteExtrasRow struct {
+  Vhost string `json:"vhost"`
+  Kind string `json:"kind"`
+  Label string `json:"label"`
+  Data string `json:"data"`
+}
+
+type sqliteTimelineRow struct {
+  sqliteSplit
+  Vhost string `json:"vhost"`
+  Hour string `json:"hour"`
+}
+
+type sqliteRuleRow struct {
+  Kind string `json:"kind"`
+  Name string `json:"name"`
+  Match string `json:"match"`
+  Location string `json:"location"`
+  Hits int `json:"hits"`
+  Action string `json:"action"`
+}
+
+type sqlitePeriodRow struct {
+  SchemaVersion int `json:"schema_version"`
+  ToolVersion string `json:"tool_version"`
+  Generated string `json:"generated"`
+  PeriodStart string `json:"period_start"`
+  PeriodEnd string `json:"period_end"`
+  Lines int `json:"lines"`
+  ParseErrors int `json:"parse_errors"`
+  ConfigHash string `json:"config_hash"`
+}
+
+// sqliteHasTable is false for the tables a database written by an older build does not have yet
+func sqliteHasTable (sqlite3 string, db string, table string) (bool, error) {
+  var rows []struct { Name string `json:"name"` }
+  err := sqliteQuery(sqlite3, db, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = " + sqlQuote(table), &rows)
+  return len(rows) > 0, err
+}
+
+// sqliteTrackedMap finds the networks or sites of a vhost (creating the vhost if it is missing)
+func sqliteTrackedMap (tracking *trackedOverall, vhost string, kind string) (map[string]trackedData) {
+  info, isPresent := tracking.Tracked[vhost]
+  if ! isPresent {
+    info = initTrackedInfo()
+    tracking.Tracked[vhost] = info
+  }
+
+  if kind == "site" {
+    return info.Sites
+  }
+  return info.Networks
+}
+
+// sqliteRead rebuilds the summary for a period from db
+func sqliteRead (sqlite3 string, db string, period string) (trackedOverall, error) {
+  tracking := initTrackedOverall()
+  if period == "" {
+    return tracking, fmt.Errorf("reading from sqlite needs a -period")
+  }
+  where := " WHERE period = " + sqlQuote(period)
+
+  var periods []sqlitePeriodRow
+  err := sqliteQuery(sqlite3, db, "SELECT * FROM periods" + where, &periods)
+  if err != nil {
+    return tracking, err
+  }
+  if len(periods) == 0 {
+    return tracking, fmt.Errorf("period %s is not in %s", period, db)
+  }
+  p := periods[0]
+  tracking.SchemaVersion = p.SchemaVersion
+  tracking.Meta = &summaryMeta{ ToolVersion: p.ToolVersion, Generated: p.Generated, PeriodStart: p.PeriodStart,
+    PeriodEnd: p.PeriodEnd, InputFiles: []string{ db }, Lines: p.Lines, ParseErrors: p.ParseErrors, ConfigHash: p.ConfigHash }
+
+  // the vhosts sort first so they exist before their networks and sites
+  var entries []sqliteEntryRow
+  err = sqliteQuery(sqlite3, db, "SELECT * FROM entries" + where + " ORDER BY kind = 'vhost' DESC", &entries)
+  if err != nil {
+    return tracking, err
+  }
+  for _, row := range entries {
+    switch row.Kind {
+    case "overall":
+      tracking.campusSplit = sqliteToSplit(row.sqliteSplit)
+    case "vhost":
+      info := initTrackedInfo()
+      info.campusSplit = sqliteToSplit(row.sqliteSplit)
+      info.Number = row.Number
+      tracking.Tracked[row.Vhost] = info
+    default:
+      data := initTrackedData(row.TrackHosts != 0, row.TrackURI != 0)
+      data.campusSplit = sqliteToSplit(row.sqliteSplit)
+      data.NumRequests = row.Number
+      data.Base_uri["_total"] = row.Number
+      sqliteTrackedMap(&tracking, row.Vhost, row.Kind)[row.Label] = data
+    }
+  }
+
+  for _, table := range []string{ "hosts", "base_uri" } {
+    var counts []sqliteCountRow
+    column := table
+    if table == "hosts" {
+      column = "host"
+    }
+    query := "SELECT vhost, kind, label, " + column + " AS key, requests FROM " + table + where
+    err = sqliteQuery(sqlite3, db, query, &counts)
+    if err != nil {
+      return tracking, err
+    }
+    for _, row := range counts {
+      // a hand edited (or half written) database can have counts without their entries row
+      entries := sqliteTrackedMap(&tracking, row.Vhost, row.Kind)
+      data, isPresent := entries[row.Label]
+      if ! isPresent {
+        data = initTrackedData(table == "hosts", table == "base_uri")
+        entries[row.Label] = data
+      }
+      if table == "hosts" {
+        data.Hosts[row.Key] = row.Requests
+      } else {
+        data.Base_uri[row.Key] = row.Requests
+      }
+    }
+  }
+
+  var timeline []sqliteTimelineRow
+  err = sqliteQuery(sqlite3, db, "SELECT * FROM timeline" + where, &timeline)
+  if err != nil {
+    return tracking, err
+  }
+  for _, row := range timeline {
+    if row.Vhost == "" {
+      tracking.Timeline[row.Hour] = sqliteToSplit(row.sqliteSplit)
+    } else if info, isPresent := tracking.Tracked[row.Vhost]; isPresent {
+      info.Timeline[row.Hour] = sqliteToSplit(row.sqliteSplit)
+    }
+  }
+
+  // extras and rules are read when the database has them
+  var extras []sqliteExtrasRow
+  present, err := sqliteHasTable(sqlite3, db, "extras")
+  if err == nil && present {
+    err = sqliteQuery(sqlite3, db, "SELECT vhost, kind, label, data FROM extras" + where, &extras)
+  }
+  if err != nil {
+    return tracking, err
+  }
+  for _, row := range extras {
+    var item sqliteExtras
+    err = json.Unmarshal([]byte(row.Data), &item)
+    if err != nil {
+      return tracking, fmt.Errorf("extras %s %s %s: %s", row.Vhost, row.Kind, row.Label, err)
+    }
+    switch row.Kind {
+    case "overall":
+      tracking.Tags = item.Tags
+      if item.Meta != nil {
+        tracking.Meta = item.Meta
+      }
+    case "vhost":
+      info, isPresent := tracking.Tracked[row.Vhost]
+      if ! isPresent {
+        continue
+      }
+      if item.CrossTab != nil {
+        info.CrossTab = item.CrossTab
+      }
+      info.Paths, info.Latency, info.Tags = item.Paths, item.Latency, item.Tags
+      tracking.Tracked[row.Vhost] = info
+    default:
+      entries := sqliteTrackedMap(&tracking, row.Vhost, row.Kind)
+      if data, isPresent := entries[row.Label]; isPresent {
+        data.Query = item.Query
+        entries[row.Label] = data
+      }
+    }
+  }
+
+  var rules []sqliteRuleRow
+  present, err = sqliteHasTable(sqlite3, db, "rules")
+  if err == nil && present {
+    err = sqliteQuery(sqlite3, db, "SELECT kind, name, match, location, hits, action FROM rules" + where + " ORDER BY num", &rules)
+  }
+  if err != nil {
+    return tracking, err
+  }
+  for _, row := range rules {
+    tracking.Rules = append(tracking.Rules, ruleHit{ row.Kind, row.Name, row.Match, row.Location, row.Hits, row.Action })
+  }
+
+  return tracking, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+  "os/exec"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+func TestSQLQuote (t *testing.T) {
+  if quoted := sqlQuote("/met/o'brien\x00"); quoted != "'/met/o''brien'" {
+    t.Errorf("sqlQuote: got %s", quoted)
+  }
+}
+
+func TestSummaryPeriod (t *testing.T) {
+  tracking := initTrackedOverall()
+  if _, err := summaryPeriod("", tracking); err == nil {
+    t.Errorf("no meta and no period should be an error")
+  }
+
+  tracking.Meta = &summaryMeta{ PeriodStart: "2017-09-01T00" }
+  if period, _ := summaryPeriod("", tracking); period != "2017-09" {
+    t.Errorf("period should default to the month: %s", period)
+  }
+  if period, _ := summaryPeriod("2017-q3", tracking); period != "2017-q3" {
+    t.Errorf("the given period should win: %s", period)
+  }
+}
+
+func TestSQLiteRoundTrip (t *testing.T) {
+  sqlite3, err := exec.LookPath("sqlite3")
+  if err != nil {
+    t.Skip("no sqlite3 tool installed")
+  }
+
+  tracking, _ := testTrackStuff(t, testHTMLLines, 1, 1000)
+  finishSummary(&tracking)
+  db := filepath.Join(t.TempDir(), "test.db")
+
+  // the optional parts have to come back too so the report from sqlite is the live one
+  tracking.Tags = map[string]campusSplit{ "team=web": tracking.campusSplit }
+  tracking.Rules = []ruleHit{ { "network", "10net", "10.0.0.0/8", "ipnets.yaml:3", 2, "" },
+    { "rule", "static", "base_uri ~ \\.js$", "ipnets.yaml:9", 0, "sample 1/10" } }
+  tracking.Meta.ConfigIncludes = []string{ "shared.yaml" }
+  tracking.Meta.SampledOut = 7
+  tracking.Meta.Reloads = []configReload{ { Time: "2017-09-01T10:12:00-04:00", Line: 2, Reason: "signal",
+    DroppedRules: []ruleHit{ { "site", "met", "", "ipnets.yaml:5", 1, "" } } } }
+  for vhost, info := range tracking.Tracked {
+    info.Paths = initPathNode()
+    trackPath(info.Paths, "/htbin/index.html", 2, 100)
+    info.Latency = &latencyHistogram{ Count: 1, Sum: 0.5, Buckets: make([]int, len(latencyBounds)+1) }
+    trackCrossTab(info.CrossTab, "10net", "htbin", 100)
+    for site, data := range info.Sites {
+      data.Query = initQueryStats()
+      trackQuery(data.Query, "/htbin/index.html", "ver=1")
+      info.Sites[site] = data
+    }
+    tracking.Tracked[vhost] = info
+  }
+
+  // writing the same period twice has to replace it rather than fail on the keys
+  for i := 0; i < 2; i++ {
+    err = sqliteWrite(sqlite3, db, "", tracking)
+    if err != nil {
+      t.Errorf("error=%s", err)
+      return
+    }
+  }
+
+  read, err := sqliteRead(sqlite3, db, "2017-09")
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+
+  if read.campusSplit != tracking.campusSplit {
+    t.Errorf("overall split differs: %+v %+v", read.campusSplit, tracking.campusSplit)
+  }
+  if ! reflect.DeepEqual(read.Timeline, tracking.Timeline) {
+    t.Errorf("timeline differs: %+v %+v", read.Timeline, tracking.Timeline)
+  }
+  for vhost, info := range tracking.Tracked {
+    got := read.Tracked[vhost]
+    if got.campusSplit != info.campusSplit || got.Number != info.Number {
+      t.Errorf("vhost %s differs: %+v %+v", vhost, got, info)
+    }
+    if ! reflect.DeepEqual(got.Networks, info.Networks) || ! reflect.DeepEqual(got.Sites, info.Sites) {
+      t.Errorf("vhost %s networks/sites differ:\n%+v\n%+v", vhost, got, info)
+    }
+    if ! reflect.DeepEqual(got.CrossTab, info.CrossTab) || ! reflect.DeepEqual(got.Paths, info.Paths) || ! reflect.DeepEqual(got.Latency, info.Latency) {
+      t.Errorf("vhost %s extras differ:\n%+v\n%+v", vhost, got, info)
+    }
+  }
+  if ! reflect.DeepEqual(read.Tags, tracking.Tags) {
+    t.Errorf("tags differ: %+v %+v", read.Tags, tracking.Tags)
+  }
+  if ! reflect.DeepEqual(read.Rules, tracking.Rules) || ! reflect.DeepEqual(read.Meta, tracking.Meta) {
+    t.Errorf("rules or meta differ:\n%+v %+v\n%+v %+v", read.Rules, read.Meta, tracking.Rules, tracking.Meta)
+  }
+
+  // a database from before the extras and rules tables still reads
+  old := filepath.Join(t.TempDir(), "old.db")
+  err = sqliteWrite(sqlite3, old, "", tracking)
+  if err == nil {
+    err = exec.Command(sqlite3, old, "DROP TABLE extras; DROP TABLE rules").Run()
+  }
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  read, err = sqliteRead(sqlite3, old, "2017-09")
+  if err != nil || read.campusSplit != tracking.campusSplit || read.Meta.ConfigHash != tracking.Meta.ConfigHash || len(read.Rules) != 0 {
+    t.Errorf("old database did not read: %v %+v", err, read.Meta)
+  }
+
+  // counts without their entries row get an entry instead of crashing the report
+  err = exec.Command(sqlite3, db, "INSERT INTO hosts VALUES ('2017-09', '_default', 'network', 'orphan', '10.1.2.3', 4)").Run()
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  read, err = sqliteRead(sqlite3, db, "2017-09")
+  if err != nil || read.Tracked["_default"].Networks["orphan"].Hosts["10.1.2.3"] != 4 {
+    t.Errorf("orphan hosts row was not kept: %v %+v", err, read.Tracked["_default"].Networks["orphan"])
+  }
+
+  if _, err := sqliteRead(sqlite3, db, "2001-01"); err == nil {
+    t.Errorf("a missing period should be an error")
+  }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+  "compress/gzip"
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "io"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// summarySchemaVersion is the version of the json written by jsonTracked.  Version 1 is the
+// original unversioned json (no SchemaVersion or Meta) which readTracked upgrades when it loads it.
+const summarySchemaVersion = 2
+
+// toolVersion can be set when building with -ldflags "-X main.toolVersion=1.2.3"
+var toolVersion = "dev"
+
+// summaryMeta describes where a summary came from so summaries can be merged safely
+type summaryMeta struct {
+  ToolVersion string
+  Generated string
+  // first and last hour (2017-09-01T00) seen in the logs
+  PeriodStart string
+  PeriodEnd string
+  // log files read (- is stdin)
+  InputFiles []string
+  Lines int
+  ParseErrors int
+  ConfigFile string
+  // sha256 of the config file contents (and of the files it includes)
+  ConfigHash string
+  // the files ConfigFile includes in the order they were layered
+  ConfigIncludes []string `json:",omitempty"`
+  // entries a sample rule left out of the counts
+  SampledOut int `json:",omitempty"`
+  // configs loaded by -reload during the run (see reload.go)
+  Reloads []configReload `json:",omitempty"`
+  // set when readTracked upgraded an older summary (the version it came from)
+  UpgradedFrom int `json:",omitempty"`
+}
+
+func initSummaryMeta () (*summaryMeta) {
+  return &summaryMeta{ ToolVersion: toolVersion }
+}
+
+func hashConfig (data []byte) (string) {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+// timelinePeriod returns the first and last hour in the timeline
+func timelinePeriod (timeline map[string]campusSplit) (string, string) {
+  var buckets []string
+  for bucket := range timeline {
+    buckets = append(buckets, bucket)
+  }
+  if len(buckets) == 0 {
+    return "", ""
+  }
+
+  sort.Strings(buckets)
+  return buckets[0], buckets[len(buckets)-1]
+}
+
+// finishSummary fills in the parts of the meta that are only known after the logs are read
+func finishSummary (tracking *trackedOverall) {
+  tracking.SchemaVersion = summarySchemaVersion
+  if tracking.Meta == nil {
+    tracking.Meta = initSummaryMeta()
+  }
+  tracking.Meta.Generated = time.Now().Format(time.RFC3339)
+  tracking.Meta.PeriodStart, tracking.Meta.PeriodEnd = timelinePeriod(tracking.Timeline)
+}
+
+// upgradeTracked brings a summary loaded from json up to the current schema version
+func upgradeTracked (tracking *trackedOverall) (error) {
+  if tracking.SchemaVersion > summarySchemaVersion {
+    return fmt.Errorf("summary schema version %d is newer than this build understands (%d)", tracking.SchemaVersion, summarySchemaVersion)
+  }
+
+  if tracking.SchemaVersion == 0 {
+    // version 1 had no meta at all so all we know is what we can work out from the counts - the Total is
+    // the tracked entries and not the lines read so Lines (and ParseErrors) stay 0 for unknown
+    tracking.SchemaVersion = 1
+    tracking.Meta = &summaryMeta{ ToolVersion: "unknown" }
+    tracking.Meta.PeriodStart, tracking.Meta.PeriodEnd = timelinePeriod(tracking.Timeline)
+  }
+
+  if tracking.SchemaVersion < summarySchemaVersion {
+    tracking.Meta.UpgradedFrom = tracking.SchemaVersion
+    tracking.SchemaVersion = summarySchemaVersion
+  }
+
+  if tracking.Meta == nil {
+    tracking.Meta = initSummaryMeta()
+  }
+  return nil
+}
+
+// openLog opens a log file for scanLog (gunzipping .gz files and - for stdin)
+func openLog (filename string) (io.Reader, func() (error), error) {
+  if filename == "-" {
+    return os.Stdin, func() (error) { return nil }, nil
+  }
+
+  file, err := os.Open(filename)
+  if err != nil {
+    return nil, nil, err
+  }
+
+  if ! strings.HasSuffix(filename, ".gz") {
+    return file, file.Close, nil
+  }
+
+  reader, err := gzip.NewReader(file)
+  if err != nil {
+    file.Close()
+    return nil, nil, err
+  }
+  return reader, func() (error) { reader.Close(); return file.Close() }, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+  "compress/gzip"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// what jsonTracked wrote before the schema was versioned
+var testUnversionedSummary = `{"Total":20,"TotalBytes":241738,"OnCampus":5,"OnCampusBytes":20925,"OffCampus":15,"OffCampusBytes":220813,"Tracked":{"_default":{"Number":0,"Networks":{"default":{"NumRequests":0,"Hosts":{},"Base_uri":{"_total":17},"TrackHosts":false,"TrackURI":false}},"Sites":{}}}}`
+
+func writeTestFile (t *testing.T, name string, data string) (string) {
+  filename := filepath.Join(t.TempDir(), name)
+  err := os.WriteFile(filename, []byte(data), 0644)
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  return filename
+}
+
+func TestUpgradeUnversioned (t *testing.T) {
+  tracking, err := readTracked(writeTestFile(t, "old.json", testUnversionedSummary))
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+
+  if tracking.SchemaVersion != summarySchemaVersion || tracking.Meta == nil {
+    t.Errorf("summary should be upgraded to %d: %+v", summarySchemaVersion, tracking)
+    return
+  }
+  if tracking.Meta.UpgradedFrom != 1 || tracking.Meta.ToolVersion != "unknown" || tracking.Meta.Lines != 0 {
+    t.Errorf("upgraded meta is wrong: %+v", tracking.Meta)
+  }
+  if tracking.OnCampus != 5 || tracking.Tracked["_default"].Networks["default"].Base_uri["_total"] != 17 {
+    t.Errorf("counts were lost in the upgrade: %+v", tracking)
+  }
+}
+
+func TestReadNewerSchema (t *testing.T) {
+  _, err := readTracked(writeTestFile(t, "new.json", `{"SchemaVersion":99,"Total":1}`))
+  if err == nil {
+    t.Errorf("a newer schema version should be an error")
+  }
+}
+
+func TestScanLogZeroTracking (t *testing.T) {
+  config, err := testIPRanges()
+  if err != nil {
+    t.Fatalf("error=%+v", err)
+  }
+  saved := diag
+  diag = &strings.Builder{}
+  defer func() { diag = saved }()
+
+  // a zero trackedOverall (no Meta or maps) is fine to scan into
+  var tracking trackedOverall
+  err = scanLog(config, strings.NewReader(testHTMLLines[0] + "\ngarbage\n"), &tracking)
+  if err != nil || tracking.Meta == nil || tracking.Meta.Lines != 2 || tracking.Meta.ParseErrors != 1 {
+    t.Errorf("wrong meta %v %+v", err, tracking.Meta)
+  }
+}
+
+func TestScanLogMeta (t *testing.T) {
+  config, err := testIPRanges()
+  if err != nil {
+    t.Errorf("error=%+v", err)
+    return
+  }
+
+  saved := diag
+  diag = &strings.Builder{}
+  defer func() { diag = saved }()
+
+  tracking := initTrackedOverall()
+  tracking.Meta = initSummaryMeta()
+  input := strings.Join(testHTMLLines, "\n") + "\ngarbage\n"
+  err = scanLog(config, strings.NewReader(input), &tracking)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  finishSummary(&tracking)
+
+  if tracking.Meta.Lines != 4 || tracking.Meta.ParseErrors != 1 {
+    t.Errorf("should have read 4 lines with 1 parse error: %+v", tracking.Meta)
+  }
+  if tracking.Meta.PeriodStart != "2017-09-01T04" || tracking.Meta.PeriodEnd != "2017-09-01T05" {
+    t.Errorf("period is wrong: %+v", tracking.Meta)
+  }
+  if tracking.SchemaVersion != summarySchemaVersion {
+    t.Errorf("schema version should be %d and is %d", summarySchemaVersion, tracking.SchemaVersion)
+  }
+}
+
+func TestOpenLogGzip (t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "access_log.gz")
+  file, err := os.Create(filename)
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+  gz := gzip.NewWriter(file)
+  gz.Write([]byte(mainTopLevel + "\n"))
+  gz.Close()
+  file.Close()
+
+  input, closer, err := openLog(filename)
+  if err != nil {
+    t.Errorf("error=%s", err)
+    return
+  }
+  defer closer()
+
+  config, _ := testIPRanges()
+  tracking := initTrackedOverall()
+  tracking.Meta = initSummaryMeta()
+  scanLog(config, input, &tracking)
+  if tracking.Total != 1 {
+    t.Errorf("should have read 1 request from the gzip file: %+v", tracking.campusSplit)
+  }
+}
+
+func TestConfigHash (t *testing.T) {
+  filename := writeTestFile(t, "ipnets.json", `[ { "name": "10net", "net": "10.0.0.0/8" } ]`)
+  config, err := buildIPRanges(filename)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  if len(config.hash) != 64 || config.hash != hashConfig([]byte(`[ { "name": "10net", "net": "10.0.0.0/8" } ]`)) {
+    t.Errorf("config hash is wrong: %s", config.hash)
+  }
+}
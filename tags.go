@@ -0,0 +1,92 @@
+package main
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// Tags are free form labels on the network, vhost and site entries (and from the tag rules) - usually
+// key=value like team=web or role=proxy so everything with the same tag can be rolled up without
+// picking the network names apart.
+
+// splitTags reads the comma separated tags of an ipnets.json entry
+func splitTags (tags string) ([]string) {
+  var list []string
+  for _, tag := range strings.Split(tags, ",") {
+    if tag = strings.TrimSpace(tag); tag != "" {
+      list = append(list, tag)
+    }
+  }
+  return list
+}
+
+func checkTags (tags []string) (error) {
+  for _, tag := range tags {
+    if strings.TrimSpace(tag) == "" || strings.Contains(tag, ",") {
+      return fmt.Errorf("bad tag %q (key=value or a word without commas)", tag)
+    }
+    if strings.HasPrefix(tag, "=") || strings.HasSuffix(tag, "=") {
+      return fmt.Errorf("bad tag %q (key=value needs both)", tag)
+    }
+  }
+  return nil
+}
+
+// entryTags are the tags of the network, vhost and site entries that decided an entry followed by the ones
+// the rules added (each once)
+func entryTags (config logConfig, d entryDecision) ([]string) {
+  var all []string
+  if d.NetworkRule >= 0 && d.NetworkRule < len(config.ipranges) {
+    all = append(all, config.ipranges[d.NetworkRule].tags...)
+  }
+  if d.VHostRule != "" {
+    all = append(all, config.vhostTags[d.VHostRule]...)
+  }
+  if d.SiteRule != "" {
+    all = append(all, config.siteTags[d.SiteRule]...)
+  }
+  all = append(all, d.Tags...)
+
+  var tags []string
+  seen := make(map[string]bool)
+  for _, tag := range all {
+    if !seen[tag] {
+      seen[tag] = true
+      tags = append(tags, tag)
+    }
+  }
+  return tags
+}
+
+// trackTags adds the entry to the split of each of its tags (the map is made on the first tag)
+func trackTags (tags map[string]campusSplit, names []string, ignore bool, onCampus bool, bytes int64) (map[string]campusSplit) {
+  for _, name := range names {
+    if tags == nil {
+      tags = make(map[string]campusSplit)
+    }
+    split := tags[name]
+    addToSplit(&split, ignore, onCampus, bytes)
+    tags[name] = split
+  }
+  return tags
+}
+
+// buildReportTags lists the tags in name order (so the values of a key end up together)
+func buildReportTags (label string, tags map[string]campusSplit) (*reportTags) {
+  if len(tags) == 0 {
+    return nil
+  }
+
+  var names []string
+  for name := range tags {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+
+  report := &reportTags{ Label: label }
+  for _, name := range names {
+    report.Tags = append(report.Tags, reportTag{ name, reportSplit{ "", tags[name] } })
+  }
+  return report
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+)
+
+const testTagsConfig = `[
+  { "name": "webproxy:wp-app", "net": "10.241.0.0/16", "tags": "role=proxy, team=web" },
+  { "name": "10net", "net": "10.0.0.0/8", "tags": "department=IST" },
+  { "virtual": "testdomain1", "status": "track", "tags": "team=web" },
+  { "site": "htbin", "status": "track", "tags": "department=IST" }
+]`
+
+func TestSplitTags (t *testing.T) {
+  tags := splitTags(" role=proxy, ,team=web,")
+  if strings.Join(tags, "|") != "role=proxy|team=web" {
+    t.Errorf("wrong tags %q", tags)
+  }
+  for tag, ok := range map[string]bool{ "role=proxy": true, "proxy": true, "": false, "a,b": false, "=x": false, "x=": false } {
+    if (checkTags([]string{ tag }) == nil) != ok {
+      t.Errorf("%q should be ok=%t", tag, ok)
+    }
+  }
+}
+
+func TestTrackTags (t *testing.T) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.json", testTagsConfig))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  // 10.241.26.100 is a proxy, 100.241.26.100 has no network and the last one goes to testdomain1
+  lines := append(append([]string{}, testCSVLines[:2]...), strings.Replace(testCSVLines[2], "off:http", "off:http x testdomain1", 1))
+  tracking := initTrackedOverall()
+  for num, line := range lines {
+    trackEntry(lc.config, &tracking, ParseAccess(num, line))
+  }
+
+  // the proxy entries carry the network tags and the site tag and each tag counts an entry once
+  if tracking.Tags["role=proxy"].Total != 2 || tracking.Tags["team=web"].Total != 2 || tracking.Tags["department=IST"].Total != 3 {
+    t.Errorf("wrong overall tags %+v", tracking.Tags)
+  }
+  if len(tracking.Tracked["_default"].Tags) != 3 || tracking.Tracked["testdomain1"].Tags["team=web"].Total != 1 {
+    t.Errorf("wrong vhost tags %+v %+v", tracking.Tracked["_default"].Tags, tracking.Tracked["testdomain1"].Tags)
+  }
+
+  var buf bytes.Buffer
+  tmpl, name, _ := loadReportTemplate("")
+  err = writeTextReport(&buf, tmpl, name, reportLimits{}, tracking)
+  if err != nil {
+    t.Errorf("error=%s", err)
+  }
+  for _, want := range []string {
+    "*** tags (all vhosts)\n  department=IST: requests= 3 (on campus 2, off campus 1, ignored 0) kbytes= 4\n  role=proxy: requests= 2",
+    "*** tags-testdomain1\n  department=IST: requests= 1",
+  } {
+    if !strings.Contains(buf.String(), want) {
+      t.Errorf("missing %q in:\n%s", want, buf.String())
+    }
+  }
+}
+
+func TestTypedTags (t *testing.T) {
+  lc, err := loadConfig(testConfigFile(t, "ipnets.yaml", `networks:
+  - name: proxy
+    net: 10.241.0.0/16
+    tags: [role=proxy]
+sites:
+  - name: "^ht.*"
+    tags: [department=IST]
+rules:
+  - name: errors
+    when: ["ret in 500..599"]
+    action: tag
+    value: role=proxy
+`))
+  if err != nil {
+    t.Fatalf("error=%s", err)
+  }
+
+  d := classifyEntry(lc.config, ParseAccess(0, strings.Replace(testCSVLines[0], " 200 ", " 503 ", 1)), nil)
+  if strings.Join(d.Tags, ",") != "role=proxy,department=IST" {
+    t.Errorf("wrong tags %v", d.Tags)
+  }
+
+  _, err = buildIPRanges(testConfigFile(t, "bad.yaml", "vhosts:\n  - name: x\n    tags: [\"a,b\"]\n"))
+  if err == nil || !strings.Contains(err.Error(), "vhosts[0]: bad tag") {
+    t.Errorf("expected a bad tag error got %v", err)
+  }
+}